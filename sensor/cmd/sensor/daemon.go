@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/asset_discovery/sensor/internal/capture"
+	"github.com/asset_discovery/sensor/internal/output"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// sensorIdentity describes the sensor in every summary it writes
+type sensorIdentity struct {
+	osName     string
+	ifaceName  string
+	localIP    string
+	interfaces []output.SegmentInfo
+	selfIPs    []string
+}
+
+// runDaemon captures until the context is cancelled, writing a summary
+// every interval. Traffic statistics cover a single window while the
+// device registry accumulates over the whole run. SIGHUP reloads the
+// config file and SIGTERM/SIGINT write a final summary before exiting.
+func runDaemon(ctx context.Context, cmd *cobra.Command, p *pipeline, engine *capture.Engine, id sensorIdentity) error {
+	if interval <= 0 {
+		return fmt.Errorf("--interval must be at least 1 minute")
+	}
+
+	fmt.Printf(color.YellowString("Capturing continuously, summary every %d minutes... (Ctrl+C to stop)\n"), interval)
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- engine.Start(ctx, 0)
+	}()
+
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	defer signal.Stop(hupChan)
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Minute)
+	defer ticker.Stop()
+
+	windowStart := time.Now()
+	var windowBase int64
+	var statsBase capture.Stats
+
+	// writeWindow summarizes the window that just ended and starts the next.
+	// The final window also closes the packet recording.
+	writeWindow := func(final bool) error {
+		var summary *output.Summary
+		now := time.Now()
+		engine.Quiesce(func() {
+			count := engine.PacketCount()
+			summary = p.buildSummary(id.osName, id.ifaceName, id.localIP, p.traffic.Rotate())
+			summary.SetCaptureInfo(windowStart, int(now.Sub(windowStart).Seconds()), count-windowBase)
+			p.attachRecordings(summary, final)
+			windowBase = count
+		})
+		stats := engine.Stats()
+		summary.SetCaptureStats(captureStats(stats.Since(statsBase)), dropWarn/100)
+		statsBase = stats
+		summary.SetInterfaces(id.interfaces)
+		windowStart = now
+
+		return writeSummary(summary)
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := writeWindow(false); err != nil {
+				color.Red("Summary failed: %v", err)
+			}
+
+		case <-hupChan:
+			fmt.Println("\nReloading configuration...")
+			if err := reloadDaemon(cmd, engine, id); err != nil {
+				color.Red("Reload failed: %v", err)
+				continue
+			}
+			ticker.Reset(time.Duration(interval) * time.Minute)
+			color.Green("Configuration reloaded (summary every %d minutes)", interval)
+
+		case err := <-errChan:
+			// Capture ended (signal or source closed); flush the last window
+			if werr := writeWindow(true); werr != nil {
+				color.Red("Final summary failed: %v", werr)
+			}
+			if err != nil {
+				return fmt.Errorf("capture failed: %w", err)
+			}
+			return nil
+		}
+	}
+}
+
+// reloadDaemon re-reads the config file and applies the settings that
+// can change while capturing: interval, retention, output, drop warning
+// threshold, filters and VLAN selection
+func reloadDaemon(cmd *cobra.Command, engine *capture.Engine, id sensorIdentity) error {
+	if configFile == "" {
+		return fmt.Errorf("no --config file to reload")
+	}
+
+	// Keep the current settings if the new file is invalid
+	prevInterval, prevRetain, prevOutput, prevDropWarn := interval, retain, outputDir, dropWarn
+	prevFilter, prevSelf, prevHosts, prevNets := bpfFilter, excludeSelf, excludeHosts, excludeNets
+	prevVLANs := vlans
+	restore := func() {
+		interval, retain, outputDir, dropWarn = prevInterval, prevRetain, prevOutput, prevDropWarn
+		bpfFilter, excludeSelf, excludeHosts, excludeNets = prevFilter, prevSelf, prevHosts, prevNets
+		vlans = prevVLANs
+	}
+
+	if err := loadConfigFile(cmd); err != nil {
+		restore()
+		return err
+	}
+	if interval <= 0 {
+		restore()
+		return fmt.Errorf("interval must be at least 1 minute")
+	}
+
+	var captureConfig capture.Config
+	applyFilterFlags(&captureConfig, id.selfIPs)
+	if err := engine.UpdateFilter(captureConfig.Filter, captureConfig.ExcludeHosts, captureConfig.ExcludeNets); err != nil {
+		restore()
+		return err
+	}
+	if err := engine.SetVLANs(captureConfig.VLANs); err != nil {
+		restore()
+		return err
+	}
+
+	return nil
+}
@@ -5,33 +5,83 @@ import (
 	"fmt"
 	"net"
 	"os"
-	"os/signal"
-	"syscall"
+	"strings"
 	"time"
 
 	"github.com/asset_discovery/sensor/internal/capture"
+	"github.com/asset_discovery/sensor/internal/config"
 	"github.com/asset_discovery/sensor/internal/discovery"
-	"github.com/asset_discovery/sensor/internal/fingerprint"
 	"github.com/asset_discovery/sensor/internal/iface"
-	"github.com/asset_discovery/sensor/internal/oui"
 	"github.com/asset_discovery/sensor/internal/output"
 	"github.com/asset_discovery/sensor/internal/platform"
-	"github.com/asset_discovery/sensor/internal/traffic"
 	"github.com/asset_discovery/sensor/pkg/consent"
 	"github.com/fatih/color"
-	"github.com/gopacket/gopacket"
 	"github.com/spf13/cobra"
 )
 
 var (
 	// CLI flags
 	listIfaces bool
-	ifaceName  string
+	ifaceNames []string
 	autoIface  bool
 	duration   int
 	activeMode bool
+	activeMDNS bool
+	activeSSDP bool
+	targets    []string
+	activePPS  int
+	pingModes  []string
+	pingPorts  []int
+	portProbe  bool
+	probePorts []int
+	probeHosts int
+	nameQuery  bool
+	activeSNMP bool
 	outputDir  string
 	skipCheck  bool
+	readFile   string
+	realtime   bool
+	localNet   string
+
+	// Capture filter flags
+	bpfFilter    string
+	excludeSelf  bool
+	excludeHosts []string
+	excludeNets  []string
+	vlans        []int
+
+	// Daemon mode flags
+	daemonMode bool
+	interval   int
+	retain     int
+	configFile string
+
+	// Dispatch flags
+	workers   int
+	queueSize int
+	backend   string
+	ringSize  int
+
+	// Sampling flags
+	sampleRate int
+	sampleMode string
+
+	// Capture health flags
+	dropWarn float64
+
+	// Recording flags
+	recordMode    bool
+	recordSize    int
+	recordAge     int
+	recordBudget  int
+	recordHeaders bool
+
+	// Fault isolation flags
+	quarantine     bool
+	quarantinePath string // Quarantine file for this run, set from --quarantine
+
+	// Settings only read from the config file
+	snmpCommunities []string
 )
 
 func main() {
@@ -48,12 +98,49 @@ to build an inventory of devices and their behaviors.`,
 
 	// Flags
 	rootCmd.Flags().BoolVar(&listIfaces, "list-ifaces", false, "List available network interfaces and exit")
-	rootCmd.Flags().StringVar(&ifaceName, "iface", "", "Network interface to capture on")
+	rootCmd.Flags().StringSliceVar(&ifaceNames, "iface", nil, "Network interface(s) to capture on, comma-separated for concurrent capture")
 	rootCmd.Flags().BoolVar(&autoIface, "auto-iface", true, "Automatically select the best interface")
 	rootCmd.Flags().IntVar(&duration, "duration", 30, "Capture duration in seconds (30 or 60)")
 	rootCmd.Flags().BoolVar(&activeMode, "active", false, "Enable active discovery (ARP sweep)")
+	rootCmd.Flags().BoolVar(&activeMDNS, "mdns", false, "With --active, also browse mDNS/DNS-SD services")
+	rootCmd.Flags().BoolVar(&activeSSDP, "ssdp", false, "With --active, also search for UPnP devices and fetch their descriptions")
+	rootCmd.Flags().StringSliceVar(&targets, "targets", nil, "With --active, only probe these IPv4 addresses, CIDR prefixes and ranges (e.g. 10.1.0.0/22,10.1.4.10-10.1.4.50)")
+	rootCmd.Flags().IntVar(&activePPS, "active-pps", discovery.DefaultRate, "Active probe packets per second")
+	rootCmd.Flags().StringSliceVar(&pingModes, "ping", nil, "With --active, also ping the targets (or the subnet): echo, timestamp, syn and/or ack")
+	rootCmd.Flags().IntSliceVar(&pingPorts, "ping-ports", discovery.DefaultPingPorts, "TCP ports for syn and ack pings")
+	rootCmd.Flags().BoolVar(&nameQuery, "name-query", false, "With --active, ask discovered hosts for their NetBIOS names (NBSTAT) and LLMNR reverse name")
+	rootCmd.Flags().BoolVar(&activeSNMP, "snmp", false, "With --active, query the SNMP system group of discovered hosts with the config file's snmpCommunities")
+	rootCmd.Flags().BoolVar(&portProbe, "port-probe", false, "With --active, SYN-probe --probe-ports on the discovered devices")
+	rootCmd.Flags().IntSliceVar(&probePorts, "probe-ports", discovery.DefaultProbePorts, "TCP ports of the port probe")
+	rootCmd.Flags().IntVar(&probeHosts, "probe-max-hosts", discovery.DefaultProbeHosts, "Most devices the port probe covers")
 	rootCmd.Flags().StringVar(&outputDir, "output", ".", "Output directory for summary files")
 	rootCmd.Flags().BoolVar(&skipCheck, "skip-prereq", false, "Skip prerequisite checks")
+	rootCmd.Flags().StringVar(&readFile, "read", "", "Replay packets from a pcap/pcapng file or named pipe (\"-\" for stdin) instead of capturing live")
+	rootCmd.Flags().BoolVar(&realtime, "realtime", false, "Replay at the original capture rate instead of as fast as possible")
+	rootCmd.Flags().StringVar(&localNet, "local-net", "", "Local network in CIDR form, telling local from external traffic (default: the /16 of the sensor's address; needed with --read)")
+	rootCmd.Flags().StringVar(&bpfFilter, "filter", "", "BPF expression restricting captured traffic (e.g. \"not port 22\")")
+	rootCmd.Flags().BoolVar(&excludeSelf, "exclude-self", false, "Ignore traffic to and from the sensor's own addresses")
+	rootCmd.Flags().StringSliceVar(&excludeHosts, "exclude-host", nil, "Ignore traffic to and from these IP addresses")
+	rootCmd.Flags().StringSliceVar(&excludeNets, "exclude-net", nil, "Ignore traffic to and from these CIDR subnets")
+	rootCmd.Flags().IntSliceVar(&vlans, "vlan", nil, "Only analyze traffic on these 802.1Q VLAN IDs (0 for untagged)")
+	rootCmd.Flags().BoolVar(&daemonMode, "daemon", false, "Capture continuously, writing a summary every --interval minutes")
+	rootCmd.Flags().IntVar(&interval, "interval", 15, "Minutes between summaries in daemon mode")
+	rootCmd.Flags().IntVar(&retain, "retain", 0, "Number of summary files to keep in the output directory (0 keeps all)")
+	rootCmd.Flags().StringVar(&configFile, "config", "", "JSON config file (reloaded on SIGHUP in daemon mode)")
+	rootCmd.Flags().IntVar(&workers, "workers", 1, "Packet processing workers; packets are sharded by flow so per-flow order is kept")
+	rootCmd.Flags().IntVar(&queueSize, "queue-size", 1024, "Packets buffered per worker before capture blocks")
+	rootCmd.Flags().StringVar(&backend, "backend", capture.DefaultBackend, "Live capture backend: pcap, or afpacket on Linux (one fanout socket per worker)")
+	rootCmd.Flags().IntVar(&ringSize, "ring-size", 64, "AF_PACKET ring buffer size in MB per interface")
+	rootCmd.Flags().IntVar(&sampleRate, "sample", 0, "Analyze 1 in N packets on high-rate links, scaling traffic counts (discovery packets are always analyzed)")
+	rootCmd.Flags().StringVar(&sampleMode, "sample-mode", capture.SampleByPacket, "Sampling mode: packet (every Nth packet) or flow (all packets of 1 in N flows)")
+
+	rootCmd.Flags().Float64Var(&dropWarn, "drop-warn", 1, "Warn in the summary when more than this percentage of packets is dropped (0 disables)")
+	rootCmd.Flags().BoolVar(&recordMode, "record", false, "Also record packets to pcapng files in the output directory")
+	rootCmd.Flags().IntVar(&recordSize, "record-size", 100, "Start a new recording file after this many MB (0 for no limit, which needs --record-budget 0)")
+	rootCmd.Flags().IntVar(&recordAge, "record-age", 0, "Start a new recording file after this many minutes (0 for no limit)")
+	rootCmd.Flags().IntVar(&recordBudget, "record-budget", 1024, "Delete the oldest recordings to stay within this many MB (0 for no limit)")
+	rootCmd.Flags().BoolVar(&recordHeaders, "record-headers", false, "Record protocol headers only, truncating payloads")
+	rootCmd.Flags().BoolVar(&quarantine, "quarantine", false, "Save packets that make an analyzer panic to a pcapng file in the output directory")
 
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
@@ -69,6 +156,11 @@ func runSensor(cmd *cobra.Command, args []string) error {
 		return listInterfaces(selector)
 	}
 
+	// Load the config file over the flag defaults
+	if err := loadConfigFile(cmd); err != nil {
+		return err
+	}
+
 	// Check consent
 	if err := consent.CheckAndPromptConsent(); err != nil {
 		return err
@@ -81,6 +173,11 @@ func runSensor(cmd *cobra.Command, args []string) error {
 	fmt.Printf("\n%s\n", color.CyanString("Local Network Visibility Sensor"))
 	fmt.Printf("OS: %s %s (%s)\n", osInfo.Name, osInfo.Version, osInfo.Arch)
 
+	// Replaying a file needs neither privileges nor an interface
+	if readFile != "" {
+		return runReplay(cmd, osInfo)
+	}
+
 	// Check prerequisites
 	if !skipCheck {
 		if err := detector.CheckPrerequisites(); err != nil {
@@ -93,90 +190,188 @@ func runSensor(cmd *cobra.Command, args []string) error {
 		color.Green("Prerequisites satisfied.")
 	}
 
-	// Select interface
-	var selectedIface *iface.InterfaceInfo
-	var err error
+	// Select interfaces
+	selectedIfaces, err := selectInterfaces(selector)
+	if err != nil {
+		return err
+	}
 
-	if ifaceName != "" {
-		selectedIface, err = selector.GetInterfaceByName(ifaceName)
-		if err != nil {
-			return fmt.Errorf("interface %q not found: %w", ifaceName, err)
+	captureIfaces := make([]capture.Interface, 0, len(selectedIfaces))
+	names := make([]string, 0, len(selectedIfaces))
+	for _, info := range selectedIfaces {
+		ci := capture.Interface{Name: info.Name}
+		subnet, subnetErr := getLocalSubnet(info)
+		if subnetErr == nil {
+			ci.Subnet = subnet.String()
 		}
-	} else if autoIface {
-		selectedIface, err = selector.AutoSelect()
-		if err != nil {
-			return fmt.Errorf("auto-select failed: %w", err)
+		captureIfaces = append(captureIfaces, ci)
+		names = append(names, info.Name)
+
+		fmt.Printf("Interface: %s\n", color.GreenString(info.Name))
+		if len(info.IPs) > 0 {
+			fmt.Printf("  Local IP: %s\n", info.IPs[0])
+		}
+		if ci.Subnet != "" {
+			fmt.Printf("  Subnet: %s\n", ci.Subnet)
+		} else if len(info.IPs) > 0 {
+			color.Yellow("  Subnet: unknown (%v)", subnetErr)
 		}
-	} else {
-		return fmt.Errorf("no interface specified. Use --iface or --auto-iface")
 	}
-
-	fmt.Printf("Interface: %s\n", color.GreenString(selectedIface.Name))
-	if len(selectedIface.IPs) > 0 {
-		fmt.Printf("Local IP: %s\n", selectedIface.IPs[0])
+	if daemonMode {
+		fmt.Printf("Mode: daemon (summary every %d minutes)\n", interval)
+	} else {
+		fmt.Printf("Duration: %d seconds\n", duration)
 	}
-	fmt.Printf("Duration: %d seconds\n", duration)
 	fmt.Printf("Active discovery: %v\n", activeMode)
 	fmt.Printf("Output: %s\n", outputDir)
 	fmt.Println()
 
-	// Get local IP and MAC for active discovery
-	localIP := getLocalIP(selectedIface)
-	localMAC := getLocalMAC(selectedIface.Name)
-	localSubnet := getLocalSubnet(selectedIface)
+	// The first interface provides the sensor's identity in the summary
+	localIP := getLocalIP(selectedIfaces[0])
 
 	// Initialize components
-	ouiLookup := oui.NewLookup()
-	deviceRegistry := discovery.NewDeviceRegistry()
-	passiveDiscovery := discovery.NewPassiveDiscovery(deviceRegistry, ouiLookup)
-	trafficAnalyzer := traffic.NewAnalyzer(localIP.String())
-	fingerprintEngine := fingerprint.NewEngine(deviceRegistry)
+	p := newPipeline(localIP.String())
+	if err := p.setLocalNet(); err != nil {
+		return err
+	}
 
 	// Create capture engine
-	captureConfig := capture.DefaultConfig(selectedIface.Name)
+	var selfIPs []string
+	for _, info := range selectedIfaces {
+		selfIPs = append(selfIPs, info.IPs...)
+	}
+
+	captureConfig := capture.DefaultConfig()
+	captureConfig.Interfaces = captureIfaces
+	captureConfig.Workers = workers
+	captureConfig.QueueSize = queueSize
+	captureConfig.Backend = backend
+	captureConfig.RingSize = ringSize << 20
+	captureConfig.SampleRate = sampleRate
+	captureConfig.SampleMode = sampleMode
+	applyFilterFlags(&captureConfig, selfIPs)
+	applyHandlerFlags(&captureConfig)
 	captureEngine, err := capture.NewEngine(captureConfig)
 	if err != nil {
 		return fmt.Errorf("failed to create capture engine: %w", err)
 	}
 
 	// Add packet handlers
-	captureEngine.AddHandler(func(packet gopacket.Packet) {
-		passiveDiscovery.ProcessPacket(packet)
-		trafficAnalyzer.ProcessPacket(packet)
-		fingerprintEngine.ProcessPacket(packet)
-	})
+	p.attach(captureEngine)
+	if err := p.startRecording(captureEngine, captureConfig.SnapLen); err != nil {
+		return err
+	}
 
 	// Setup signal handling
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := signalContext("Stopping capture...")
 	defer cancel()
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
-	go func() {
-		<-sigChan
-		fmt.Println("\nStopping capture...")
-		cancel()
-	}()
+	if filter := captureEngine.Filter(); filter != "" {
+		fmt.Printf("Filter: %s\n", filter)
+	}
+	if backend != capture.DefaultBackend {
+		fmt.Printf("Backend: %s\n", backend)
+	}
 
 	// Run active discovery first if enabled
 	if activeMode {
+		if activePPS <= 0 {
+			return fmt.Errorf("--active-pps must be positive")
+		}
+		if activeSNMP && len(snmpCommunities) == 0 {
+			return fmt.Errorf("--snmp needs snmpCommunities in the --config file")
+		}
 		fmt.Println(color.YellowString("Running active discovery..."))
-		activeDisc := discovery.NewActiveDiscovery(
-			deviceRegistry,
-			ouiLookup,
-			selectedIface.Name,
-			localIP,
-			localMAC,
-			localSubnet,
+		var (
+			sweeps      []*discovery.ActiveDiscovery
+			sweepIfaces []string
+			subnets     []*net.IPNet
 		)
+		for _, info := range selectedIfaces {
+			subnet, err := getLocalSubnet(info)
+			if err != nil {
+				color.Yellow("Active discovery warning (%s): %v", info.Name, err)
+				continue
+			}
+			activeDisc := discovery.NewActiveDiscovery(
+				p.registry,
+				p.ouiLookup,
+				info.Name,
+				getLocalIP(info),
+				getLocalMAC(info.Name),
+				subnet,
+			)
+			activeDisc.SetBackend(backend)
+			if err := activeDisc.SetTargets(targets); err != nil {
+				return err
+			}
+			if err := activeDisc.CheckSize(); err != nil {
+				return fmt.Errorf("cannot sweep %s: %w; choose the ranges to probe with --targets", info.Name, err)
+			}
+			activeDisc.SetRate(activePPS)
+			activeDisc.SetMDNS(activeMDNS)
+			activeDisc.SetSSDP(activeSSDP)
+			activeDisc.SetSignalHandler(p.fingerprint.AddSignal)
+			activeDisc.SetTTLHandler(p.fingerprint.AddTTL)
+			activeDisc.SetRekeyHandler(p.fingerprint.Rekey)
+			sweeps = append(sweeps, activeDisc)
+			sweepIfaces = append(sweepIfaces, info.Name)
+			subnets = append(subnets, subnet)
+		}
+		if len(sweeps) == 0 {
+			color.Yellow("Active discovery warning: no interface has a usable subnet, skipping it")
+		}
 
-		activeCtx, activeCancel := context.WithTimeout(ctx, 10*time.Second)
-		if err := activeDisc.Run(activeCtx); err != nil {
-			color.Yellow("Active discovery warning: %v", err)
+		for i, activeDisc := range sweeps {
+			// Routed targets are reached through the routing table
+			// whichever interface sends, so they are pinged once
+			if i == 0 || len(targets) == 0 {
+				if err := activeDisc.SetPing(pingModes); err != nil {
+					return err
+				}
+				if err := activeDisc.SetPingPorts(pingPorts); err != nil {
+					return err
+				}
+			}
+			// After the last interface's sweep, so every discovered
+			// device is probed once, on whichever subnet it was found
+			if i == len(sweeps)-1 {
+				activeDisc.SetScope(subnets)
+				activeDisc.SetNameQueries(nameQuery)
+				if activeSNMP {
+					activeDisc.SetSNMP(snmpCommunities)
+				}
+				if portProbe {
+					if err := activeDisc.SetPortProbe(probePorts, probeHosts); err != nil {
+						return err
+					}
+				}
+			}
+
+			timeout := activeDisc.Timeout()
+			fmt.Printf("Sweeping %d addresses on %s at %d pps (up to %s)\n",
+				activeDisc.SweepSize(), sweepIfaces[i], activePPS, timeout.Round(time.Second))
+
+			// Each probe bounds its own waits; this caps the whole run
+			activeCtx, activeCancel := context.WithTimeout(ctx, timeout)
+			if err := activeDisc.Run(activeCtx); err != nil {
+				color.Yellow("Active discovery warning (%s): %v", sweepIfaces[i], err)
+			}
+			activeCancel()
 		}
-		activeCancel()
-		fmt.Printf("Active discovery found %d devices\n", deviceRegistry.Count())
+		fmt.Printf("Active discovery found %d devices\n", p.registry.Count())
+	}
+
+	id := sensorIdentity{
+		osName:     osInfo.Name,
+		ifaceName:  strings.Join(names, ","),
+		localIP:    localIP.String(),
+		interfaces: segmentInfos(captureIfaces),
+		selfIPs:    selfIPs,
+	}
+
+	if daemonMode {
+		return runDaemon(ctx, cmd, p, captureEngine, id)
 	}
 
 	// Start passive capture
@@ -187,35 +382,121 @@ func runSensor(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("capture failed: %w", err)
 	}
 
-	// Apply fingerprints
-	fingerprintEngine.ApplyFingerprints()
-
 	// Build summary
-	summary := output.NewSummary(
-		osInfo.Name,
-		platform.GetHostname(),
-		selectedIface.Name,
-		localIP.String(),
-	)
-
+	summary := p.buildSummary(id.osName, id.ifaceName, id.localIP, p.traffic.GetResults())
 	summary.SetCaptureInfo(startTime, duration, captureEngine.PacketCount())
-	summary.SetDevices(deviceRegistry.ToInfoSlice())
-	summary.SetTraffic(trafficAnalyzer.GetResults())
+	summary.SetCaptureStats(captureStats(captureEngine.Stats()), dropWarn/100)
+	summary.SetInterfaces(id.interfaces)
+	p.attachRecordings(summary, true)
+
+	return writeSummary(summary)
+}
+
+// applyFilterFlags copies the capture filter and VLAN flags into the
+// config. selfIPs are excluded when --exclude-self is set.
+func applyFilterFlags(cfg *capture.Config, selfIPs []string) {
+	cfg.Filter = bpfFilter
+	cfg.ExcludeHosts = append(cfg.ExcludeHosts, excludeHosts...)
+	if excludeSelf {
+		cfg.ExcludeHosts = append(cfg.ExcludeHosts, selfIPs...)
+	}
+	cfg.ExcludeNets = append(cfg.ExcludeNets, excludeNets...)
+	cfg.VLANs = vlans
+}
 
-	// Print summary
-	fmt.Println(summary.PrettyPrint())
+// loadConfigFile applies the --config file to every flag that was not
+// given explicitly on the command line
+func loadConfigFile(cmd *cobra.Command) error {
+	if configFile == "" {
+		return nil
+	}
 
-	// Write summary file
-	generator := output.NewGenerator(outputDir)
-	filepath, err := generator.Generate(summary)
+	cfg, err := config.Load(configFile)
 	if err != nil {
-		return fmt.Errorf("failed to write summary: %w", err)
+		return err
 	}
 
-	color.Green("\nSummary written to: %s", filepath)
+	flags := cmd.Flags()
+	if cfg.Output != "" && !flags.Changed("output") {
+		outputDir = cfg.Output
+	}
+	if cfg.Interval != nil && !flags.Changed("interval") {
+		interval = *cfg.Interval
+	}
+	if cfg.Retain != nil && !flags.Changed("retain") {
+		retain = *cfg.Retain
+	}
+	if !flags.Changed("filter") {
+		bpfFilter = cfg.Filter
+	}
+	if cfg.ExcludeSelf != nil && !flags.Changed("exclude-self") {
+		excludeSelf = *cfg.ExcludeSelf
+	}
+	if !flags.Changed("exclude-host") {
+		excludeHosts = cfg.ExcludeHosts
+	}
+	if !flags.Changed("exclude-net") {
+		excludeNets = cfg.ExcludeNets
+	}
+	if !flags.Changed("vlan") {
+		vlans = cfg.VLANs
+	}
+	if cfg.DropWarn != nil && !flags.Changed("drop-warn") {
+		dropWarn = *cfg.DropWarn
+	}
+	if !flags.Changed("targets") {
+		targets = cfg.Targets
+	}
+	if cfg.ActivePPS != nil && !flags.Changed("active-pps") {
+		activePPS = *cfg.ActivePPS
+	}
+	snmpCommunities = cfg.SNMPCommunities
 	return nil
 }
 
+// selectInterfaces resolves the --iface list, or auto-selects a single interface
+func selectInterfaces(selector *iface.Selector) ([]*iface.InterfaceInfo, error) {
+	if len(ifaceNames) > 0 {
+		seen := make(map[string]bool)
+		result := make([]*iface.InterfaceInfo, 0, len(ifaceNames))
+		for _, name := range ifaceNames {
+			name = strings.TrimSpace(name)
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			info, err := selector.GetInterfaceByName(name)
+			if err != nil {
+				return nil, fmt.Errorf("interface %q not found: %w", name, err)
+			}
+			result = append(result, info)
+		}
+		if len(result) > 0 {
+			return result, nil
+		}
+	}
+
+	if autoIface {
+		info, err := selector.AutoSelect()
+		if err != nil {
+			return nil, fmt.Errorf("auto-select failed: %w", err)
+		}
+		return []*iface.InterfaceInfo{info}, nil
+	}
+
+	return nil, fmt.Errorf("no interface specified. Use --iface or --auto-iface")
+}
+
+// segmentInfos converts capture interfaces to their summary form
+func segmentInfos(ifaces []capture.Interface) []output.SegmentInfo {
+	result := make([]output.SegmentInfo, 0, len(ifaces))
+	for _, i := range ifaces {
+		result = append(result, output.SegmentInfo{Interface: i.Name, Subnet: i.Subnet})
+	}
+	return result
+}
+
 func listInterfaces(selector *iface.Selector) error {
 	ifaces, err := selector.ListInterfaces()
 	if err != nil {
@@ -233,10 +514,10 @@ func getLocalIP(ifaceInfo *iface.InterfaceInfo) net.IP {
 			return ip
 		}
 	}
-	// Fallback to first IPv4
+	// Fallback to the first routable IPv4 address, skipping link-local ones
 	for _, ipStr := range ifaceInfo.IPs {
 		ip := net.ParseIP(ipStr)
-		if ip != nil && ip.To4() != nil {
+		if ip != nil && ip.To4() != nil && ip.IsGlobalUnicast() {
 			return ip
 		}
 	}
@@ -256,20 +537,17 @@ func getLocalMAC(ifaceName string) net.HardwareAddr {
 	return nil
 }
 
-func getLocalSubnet(ifaceInfo *iface.InterfaceInfo) *net.IPNet {
-	for _, ipStr := range ifaceInfo.IPs {
-		ip := net.ParseIP(ipStr)
-		if ip == nil || !iface.IsRFC1918(ip) {
-			continue
-		}
-
-		// Assume /24 for simplicity (common home/office network)
-		// A more robust implementation would get the actual mask
-		mask := net.CIDRMask(24, 32)
-		return &net.IPNet{
-			IP:   ip.Mask(mask),
-			Mask: mask,
-		}
+// getLocalSubnet returns the subnet of the interface's local IP. A
+// guessed netmask would sweep or omit the wrong hosts, so an unknown one
+// is an error.
+func getLocalSubnet(ifaceInfo *iface.InterfaceInfo) (*net.IPNet, error) {
+	ip := getLocalIP(ifaceInfo)
+	if ip == nil {
+		return nil, fmt.Errorf("no IPv4 address on %s", ifaceInfo.Name)
 	}
-	return nil
+	subnet := iface.GetLocalSubnet(ip, ifaceInfo.Netmask(ip))
+	if subnet == nil {
+		return nil, fmt.Errorf("netmask of %s on %s is unknown", ip, ifaceInfo.Name)
+	}
+	return subnet, nil
 }
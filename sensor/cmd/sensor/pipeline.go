@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/asset_discovery/sensor/internal/capture"
+	"github.com/asset_discovery/sensor/internal/discovery"
+	"github.com/asset_discovery/sensor/internal/fingerprint"
+	"github.com/asset_discovery/sensor/internal/oui"
+	"github.com/asset_discovery/sensor/internal/output"
+	"github.com/asset_discovery/sensor/internal/platform"
+	"github.com/asset_discovery/sensor/internal/record"
+	"github.com/asset_discovery/sensor/internal/traffic"
+	"github.com/fatih/color"
+)
+
+// pipeline bundles the analyzers that consume captured packets
+type pipeline struct {
+	ouiLookup   *oui.Lookup
+	registry    *discovery.DeviceRegistry
+	passive     *discovery.PassiveDiscovery
+	traffic     *traffic.Analyzer
+	fingerprint *fingerprint.Engine
+	recorder    *record.Recorder // Set when --record is enabled
+}
+
+// newPipeline creates the analyzers for a capture session
+func newPipeline(localIP string) *pipeline {
+	ouiLookup := oui.NewLookup()
+	registry := discovery.NewDeviceRegistry()
+
+	return &pipeline{
+		ouiLookup:   ouiLookup,
+		registry:    registry,
+		passive:     discovery.NewPassiveDiscovery(registry, ouiLookup),
+		traffic:     traffic.NewAnalyzer(localIP),
+		fingerprint: fingerprint.NewEngine(registry),
+	}
+}
+
+// setLocalNet applies --local-net to the traffic analyzer
+func (p *pipeline) setLocalNet() error {
+	if localNet == "" {
+		return nil
+	}
+	_, ipNet, err := net.ParseCIDR(localNet)
+	if err != nil {
+		return fmt.Errorf("invalid --local-net %q: %w", localNet, err)
+	}
+	p.traffic.SetLocalNet(ipNet)
+	return nil
+}
+
+// attach registers every analyzer with the engine as its own handler,
+// so each is timed separately and a failure in one does not stop the others
+func (p *pipeline) attach(engine *capture.Engine) {
+	engine.AddHandler("passive", p.passive.ProcessPacket)
+	engine.AddHandler("traffic", p.traffic.ProcessPacket)
+	engine.AddHandler("fingerprint", p.fingerprint.ProcessPacket)
+}
+
+// maxLoggedPanics is how many panics are logged per handler; later ones
+// are only counted
+const maxLoggedPanics = 5
+
+// applyHandlerFlags sets up panic logging and, with --quarantine, the
+// file receiving packets that make a handler panic
+func applyHandlerFlags(cfg *capture.Config) {
+	cfg.OnPanic = logHandlerPanic
+	quarantinePath = ""
+	if quarantine {
+		quarantinePath = filepath.Join(outputDir, fmt.Sprintf("quarantine_%s.pcapng", time.Now().Format("20060102_150405")))
+		cfg.QuarantineFile = quarantinePath
+	}
+}
+
+// logHandlerPanic reports a recovered handler panic
+func logHandlerPanic(p capture.HandlerPanic) {
+	if p.Count > maxLoggedPanics {
+		return
+	}
+	msg := fmt.Sprintf("The %s analyzer panicked: %v", p.Handler, p.Value)
+	if p.Quarantined {
+		msg += fmt.Sprintf(" (packet saved to %s)", quarantinePath)
+	}
+	color.Red(msg)
+	if p.Count == 1 {
+		fmt.Fprintf(os.Stderr, "%s\n", p.Stack)
+	}
+	if p.Count == maxLoggedPanics {
+		color.Red("Further panics from the %s analyzer are counted but not logged", p.Handler)
+	}
+}
+
+// startRecording records packets into the output directory when --record is set
+func (p *pipeline) startRecording(engine *capture.Engine, snapLen int32) error {
+	if !recordMode {
+		return nil
+	}
+
+	recorder, err := record.NewRecorder(record.Config{
+		Dir:         outputDir,
+		MaxFileSize: int64(recordSize) << 20,
+		MaxFileAge:  time.Duration(recordAge) * time.Minute,
+		MaxTotal:    int64(recordBudget) << 20,
+		HeadersOnly: recordHeaders,
+		SnapLen:     int(snapLen),
+	})
+	if err != nil {
+		return err
+	}
+
+	p.recorder = recorder
+	// Sampling and VLAN selection thin out analysis, not the evidence
+	engine.AddTap("recorder", recorder.WritePacket)
+	return nil
+}
+
+// attachRecordings references the files recorded since the last summary.
+// The final summary closes the recording; otherwise a new file is started.
+func (p *pipeline) attachRecordings(summary *output.Summary, final bool) {
+	if p.recorder == nil {
+		return
+	}
+
+	cut := p.recorder.Cut
+	if final {
+		cut = p.recorder.Close
+	}
+	recordings, err := cut()
+	summary.SetRecordings(recordings)
+	if err != nil {
+		summary.AddWarning(fmt.Sprintf("packet recording is incomplete: %v", err))
+	}
+}
+
+// buildSummary applies fingerprints and collects the device registry
+// along with the given traffic statistics
+func (p *pipeline) buildSummary(osName, ifaceName, localIP string, trafficInfo output.TrafficInfo) *output.Summary {
+	p.fingerprint.ApplyFingerprints()
+
+	summary := output.NewSummary(
+		osName,
+		platform.GetHostname(),
+		ifaceName,
+		localIP,
+	)
+	summary.SetDevices(p.registry.ToInfoSlice())
+	summary.SetTraffic(trafficInfo)
+	return summary
+}
+
+// captureStats converts the engine's health counters for the summary
+func captureStats(stats capture.Stats) output.CaptureStats {
+	result := output.CaptureStats{
+		Received:       stats.Received,
+		Dropped:        stats.Dropped,
+		IfDropped:      stats.IfDropped,
+		DropRate:       stats.DropRate(),
+		DecodeErrors:   stats.DecodeErrors,
+		QueueHighWater: stats.QueueHighWater,
+		QueueCapacity:  stats.QueueCapacity,
+		QueueStalls:    stats.QueueStalls,
+	}
+
+	if sampleRate > 1 {
+		result.Sampling = &output.SamplingInfo{
+			Mode:    sampleMode,
+			Rate:    sampleRate,
+			Skipped: stats.Skipped,
+		}
+	}
+
+	for _, h := range stats.Handlers {
+		result.Handlers = append(result.Handlers, output.HandlerStats{
+			Name:        h.Name,
+			Packets:     h.Packets,
+			TimeMs:      float64(h.Time) / float64(time.Millisecond),
+			Panics:      h.Panics,
+			Quarantined: h.Quarantined,
+		})
+		if h.Quarantined > 0 {
+			result.QuarantineFile = filepath.Base(quarantinePath)
+		}
+	}
+
+	// Per-interface counters only add information with several interfaces
+	if len(stats.Interfaces) > 1 {
+		for _, s := range stats.Interfaces {
+			result.Interfaces = append(result.Interfaces, output.InterfaceStats{
+				Interface:    s.Interface.Name,
+				Received:     s.Received,
+				Dropped:      s.Dropped,
+				IfDropped:    s.IfDropped,
+				DecodeErrors: s.DecodeErrors,
+			})
+		}
+	}
+	return result
+}
+
+// writeSummary prints the summary and writes it to the output directory
+func writeSummary(summary *output.Summary) error {
+	fmt.Println(summary.PrettyPrint())
+
+	generator := output.NewGenerator(outputDir)
+	generator.SetRetain(retain)
+	filepath, err := generator.Generate(summary)
+	if err != nil {
+		return fmt.Errorf("failed to write summary: %w", err)
+	}
+
+	color.Green("\nSummary written to: %s", filepath)
+	return nil
+}
+
+// signalContext returns a context that is cancelled on SIGINT or SIGTERM
+func signalContext(message string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case <-sigChan:
+			fmt.Println("\n" + message)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/asset_discovery/sensor/internal/capture"
+	"github.com/asset_discovery/sensor/internal/platform"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// runReplay runs the analysis pipeline against a saved capture file
+func runReplay(cmd *cobra.Command, osInfo platform.OSInfo) error {
+	if activeMode {
+		return fmt.Errorf("active discovery cannot be used with --read")
+	}
+
+	// Replay the whole file unless a duration was explicitly requested
+	replayDuration := 0
+	if cmd.Flags().Changed("duration") {
+		replayDuration = duration
+	}
+
+	fmt.Printf("Replay file: %s\n", color.GreenString(readFile))
+	if localNet != "" {
+		fmt.Printf("Local network: %s\n", localNet)
+	}
+	if realtime {
+		fmt.Println("Pacing: real-time")
+	} else {
+		fmt.Println("Pacing: as fast as possible")
+	}
+	fmt.Printf("Output: %s\n", outputDir)
+	fmt.Println()
+
+	// Initialize components; the sensor's own address is unknown for a saved file
+	p := newPipeline("")
+	if err := p.setLocalNet(); err != nil {
+		return err
+	}
+
+	// Create capture engine
+	captureConfig := capture.DefaultConfig()
+	captureConfig.ReadFile = readFile
+	captureConfig.Realtime = realtime
+	captureConfig.Workers = workers
+	captureConfig.QueueSize = queueSize
+	captureConfig.SampleRate = sampleRate
+	captureConfig.SampleMode = sampleMode
+	applyFilterFlags(&captureConfig, nil)
+	applyHandlerFlags(&captureConfig)
+	captureEngine, err := capture.NewEngine(captureConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create capture engine: %w", err)
+	}
+
+	if filter := captureEngine.Filter(); filter != "" {
+		fmt.Printf("Filter: %s\n", filter)
+	}
+
+	p.attach(captureEngine)
+	if err := p.startRecording(captureEngine, captureConfig.SnapLen); err != nil {
+		return err
+	}
+
+	// Setup signal handling
+	ctx, cancel := signalContext("Stopping replay...")
+	defer cancel()
+
+	fmt.Println(color.YellowString("Replaying capture... (Ctrl+C to stop early)"))
+
+	if err := captureEngine.Start(ctx, time.Duration(replayDuration)*time.Second); err != nil {
+		return fmt.Errorf("replay failed: %w", err)
+	}
+
+	// Time the summary by the packets in the file rather than the wall clock
+	startTime := time.Now()
+	spanSeconds := 0
+	if first, last := captureEngine.CaptureSpan(); !first.IsZero() {
+		startTime = first
+		spanSeconds = int(last.Sub(first).Seconds())
+	}
+
+	summary := p.buildSummary(osInfo.Name, filepath.Base(readFile), "", p.traffic.GetResults())
+	summary.SetCaptureInfo(startTime, spanSeconds, captureEngine.PacketCount())
+	summary.SetCaptureStats(captureStats(captureEngine.Stats()), dropWarn/100)
+	summary.SetSourceFile(readFile)
+	if localNet == "" {
+		summary.AddWarning("no --local-net given: all traffic is counted as external")
+	}
+	p.attachRecordings(summary, true)
+
+	return writeSummary(summary)
+}
@@ -6,6 +6,7 @@ require (
 	github.com/fatih/color v1.16.0
 	github.com/gopacket/gopacket v1.3.1
 	github.com/spf13/cobra v1.8.0
+	golang.org/x/net v0.28.0
 	golang.org/x/sys v0.24.0
 )
 
@@ -0,0 +1,185 @@
+//go:build linux
+
+package capture
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/afpacket"
+	"github.com/gopacket/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+// afpacketPollTimeout bounds how long a read waits on the ring, so that
+// Close never has to wait long for a reader to let go of it
+const afpacketPollTimeout = 100 * time.Millisecond
+
+// afpacketSource is an AF_PACKET socket with a TPACKET_V3 ring buffer
+type afpacketSource struct {
+	mu       sync.Mutex // Held while reading; Close unmaps the ring
+	tp       *afpacket.TPacket
+	snapLen  int32
+	linkType layers.LinkType
+	closed   bool
+}
+
+// openAFPacket opens the given number of AF_PACKET sockets on the
+// interface, sharing ringSize bytes of ring buffer between them. Several
+// sockets join a fanout group, in which the kernel hashes each flow (in
+// both directions) to a single socket.
+func openAFPacket(ifaceName string, snapLen int32, promisc bool, sockets int, ringSize int, group uint16) ([]PacketSource, error) {
+	if sockets < 1 {
+		sockets = 1
+	}
+	blocks := ringSize / sockets / afpacket.DefaultBlockSize
+	if blocks < 8 {
+		blocks = 8
+	}
+
+	linkType := interfaceLinkType(ifaceName)
+
+	var sources []PacketSource
+	fail := func(err error) ([]PacketSource, error) {
+		for _, src := range sources {
+			src.Close()
+		}
+		return nil, fmt.Errorf("failed to open AF_PACKET socket on %s: %w", ifaceName, err)
+	}
+
+	for i := 0; i < sockets; i++ {
+		tp, err := afpacket.NewTPacket(
+			afpacket.OptInterface(ifaceName),
+			afpacket.OptTPacketVersion(afpacket.TPacketVersion3),
+			afpacket.OptBlockSize(afpacket.DefaultBlockSize),
+			afpacket.OptNumBlocks(blocks),
+			afpacket.OptPollTimeout(afpacketPollTimeout),
+			// Put back VLAN tags the NIC stripped so trunks can be segmented
+			afpacket.OptAddVLANHeader(true),
+		)
+		if err != nil {
+			return fail(err)
+		}
+		sources = append(sources, &afpacketSource{tp: tp, snapLen: snapLen, linkType: linkType})
+
+		if promisc {
+			if err := tp.SetPromiscuous(true); err != nil {
+				return fail(err)
+			}
+		}
+		if sockets > 1 {
+			if err := tp.SetFanout(afpacket.FanoutHash|afpacket.FanoutHashWithDefrag, group); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	return sources, nil
+}
+
+// Linux ARPHRD_* hardware types whose frames carry an Ethernet header
+const (
+	arphrdEther    = 1
+	arphrdLoopback = 772
+)
+
+// interfaceLinkType returns the link type of frames read from an
+// interface. Ethernet and loopback devices deliver Ethernet frames;
+// tunnels (tun, WireGuard, IP-in-IP) have no link header, so their
+// packets start at the IP header.
+func interfaceLinkType(ifaceName string) layers.LinkType {
+	data, err := os.ReadFile("/sys/class/net/" + ifaceName + "/type")
+	if err != nil {
+		return layers.LinkTypeEthernet
+	}
+	switch hwType, _ := strconv.Atoi(strings.TrimSpace(string(data))); hwType {
+	case arphrdEther, arphrdLoopback:
+		return layers.LinkTypeEthernet
+	default:
+		return layers.LinkTypeRaw
+	}
+}
+
+// ReadPacketData copies the next packet out of the ring, truncated to
+// the snapshot length. It returns io.EOF once the socket is closed.
+func (s *afpacketSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return nil, gopacket.CaptureInfo{}, io.EOF
+		}
+
+		data, ci, err := s.tp.ZeroCopyReadPacketData()
+		if err == nil {
+			if s.snapLen > 0 && len(data) > int(s.snapLen) {
+				data = data[:s.snapLen]
+			}
+			data = append([]byte(nil), data...)
+			ci.CaptureLength = len(data)
+		}
+		s.mu.Unlock()
+
+		// Poll timeouts only release the ring for Close; keep waiting
+		if errors.Is(err, afpacket.ErrTimeout) {
+			continue
+		}
+		return data, ci, err
+	}
+}
+
+// LinkType returns the link type of packets read from the socket
+func (s *afpacketSource) LinkType() layers.LinkType {
+	return s.linkType
+}
+
+// Close releases the socket and its ring buffer
+func (s *afpacketSource) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		s.tp.Close()
+	}
+}
+
+// SetBPFFilter compiles the expression and attaches it to the socket.
+// An empty expression removes filtering.
+func (s *afpacketSource) SetBPFFilter(expr string) error {
+	var program []bpf.RawInstruction
+	var err error
+	if expr == "" {
+		// Accept every packet in full
+		program, err = bpf.Assemble([]bpf.Instruction{bpf.RetConstant{Val: 0x40000}})
+	} else {
+		program, err = compileBPF(s.LinkType(), s.snapLen, expr)
+	}
+	if err != nil {
+		return err
+	}
+	return s.tp.SetBPF(program)
+}
+
+// WritePacketData transmits a raw frame on the interface
+func (s *afpacketSource) WritePacketData(data []byte) error {
+	return s.tp.WritePacketData(data)
+}
+
+// captureStats reports the kernel's socket counters. The kernel counts
+// dropped packets in its packet total, so they are subtracted here.
+func (s *afpacketSource) captureStats() (InterfaceStats, error) {
+	_, v3, err := s.tp.SocketStats()
+	if err != nil {
+		return InterfaceStats{}, err
+	}
+	return InterfaceStats{
+		Received: int64(v3.Packets()) - int64(v3.Drops()),
+		Dropped:  int64(v3.Drops()),
+	}, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package capture
+
+import "fmt"
+
+// openAFPacket is only available on Linux
+func openAFPacket(ifaceName string, snapLen int32, promisc bool, sockets int, ringSize int, group uint16) ([]PacketSource, error) {
+	return nil, fmt.Errorf("the afpacket backend is only available on Linux")
+}
@@ -3,192 +3,530 @@ package capture
 import (
 	"context"
 	"fmt"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
-
-	"github.com/gopacket/gopacket"
-	"github.com/gopacket/gopacket/layers"
-	"github.com/gopacket/gopacket/pcap"
 )
 
-// PacketHandler is called for each captured packet
-type PacketHandler func(packet gopacket.Packet)
+// PacketHandler is called for each captured packet with its decoded
+// metadata, which is only valid until the handler returns
+type PacketHandler func(packet *PacketMeta)
 
 // Engine manages packet capture
 type Engine struct {
-	handle       *pcap.Handle
-	ifaceName    string
-	snapLen      int32
-	promisc      bool
-	timeout      time.Duration
+	cfg          Config
+	filter       string // Compiled-in BPF expression (user filter plus exclusions)
+	sources      []*taggedSource
+	sourceMutex  sync.Mutex
+	finalStats   []InterfaceStats // Source counters captured when the sources closed
+	queue        queueStats
 	packetCount  atomic.Int64
-	handlers     []PacketHandler
+	handlers     []*handler
 	handlerMutex sync.RWMutex
+	hasTaps      atomic.Bool
+	quarantine   *quarantine             // Set when Config.QuarantineFile is given
+	vlans        atomic.Pointer[vlanSet] // VLANs selected for analysis; nil selects all
+	sampleCount  atomic.Uint64           // Packets offered to 1-in-N sampling
+	skipped      atomic.Int64            // Packets left out by sampling
+
+	// Timestamps of the first and last packets seen, in Unix nanoseconds
+	firstPacket atomic.Int64
+	lastPacket  atomic.Int64
+}
+
+// Interface identifies a capture interface. It is attached to every
+// packet read from that interface so analyzers can attribute traffic.
+type Interface struct {
+	Name   string
+	Subnet string // Local subnet of the interface in CIDR form, if known
 }
 
 // Config holds capture configuration
 type Config struct {
-	InterfaceName string
-	SnapLen       int32         // Snapshot length (default 1600)
-	Promiscuous   bool          // Promiscuous mode (default true)
-	Timeout       time.Duration // Read timeout
+	Interfaces     []Interface        // Interfaces captured concurrently
+	SnapLen        int32              // Snapshot length (default 1600)
+	Promiscuous    bool               // Promiscuous mode (default true)
+	Timeout        time.Duration      // Read timeout
+	ReadFile       string             // Replay packets from a pcap/pcapng file ("-" for stdin) instead of the interfaces
+	Realtime       bool               // Pace non-live packets by their capture timestamps
+	Source         PacketSource       // Use this source instead of opening the interfaces or file
+	Filter         string             // BPF expression restricting what is captured
+	ExcludeHosts   []string           // IP addresses whose traffic is ignored (e.g. the sensor itself)
+	ExcludeNets    []string           // CIDR subnets whose traffic is ignored
+	Workers        int                // Dispatch workers; 1 runs handlers on the capture goroutine
+	QueueSize      int                // Packets queued per worker before capture blocks
+	Backend        string             // Live capture backend: BackendPcap or BackendAFPacket
+	RingSize       int                // AF_PACKET ring buffer bytes per interface
+	VLANs          []int              // Only analyze packets on these VLAN IDs (0 = untagged); empty analyzes all
+	OnPanic        func(HandlerPanic) // Called after a handler panic is recovered; may run on several workers at once
+	QuarantineFile string             // Write packets that make a handler panic to this pcapng file
+	SampleRate     int                // Analyze 1 in N packets (0 or 1 analyzes all); discovery packets are always analyzed
+	SampleMode     string             // SampleByPacket (default) or SampleByFlow
 }
 
+// Live capture backends
+const (
+	BackendPcap     = "pcap"     // libpcap (Npcap on Windows)
+	BackendAFPacket = "afpacket" // Linux AF_PACKET with a TPACKET_V3 ring, fanned out to the workers
+)
+
 // DefaultConfig returns sensible default configuration
-func DefaultConfig(ifaceName string) Config {
+func DefaultConfig(ifaceNames ...string) Config {
+	ifaces := make([]Interface, 0, len(ifaceNames))
+	for _, name := range ifaceNames {
+		ifaces = append(ifaces, Interface{Name: name})
+	}
+
 	return Config{
-		InterfaceName: ifaceName,
-		SnapLen:       1600, // Enough for most headers
-		Promiscuous:   true,
-		Timeout:       pcap.BlockForever,
+		Interfaces:  ifaces,
+		SnapLen:     1600, // Enough for most headers
+		Promiscuous: true,
+		Timeout:     blockForever,
+		Workers:     1,
+		QueueSize:   1024,
+		Backend:     DefaultBackend,
+		RingSize:    64 << 20,
 	}
 }
 
-// NewEngine creates a new capture engine
+// NewEngine creates a new capture engine. The capture filter is built
+// here; it is compiled for each source's link type once the source is
+// opened, so a bad expression fails Start before any packet is read.
 func NewEngine(cfg Config) (*Engine, error) {
-	return &Engine{
-		ifaceName: cfg.InterfaceName,
-		snapLen:   cfg.SnapLen,
-		promisc:   cfg.Promiscuous,
-		timeout:   cfg.Timeout,
-		handlers:  make([]PacketHandler, 0),
-	}, nil
+	switch cfg.Backend {
+	case "":
+		cfg.Backend = DefaultBackend
+	case BackendPcap, BackendAFPacket:
+	default:
+		return nil, fmt.Errorf("unknown capture backend %q (use %s or %s)", cfg.Backend, BackendPcap, BackendAFPacket)
+	}
+
+	if err := validateSampling(&cfg); err != nil {
+		return nil, err
+	}
+
+	filter, err := BuildFilter(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Engine{
+		cfg:      cfg,
+		filter:   filter,
+		handlers: make([]*handler, 0),
+	}
+	if cfg.QuarantineFile != "" {
+		e.quarantine = &quarantine{path: cfg.QuarantineFile}
+	}
+	if err := e.SetVLANs(cfg.VLANs); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Filter returns the BPF expression applied to captured packets
+func (e *Engine) Filter() string {
+	e.sourceMutex.Lock()
+	defer e.sourceMutex.Unlock()
+	return e.filter
+}
+
+// UpdateFilter replaces the capture filter, including on sources that
+// are already capturing. The new filter is validated against the link
+// type of every open source before any of them is changed.
+func (e *Engine) UpdateFilter(filter string, excludeHosts, excludeNets []string) error {
+	e.sourceMutex.Lock()
+	defer e.sourceMutex.Unlock()
+
+	cfg := e.cfg
+	cfg.Filter = filter
+	cfg.ExcludeHosts = excludeHosts
+	cfg.ExcludeNets = excludeNets
+
+	expr, err := BuildFilter(cfg)
+	if err != nil {
+		return err
+	}
+	for _, src := range e.sources {
+		if _, ok := src.PacketSource.(bpfSetter); !ok {
+			return fmt.Errorf("capture source does not support changing the filter while running")
+		}
+		if err := ValidateFilter(expr, src.LinkType(), cfg.SnapLen); err != nil {
+			return err
+		}
+	}
+
+	for _, src := range e.sources {
+		if err := src.PacketSource.(bpfSetter).SetBPFFilter(expr); err != nil {
+			return fmt.Errorf("failed to set capture filter: %w", err)
+		}
+	}
+
+	e.cfg = cfg
+	e.filter = expr
+	return nil
 }
 
-// AddHandler adds a packet handler
-func (e *Engine) AddHandler(h PacketHandler) {
+// vlanSet is a selection of VLAN IDs, with 0 standing for untagged traffic
+type vlanSet map[uint16]bool
+
+// SetVLANs restricts analysis to packets on the given VLAN IDs, where 0
+// selects untagged packets. A QinQ packet matches on either tag. An
+// empty list analyzes every packet. It can be called while capturing.
+func (e *Engine) SetVLANs(ids []int) error {
+	if len(ids) == 0 {
+		e.vlans.Store(nil)
+		return nil
+	}
+
+	set := make(vlanSet, len(ids))
+	for _, id := range ids {
+		if id < 0 || id > 4094 {
+			return fmt.Errorf("invalid VLAN ID %d (must be 0-4094, 0 for untagged)", id)
+		}
+		set[uint16(id)] = true
+	}
+	e.vlans.Store(&set)
+	return nil
+}
+
+// selected reports whether a packet is on a selected VLAN
+func (e *Engine) selected(packet *PacketMeta) bool {
+	set := e.vlans.Load()
+	if set == nil {
+		return true
+	}
+	if len(packet.VLANs) == 0 {
+		return (*set)[0]
+	}
+	for _, id := range packet.VLANs {
+		if (*set)[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// AddHandler adds a packet handler. The name identifies it in the
+// timing and panic counters.
+func (e *Engine) AddHandler(name string, h PacketHandler) {
+	e.handlerMutex.Lock()
+	defer e.handlerMutex.Unlock()
+	e.handlers = append(e.handlers, &handler{name: name, fn: h})
+}
+
+// AddTap adds a handler that sees every packet the sources deliver,
+// before VLAN selection and sampling leave any out, such as a recorder
+// keeping complete evidence. Taps run on the capture goroutines and are
+// timed and recovered like handlers.
+func (e *Engine) AddTap(name string, h PacketHandler) {
 	e.handlerMutex.Lock()
 	defer e.handlerMutex.Unlock()
-	e.handlers = append(e.handlers, h)
+	e.handlers = append(e.handlers, &handler{name: name, fn: h, tap: true})
+	e.hasTaps.Store(true)
 }
 
-// Start begins packet capture for the specified duration
+// Start begins packet capture for the specified duration.
+// A duration of zero or less captures until the context is cancelled or,
+// when replaying a file, until the end of the file is reached.
+// Packets from multiple interfaces are merged into one stream, except
+// with afpacket fanout where each socket dispatches its own flows.
 func (e *Engine) Start(ctx context.Context, duration time.Duration) error {
-	// Open the capture handle
-	handle, err := pcap.OpenLive(e.ifaceName, e.snapLen, e.promisc, e.timeout)
+	// Open the packet sources
+	sources, live, err := e.openSources()
 	if err != nil {
-		return fmt.Errorf("failed to open interface %s: %w", e.ifaceName, err)
+		return err
 	}
-	e.handle = handle
-	defer func() {
-		handle.Close()
-		e.handle = nil
-	}()
+	e.sourceMutex.Lock()
+	e.sources = sources
+	e.sourceMutex.Unlock()
 
-	// Create packet source
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-	packetSource.DecodeOptions.Lazy = true
-	packetSource.DecodeOptions.NoCopy = true
+	// Closing the sources also unblocks readers waiting for a packet
+	var closeOnce sync.Once
+	closeSources := func() {
+		closeOnce.Do(func() {
+			e.sourceMutex.Lock()
+			defer e.sourceMutex.Unlock()
+			e.finalStats = make([]InterfaceStats, 0, len(sources))
+			for _, src := range sources {
+				e.finalStats = append(e.finalStats, src.stats())
+				src.Close()
+			}
+			e.sources = nil
+		})
+	}
+	defer closeSources()
+	if e.quarantine != nil {
+		defer e.quarantine.close()
+	}
 
 	// Create timeout context
-	captureCtx, cancel := context.WithTimeout(ctx, duration)
+	captureCtx, cancel := context.WithCancel(ctx)
+	if duration > 0 {
+		captureCtx, cancel = context.WithTimeout(ctx, duration)
+	}
 	defer cancel()
 
+	// With kernel fanout each socket receives whole flows, so every
+	// reader dispatches its own packets instead of funnelling them
+	// through the capture loop
+	if live && e.cfg.Backend == BackendAFPacket && e.cfg.Workers > 1 {
+		var wg sync.WaitGroup
+		for _, src := range sources {
+			wg.Add(1)
+			go func(src *taggedSource) {
+				defer wg.Done()
+				src.readPackets(captureCtx, func(packet *PacketMeta) bool {
+					e.tapPacket(packet)
+					if !e.selected(packet) {
+						packet.Release()
+						return true
+					}
+					e.countPacket(packet)
+					if !e.sample(packet) {
+						packet.Release()
+						return true
+					}
+					e.handlePacket(packet)
+					return true
+				})
+			}(src)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-captureCtx.Done():
+			closeSources()
+			<-done
+		}
+		return nil
+	}
+
+	// Read every source concurrently into one stream
+	packets := make(chan *PacketMeta)
+	deliver := func(packet *PacketMeta) bool {
+		select {
+		case packets <- packet:
+			return true
+		case <-captureCtx.Done():
+			return false
+		}
+	}
+	var wg sync.WaitGroup
+	for _, src := range sources {
+		wg.Add(1)
+		go func(src *taggedSource) {
+			defer wg.Done()
+			src.readPackets(captureCtx, deliver)
+		}(src)
+	}
+	go func() {
+		wg.Wait()
+		close(packets)
+	}()
+
+	pacer := newPacer(e.cfg.Realtime && !live)
+
+	// Hand packets to a worker pool when parallel dispatch is enabled.
+	// Stopping the pool drains the queues, so no packet is lost at the end.
+	dispatch := e.handlePacket
+	if e.cfg.Workers > 1 {
+		queueSize := e.cfg.QueueSize
+		if queueSize <= 0 {
+			queueSize = 1
+		}
+		pool := newWorkerPool(e.cfg.Workers, queueSize, &e.queue, e.handlePacket)
+		defer pool.stop()
+		dispatch = pool.submit
+	}
+
 	// Capture loop
 	for {
 		select {
 		case <-captureCtx.Done():
 			return nil
-		case packet, ok := <-packetSource.Packets():
+		case packet, ok := <-packets:
 			if !ok {
 				return nil
 			}
-			e.packetCount.Add(1)
-			e.dispatchPacket(packet)
+			e.tapPacket(packet)
+			if !e.selected(packet) {
+				packet.Release()
+				continue
+			}
+			if !pacer.wait(captureCtx, packet.Timestamp) {
+				packet.Release()
+				return nil
+			}
+			e.countPacket(packet)
+			if !e.sample(packet) {
+				packet.Release()
+				continue
+			}
+			dispatch(packet)
 		}
 	}
 }
 
-// dispatchPacket sends the packet to all handlers
-func (e *Engine) dispatchPacket(packet gopacket.Packet) {
-	e.handlerMutex.RLock()
-	defer e.handlerMutex.RUnlock()
-	for _, h := range e.handlers {
-		h(packet)
-	}
-}
-
-// PacketCount returns the number of packets captured
-func (e *Engine) PacketCount() int64 {
-	return e.packetCount.Load()
-}
+// openSources opens the configured packet sources with the capture
+// filter applied, and reports whether they are live interfaces
+func (e *Engine) openSources() (sources []*taggedSource, live bool, err error) {
+	defer func() {
+		if err != nil {
+			for _, src := range sources {
+				src.Close()
+			}
+			sources = nil
+		}
+	}()
 
-// ExtractMACs extracts source and destination MAC addresses from a packet
-func ExtractMACs(packet gopacket.Packet) (srcMAC, dstMAC string) {
-	if ethLayer := packet.Layer(layers.LayerTypeEthernet); ethLayer != nil {
-		eth := ethLayer.(*layers.Ethernet)
-		return eth.SrcMAC.String(), eth.DstMAC.String()
+	filter := e.Filter()
+	add := func(source PacketSource, iface Interface) error {
+		// Sources differ in link type (Ethernet, cooked, raw IP, loopback)
+		if err := ValidateFilter(filter, source.LinkType(), e.cfg.SnapLen); err != nil {
+			source.Close()
+			return err
+		}
+		filtered, err := applyFilter(source, filter, e.cfg.SnapLen)
+		if err != nil {
+			source.Close()
+			return err
+		}
+		sources = append(sources, &taggedSource{PacketSource: filtered, iface: iface})
+		return nil
 	}
-	return "", ""
-}
 
-// ExtractIPs extracts source and destination IP addresses from a packet
-func ExtractIPs(packet gopacket.Packet) (srcIP, dstIP string) {
-	if ipv4Layer := packet.Layer(layers.LayerTypeIPv4); ipv4Layer != nil {
-		ip := ipv4Layer.(*layers.IPv4)
-		return ip.SrcIP.String(), ip.DstIP.String()
-	}
-	if ipv6Layer := packet.Layer(layers.LayerTypeIPv6); ipv6Layer != nil {
-		ip := ipv6Layer.(*layers.IPv6)
-		return ip.SrcIP.String(), ip.DstIP.String()
+	switch {
+	case e.cfg.Source != nil:
+		return sources, false, add(e.cfg.Source, Interface{})
+	case e.cfg.ReadFile != "":
+		source, err := OpenFile(e.cfg.ReadFile)
+		if err != nil {
+			return nil, false, err
+		}
+		return sources, false, add(source, Interface{})
 	}
-	return "", ""
-}
 
-// ExtractPorts extracts source and destination ports from TCP/UDP packets
-func ExtractPorts(packet gopacket.Packet) (srcPort, dstPort uint16, protocol string) {
-	if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-		tcp := tcpLayer.(*layers.TCP)
-		return uint16(tcp.SrcPort), uint16(tcp.DstPort), "TCP"
+	if len(e.cfg.Interfaces) == 0 {
+		return nil, true, fmt.Errorf("no capture interface configured")
 	}
-	if udpLayer := packet.Layer(layers.LayerTypeUDP); udpLayer != nil {
-		udp := udpLayer.(*layers.UDP)
-		return uint16(udp.SrcPort), uint16(udp.DstPort), "UDP"
+	for i, iface := range e.cfg.Interfaces {
+		var opened []PacketSource
+		switch e.cfg.Backend {
+		case BackendAFPacket:
+			// One socket per worker; fanout groups are per interface
+			group := uint16(os.Getpid()) + uint16(i)
+			opened, err = openAFPacket(iface.Name, e.cfg.SnapLen, e.cfg.Promiscuous, e.cfg.Workers, e.cfg.RingSize, group)
+			if err != nil {
+				return sources, true, err
+			}
+		default:
+			source, err := OpenLive(iface.Name, e.cfg.SnapLen, e.cfg.Promiscuous, e.cfg.Timeout)
+			if err != nil {
+				return sources, true, err
+			}
+			opened = []PacketSource{source}
+		}
+
+		for j, source := range opened {
+			if err := add(source, iface); err != nil {
+				for _, rest := range opened[j+1:] {
+					rest.Close()
+				}
+				return sources, true, err
+			}
+		}
 	}
-	return 0, 0, ""
+	return sources, true, nil
 }
 
-// GetProtocol returns the transport/network protocol name
-func GetProtocol(packet gopacket.Packet) string {
-	if packet.Layer(layers.LayerTypeTCP) != nil {
-		return "TCP"
-	}
-	if packet.Layer(layers.LayerTypeUDP) != nil {
-		return "UDP"
-	}
-	if packet.Layer(layers.LayerTypeICMPv4) != nil {
-		return "ICMP"
+// countPacket counts a packet and tracks the capture time span
+func (e *Engine) countPacket(packet *PacketMeta) {
+	e.packetCount.Add(1)
+
+	ts := packet.Timestamp
+	if ts.IsZero() {
+		return
 	}
-	if packet.Layer(layers.LayerTypeICMPv6) != nil {
-		return "ICMPv6"
+	nanos := ts.UnixNano()
+	for {
+		first := e.firstPacket.Load()
+		if first != 0 && first <= nanos || e.firstPacket.CompareAndSwap(first, nanos) {
+			break
+		}
 	}
-	if packet.Layer(layers.LayerTypeARP) != nil {
-		return "ARP"
+	for {
+		last := e.lastPacket.Load()
+		if last >= nanos || e.lastPacket.CompareAndSwap(last, nanos) {
+			break
+		}
 	}
-	if packet.Layer(layers.LayerTypeIPv6) != nil {
-		return "IPv6"
+}
+
+// handlePacket sends the packet to all handlers and then releases it.
+// With parallel dispatch it runs on several workers at once, so handlers
+// must be goroutine-safe.
+func (e *Engine) handlePacket(packet *PacketMeta) {
+	e.dispatchPacket(packet)
+	packet.Release()
+}
+
+// dispatchPacket sends the packet to all handlers. A handler that
+// panics does not stop the others or the capture.
+func (e *Engine) dispatchPacket(packet *PacketMeta) {
+	e.runHandlers(packet, false)
+}
+
+// tapPacket sends the packet to the taps
+func (e *Engine) tapPacket(packet *PacketMeta) {
+	if e.hasTaps.Load() {
+		e.runHandlers(packet, true)
 	}
-	if packet.Layer(layers.LayerTypeIPv4) != nil {
-		return "IPv4"
+}
+
+// runHandlers runs either the taps or the handlers on the packet
+func (e *Engine) runHandlers(packet *PacketMeta, taps bool) {
+	e.handlerMutex.RLock()
+	defer e.handlerMutex.RUnlock()
+	// Each handler's end time is the next one's start, halving clock reads
+	start := time.Now()
+	for _, h := range e.handlers {
+		if h.tap != taps {
+			continue
+		}
+		h.run(e, packet)
+		end := time.Now()
+		h.packets.Add(1)
+		h.nanos.Add(int64(end.Sub(start)))
+		start = end
 	}
-	return "Other"
 }
 
-// GetPacketSize returns the total packet size in bytes
-func GetPacketSize(packet gopacket.Packet) int {
-	return len(packet.Data())
+// Quiesce runs fn while no packet is being dispatched, so handler state
+// can be read consistently while a capture is running
+func (e *Engine) Quiesce(fn func()) {
+	e.handlerMutex.Lock()
+	defer e.handlerMutex.Unlock()
+	fn()
 }
 
-// GetTTL extracts the TTL from an IP packet
-func GetTTL(packet gopacket.Packet) int {
-	if ipv4Layer := packet.Layer(layers.LayerTypeIPv4); ipv4Layer != nil {
-		ip := ipv4Layer.(*layers.IPv4)
-		return int(ip.TTL)
-	}
-	if ipv6Layer := packet.Layer(layers.LayerTypeIPv6); ipv6Layer != nil {
-		ip := ipv6Layer.(*layers.IPv6)
-		return int(ip.HopLimit)
+// PacketCount returns the number of packets captured
+func (e *Engine) PacketCount() int64 {
+	return e.packetCount.Load()
+}
+
+// CaptureSpan returns the timestamps of the first and last packets seen.
+// Both are zero if no packets were captured.
+func (e *Engine) CaptureSpan() (first, last time.Time) {
+	firstNanos, lastNanos := e.firstPacket.Load(), e.lastPacket.Load()
+	if firstNanos == 0 {
+		return time.Time{}, time.Time{}
 	}
-	return 0
+	return time.Unix(0, firstNanos), time.Unix(0, lastNanos)
 }
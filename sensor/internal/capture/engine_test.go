@@ -0,0 +1,757 @@
+package capture
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+)
+
+// testPacket describes an Ethernet frame built for a test
+type testPacket struct {
+	src, dst     string
+	sport, dport uint16
+	tcp          bool
+	vlans        []uint16 // 802.1Q tags, outermost first
+	id           uint16   // IPv4 identification, telling packets apart
+}
+
+// bytes serializes the packet
+func (p testPacket) bytes(tb testing.TB) []byte {
+	tb.Helper()
+
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	stack := []gopacket.SerializableLayer{eth}
+	if len(p.vlans) > 0 {
+		eth.EthernetType = layers.EthernetTypeDot1Q
+		for i, id := range p.vlans {
+			tag := &layers.Dot1Q{VLANIdentifier: id, Type: layers.EthernetTypeIPv4}
+			if i < len(p.vlans)-1 {
+				tag.Type = layers.EthernetTypeDot1Q
+			}
+			stack = append(stack, tag)
+		}
+	}
+
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Id:       p.id,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP(p.src).To4(),
+		DstIP:    net.ParseIP(p.dst).To4(),
+	}
+	stack = append(stack, ip)
+	if p.tcp {
+		ip.Protocol = layers.IPProtocolTCP
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(p.sport), DstPort: layers.TCPPort(p.dport), ACK: true, Window: 1024}
+		if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+			tb.Fatal(err)
+		}
+		stack = append(stack, tcp)
+	} else {
+		udp := &layers.UDP{SrcPort: layers.UDPPort(p.sport), DstPort: layers.UDPPort(p.dport)}
+		if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+			tb.Fatal(err)
+		}
+		stack = append(stack, udp)
+	}
+	stack = append(stack, gopacket.Payload("test"))
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, stack...); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// reverse returns the packet of the opposite direction of the flow
+func (p testPacket) reverse() testPacket {
+	p.src, p.dst = p.dst, p.src
+	p.sport, p.dport = p.dport, p.sport
+	return p
+}
+
+// arpPacket builds an ARP request, a discovery packet
+func arpPacket(tb testing.TB) []byte {
+	tb.Helper()
+
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.Ethernet{SrcMAC: mac, DstMAC: layers.EthernetBroadcast, EthernetType: layers.EthernetTypeARP},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPRequest,
+			SourceHwAddress:   mac,
+			SourceProtAddress: net.ParseIP("10.0.0.1").To4(),
+			DstHwAddress:      make(net.HardwareAddr, 6),
+			DstProtAddress:    net.ParseIP("10.0.0.2").To4(),
+		})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// flows returns n UDP flows with a packet in each direction, numbered in
+// order by their IPv4 identification
+func flows(n int) []testPacket {
+	var packets []testPacket
+	for i := 0; i < n; i++ {
+		p := testPacket{src: "10.0.0.1", dst: "10.0.1.1", sport: uint16(40000 + i), dport: 443}
+		p.id = uint16(len(packets))
+		packets = append(packets, p)
+		r := p.reverse()
+		r.id = uint16(len(packets))
+		packets = append(packets, r)
+	}
+	return packets
+}
+
+// rawPackets serializes packets one millisecond apart
+func rawPackets(tb testing.TB, packets []testPacket) []RawPacket {
+	tb.Helper()
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	raw := make([]RawPacket, 0, len(packets))
+	for i, p := range packets {
+		raw = append(raw, RawPacket{
+			Data: p.bytes(tb),
+			Info: gopacket.CaptureInfo{Timestamp: base.Add(time.Duration(i) * time.Millisecond)},
+		})
+	}
+	return raw
+}
+
+// seen is what a test handler kept of a packet
+type seen struct {
+	id     uint16
+	flow   uint64
+	weight int64
+	arp    bool
+}
+
+// recorder is a test handler collecting the packets it was given
+type recorder struct {
+	mu      sync.Mutex
+	packets []seen
+}
+
+func (r *recorder) handle(packet *PacketMeta) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.packets = append(r.packets, seen{
+		id:     packet.IPv4.Id,
+		flow:   packet.FlowHash(),
+		weight: packet.Weight,
+		arp:    packet.Has(layers.LayerTypeARP),
+	})
+}
+
+// runEngine replays packets through an engine with the given handlers
+func runEngine(t *testing.T, cfg Config, packets []RawPacket, handlers map[string]PacketHandler) *Engine {
+	t.Helper()
+
+	cfg.Source = NewSliceSource(layers.LinkTypeEthernet, packets)
+	e, err := NewEngine(cfg)
+	if err != nil {
+		t.Fatalf("NewEngine: %v", err)
+	}
+	for name, h := range handlers {
+		e.AddHandler(name, h)
+	}
+	if err := e.Start(context.Background(), 0); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	return e
+}
+
+func TestEngineDispatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+	}{
+		{"capture goroutine", 1},
+		{"worker pool", 4},
+	}
+
+	packets := flows(50)
+	raw := rawPackets(t, packets)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.Workers = tt.workers
+			var first, second recorder
+			e := runEngine(t, cfg, raw, map[string]PacketHandler{
+				"first":  first.handle,
+				"second": second.handle,
+			})
+
+			for _, r := range []*recorder{&first, &second} {
+				if len(r.packets) != len(packets) {
+					t.Fatalf("handler saw %d packets, want %d", len(r.packets), len(packets))
+				}
+				if tt.workers == 1 {
+					for i, p := range r.packets {
+						if p.id != uint16(i) {
+							t.Fatalf("packet %d has ID %d, want capture order", i, p.id)
+						}
+					}
+				}
+			}
+
+			if got := e.PacketCount(); got != int64(len(packets)) {
+				t.Errorf("PacketCount = %d, want %d", got, len(packets))
+			}
+			firstTS, lastTS := e.CaptureSpan()
+			if !firstTS.Equal(raw[0].Info.Timestamp) || !lastTS.Equal(raw[len(raw)-1].Info.Timestamp) {
+				t.Errorf("CaptureSpan = %v-%v, want %v-%v", firstTS, lastTS, raw[0].Info.Timestamp, raw[len(raw)-1].Info.Timestamp)
+			}
+			for _, h := range e.HandlerStats() {
+				if h.Packets != int64(len(packets)) {
+					t.Errorf("handler %s counted %d packets, want %d", h.Name, h.Packets, len(packets))
+				}
+			}
+		})
+	}
+}
+
+func TestWorkerAffinity(t *testing.T) {
+	packets := flows(64)
+
+	// Both directions of a flow are queued on the same worker
+	pool := &workerPool{queues: make([]chan *PacketMeta, 4), stats: &queueStats{}}
+	for i := range pool.queues {
+		pool.queues[i] = make(chan *PacketMeta, len(packets))
+	}
+	decoder := NewDecoder(layers.LinkTypeEthernet)
+	for i := 0; i < len(packets); i += 2 {
+		fwd, err := decoder.Decode(packets[i].bytes(t), gopacket.CaptureInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rev, err := decoder.Decode(packets[i+1].bytes(t), gopacket.CaptureInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fwd.FlowHash() != rev.FlowHash() {
+			t.Fatalf("flow %d hashes differ by direction", i/2)
+		}
+
+		pool.submit(fwd)
+		pool.submit(rev)
+		for q, queue := range pool.queues {
+			if len(queue) == 1 {
+				t.Fatalf("flow %d split across workers (queue %d holds one direction)", i/2, q)
+			}
+			for len(queue) > 0 {
+				(<-queue).Release()
+			}
+		}
+	}
+
+	// Every packet of a flow is handled in capture order
+	cfg := DefaultConfig()
+	cfg.Workers = 4
+	cfg.QueueSize = 2
+	var r recorder
+	runEngine(t, cfg, rawPackets(t, packets), map[string]PacketHandler{"order": r.handle})
+
+	last := make(map[uint64]uint16)
+	for _, p := range r.packets {
+		if prev, ok := last[p.flow]; ok && p.id < prev {
+			t.Fatalf("packet %d of a flow handled after packet %d", p.id, prev)
+		}
+		last[p.flow] = p.id
+	}
+	if len(last) != 64 {
+		t.Errorf("saw %d flows, want 64", len(last))
+	}
+}
+
+func TestSampling(t *testing.T) {
+	tests := []struct {
+		name        string
+		rate        int
+		mode        string
+		wantHandled int // Of the 200 non-discovery packets; -1 checks flows instead
+	}{
+		{"off", 0, "", 200},
+		{"rate one", 1, SampleByPacket, 200},
+		{"every fourth packet", 4, SampleByPacket, 50},
+		{"one in four flows", 4, SampleByFlow, -1},
+	}
+
+	// 100 flows of two packets, then discovery packets that always pass
+	packets := rawPackets(t, flows(100))
+	const discovery = 10
+	for i := 0; i < discovery; i++ {
+		packets = append(packets, RawPacket{Data: arpPacket(t)})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.SampleRate = tt.rate
+			cfg.SampleMode = tt.mode
+			var r recorder
+			e := runEngine(t, cfg, packets, map[string]PacketHandler{"sampled": r.handle})
+
+			wantWeight := int64(1)
+			if tt.rate > 1 {
+				wantWeight = int64(tt.rate)
+			}
+			handled, arp := 0, 0
+			kept := make(map[uint64]int)
+			for _, p := range r.packets {
+				if p.arp {
+					if p.weight != 1 {
+						t.Fatalf("discovery packet has weight %d, want 1", p.weight)
+					}
+					arp++
+					continue
+				}
+				if p.weight != wantWeight {
+					t.Fatalf("packet %d has weight %d, want %d", p.id, p.weight, wantWeight)
+				}
+				handled++
+				kept[p.flow]++
+			}
+
+			if arp != discovery {
+				t.Errorf("%d discovery packets analyzed, want all %d", arp, discovery)
+			}
+			if tt.wantHandled >= 0 && handled != tt.wantHandled {
+				t.Errorf("%d packets analyzed, want %d", handled, tt.wantHandled)
+			}
+			if tt.mode == SampleByFlow {
+				if handled == 0 || handled == 200 {
+					t.Errorf("flow sampling analyzed %d of 200 packets", handled)
+				}
+				for flow, n := range kept {
+					if n != 2 {
+						t.Errorf("flow %x: %d of its 2 packets analyzed", flow, n)
+					}
+				}
+			}
+			if got := e.Stats().Skipped; got != int64(200-handled) {
+				t.Errorf("Skipped = %d, want %d", got, 200-handled)
+			}
+		})
+	}
+}
+
+func TestVLANSelection(t *testing.T) {
+	packets := []testPacket{
+		{src: "10.0.0.1", dst: "10.0.0.2", sport: 1000, dport: 53, id: 0},
+		{src: "10.0.0.1", dst: "10.0.0.2", sport: 1000, dport: 53, id: 1, vlans: []uint16{10}},
+		{src: "10.0.0.1", dst: "10.0.0.2", sport: 1000, dport: 53, id: 2, vlans: []uint16{20}},
+		{src: "10.0.0.1", dst: "10.0.0.2", sport: 1000, dport: 53, id: 3, vlans: []uint16{100, 20}},
+	}
+	raw := rawPackets(t, packets)
+
+	tests := []struct {
+		name    string
+		vlans   []int
+		wantIDs []uint16
+		wantErr bool
+	}{
+		{name: "all", wantIDs: []uint16{0, 1, 2, 3}},
+		{name: "untagged", vlans: []int{0}, wantIDs: []uint16{0}},
+		{name: "single tag", vlans: []int{10}, wantIDs: []uint16{1}},
+		{name: "inner QinQ tag", vlans: []int{20}, wantIDs: []uint16{2, 3}},
+		{name: "outer QinQ tag", vlans: []int{100}, wantIDs: []uint16{3}},
+		{name: "several", vlans: []int{0, 10}, wantIDs: []uint16{0, 1}},
+		{name: "invalid", vlans: []int{4095}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.VLANs = tt.vlans
+			if tt.wantErr {
+				cfg.Source = NewSliceSource(layers.LinkTypeEthernet, raw)
+				if _, err := NewEngine(cfg); err == nil {
+					t.Fatal("NewEngine accepted an invalid VLAN ID")
+				}
+				return
+			}
+
+			var r recorder
+			e := runEngine(t, cfg, raw, map[string]PacketHandler{"vlan": r.handle})
+			var ids []uint16
+			for _, p := range r.packets {
+				ids = append(ids, p.id)
+			}
+			if !equalIDs(ids, tt.wantIDs) {
+				t.Errorf("analyzed packets %v, want %v", ids, tt.wantIDs)
+			}
+			// Packets on other VLANs are neither counted nor analyzed
+			if got := e.PacketCount(); got != int64(len(tt.wantIDs)) {
+				t.Errorf("PacketCount = %d, want %d", got, len(tt.wantIDs))
+			}
+		})
+	}
+}
+
+func equalIDs(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestHandlerPanic(t *testing.T) {
+	tests := []struct {
+		name       string
+		quarantine bool
+	}{
+		{"recovered", false},
+		{"quarantined", true},
+	}
+
+	packets := flows(10)
+	raw := rawPackets(t, packets)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			var path string
+			if tt.quarantine {
+				path = filepath.Join(t.TempDir(), "quarantine.pcapng")
+				cfg.QuarantineFile = path
+			}
+			var (
+				mu     sync.Mutex
+				panics []HandlerPanic
+			)
+			cfg.OnPanic = func(p HandlerPanic) {
+				mu.Lock()
+				defer mu.Unlock()
+				panics = append(panics, p)
+			}
+
+			var after recorder
+			e := runEngine(t, cfg, raw, map[string]PacketHandler{
+				"faulty": func(packet *PacketMeta) {
+					if packet.IPv4.Id%4 == 0 {
+						panic("bad packet")
+					}
+				},
+				"after": after.handle,
+			})
+
+			const wantPanics = 5 // IDs 0, 4, 8, 12 and 16
+			if len(after.packets) != len(packets) {
+				t.Errorf("other handler saw %d packets, want %d", len(after.packets), len(packets))
+			}
+			if len(panics) != wantPanics {
+				t.Fatalf("OnPanic called %d times, want %d", len(panics), wantPanics)
+			}
+			for i, p := range panics {
+				if p.Handler != "faulty" || p.Value != "bad packet" || p.Count != int64(i+1) || len(p.Stack) == 0 {
+					t.Errorf("panic %d = {%s %v count %d}, want faulty's bad packet", i, p.Handler, p.Value, p.Count)
+				}
+				if p.Quarantined != tt.quarantine {
+					t.Errorf("panic %d quarantined = %v, want %v", i, p.Quarantined, tt.quarantine)
+				}
+			}
+
+			var stats HandlerStats
+			for _, h := range e.HandlerStats() {
+				if h.Name == "faulty" {
+					stats = h
+				}
+			}
+			wantQuarantined := int64(0)
+			if tt.quarantine {
+				wantQuarantined = wantPanics
+			}
+			if stats.Panics != wantPanics || stats.Quarantined != wantQuarantined || stats.Packets != int64(len(packets)) {
+				t.Errorf("faulty stats = %+v, want %d packets, %d panics, %d quarantined",
+					stats, len(packets), wantPanics, wantQuarantined)
+			}
+
+			if !tt.quarantine {
+				return
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			reader, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < wantPanics; i++ {
+				data, _, err := reader.ReadPacketData()
+				if err != nil {
+					t.Fatalf("quarantined packet %d: %v", i, err)
+				}
+				packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+				ip, _ := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+				if ip == nil || ip.Id != uint16(4*i) {
+					t.Errorf("quarantined packet %d is not the packet that panicked", i)
+				}
+			}
+			if _, _, err := reader.ReadPacketData(); err == nil {
+				t.Error("quarantine holds more packets than panicked")
+			}
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	packets := rawPackets(t, flows(5))
+	// An IPv4 header cut short fails to decode but is still counted
+	truncated := testPacket{src: "10.0.0.1", dst: "10.0.0.2", sport: 1, dport: 2}.bytes(t)[:20]
+	packets = append(packets, RawPacket{Data: truncated})
+
+	cfg := DefaultConfig()
+	var r recorder
+	e := runEngine(t, cfg, packets, map[string]PacketHandler{"count": r.handle})
+
+	stats := e.Stats()
+	if stats.Received != int64(len(packets)) {
+		t.Errorf("Received = %d, want %d", stats.Received, len(packets))
+	}
+	if stats.DecodeErrors != 1 {
+		t.Errorf("DecodeErrors = %d, want 1", stats.DecodeErrors)
+	}
+	if len(stats.Interfaces) != 1 || stats.Interfaces[0].Received != stats.Received {
+		t.Errorf("Interfaces = %+v, want one source with every packet", stats.Interfaces)
+	}
+	if len(stats.Handlers) != 1 || stats.Handlers[0].Packets != int64(len(packets)) {
+		t.Errorf("Handlers = %+v, want one handler with every packet", stats.Handlers)
+	}
+}
+
+func TestStatsSince(t *testing.T) {
+	eth0, eth1 := Interface{Name: "eth0"}, Interface{Name: "eth1"}
+	prev := Stats{
+		Received: 100, Dropped: 10, IfDropped: 1, DecodeErrors: 2, QueueStalls: 3, Skipped: 50,
+		QueueHighWater: 7,
+		Interfaces: []InterfaceStats{
+			{Interface: eth0, Received: 60, Dropped: 6, IfDropped: 1, DecodeErrors: 2},
+			{Interface: eth1, Received: 40, Dropped: 4},
+		},
+		Handlers: []HandlerStats{{Name: "passive", Packets: 100, Time: time.Second, Panics: 1, Quarantined: 1}},
+	}
+	cur := Stats{
+		Received: 250, Dropped: 15, IfDropped: 1, DecodeErrors: 5, QueueStalls: 3, Skipped: 80,
+		QueueHighWater: 9,
+		Interfaces: []InterfaceStats{
+			{Interface: eth0, Received: 160, Dropped: 8, IfDropped: 1, DecodeErrors: 5},
+			{Interface: eth1, Received: 90, Dropped: 7},
+		},
+		Handlers: []HandlerStats{
+			{Name: "passive", Packets: 250, Time: 3 * time.Second, Panics: 1, Quarantined: 1},
+			{Name: "recorder", Packets: 20, Time: time.Millisecond},
+		},
+	}
+
+	tests := []struct {
+		name string
+		prev Stats
+		want Stats
+	}{
+		{
+			name: "first window",
+			prev: Stats{},
+			want: cur,
+		},
+		{
+			name: "later window",
+			prev: prev,
+			want: Stats{
+				Received: 150, Dropped: 5, DecodeErrors: 3, Skipped: 30,
+				QueueHighWater: 9,
+				Interfaces: []InterfaceStats{
+					{Interface: eth0, Received: 100, Dropped: 2, DecodeErrors: 3},
+					{Interface: eth1, Received: 50, Dropped: 3},
+				},
+				Handlers: []HandlerStats{
+					{Name: "passive", Packets: 150, Time: 2 * time.Second},
+					{Name: "recorder", Packets: 20, Time: time.Millisecond},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := cur.Since(tt.prev)
+			if got.Received != tt.want.Received || got.Dropped != tt.want.Dropped ||
+				got.IfDropped != tt.want.IfDropped || got.DecodeErrors != tt.want.DecodeErrors ||
+				got.QueueStalls != tt.want.QueueStalls || got.Skipped != tt.want.Skipped ||
+				got.QueueHighWater != tt.want.QueueHighWater {
+				t.Errorf("totals = %+v, want %+v", got, tt.want)
+			}
+			if len(got.Interfaces) != len(tt.want.Interfaces) {
+				t.Fatalf("Interfaces = %+v, want %+v", got.Interfaces, tt.want.Interfaces)
+			}
+			for i := range got.Interfaces {
+				if got.Interfaces[i] != tt.want.Interfaces[i] {
+					t.Errorf("Interfaces[%d] = %+v, want %+v", i, got.Interfaces[i], tt.want.Interfaces[i])
+				}
+			}
+			if len(got.Handlers) != len(tt.want.Handlers) {
+				t.Fatalf("Handlers = %+v, want %+v", got.Handlers, tt.want.Handlers)
+			}
+			for i := range got.Handlers {
+				if got.Handlers[i] != tt.want.Handlers[i] {
+					t.Errorf("Handlers[%d] = %+v, want %+v", i, got.Handlers[i], tt.want.Handlers[i])
+				}
+			}
+			// The previous snapshot is left untouched
+			if prev.Interfaces[0].Received != 60 {
+				t.Error("Since modified its argument")
+			}
+		})
+	}
+}
+
+func TestInvalidFilter(t *testing.T) {
+	// The filter is compiled for the source's link type when it opens
+	cfg := DefaultConfig()
+	cfg.Filter = "udp and ("
+	cfg.Source = NewSliceSource(layers.LinkTypeRaw, rawPackets(t, flows(1)))
+	e, err := NewEngine(cfg)
+	if err != nil {
+		t.Fatalf("NewEngine: %v", err)
+	}
+	var r recorder
+	e.AddHandler("filtered", r.handle)
+	err = e.Start(context.Background(), 0)
+	if err == nil || !strings.Contains(err.Error(), "invalid capture filter") {
+		t.Fatalf("Start error = %v, want an invalid filter", err)
+	}
+	if len(r.packets) != 0 {
+		t.Errorf("%d packets analyzed despite the invalid filter", len(r.packets))
+	}
+}
+
+func TestSumByInterface(t *testing.T) {
+	eth0, eth1 := Interface{Name: "eth0", Subnet: "10.0.0.0/24"}, Interface{Name: "eth1"}
+	tests := []struct {
+		name      string
+		perSource []InterfaceStats
+		want      []InterfaceStats
+	}{
+		{
+			name:      "one source per interface",
+			perSource: []InterfaceStats{{Interface: eth0, Received: 10}, {Interface: eth1, Received: 5}},
+			want:      []InterfaceStats{{Interface: eth0, Received: 10}, {Interface: eth1, Received: 5}},
+		},
+		{
+			// afpacket fanout opens a socket per worker on each interface
+			name: "fanout sockets",
+			perSource: []InterfaceStats{
+				{Interface: eth0, Received: 10, Dropped: 1, DecodeErrors: 1},
+				{Interface: eth0, Received: 20, Dropped: 2, IfDropped: 1},
+				{Interface: eth1, Received: 5},
+				{Interface: eth1, Received: 7, Dropped: 3},
+				{Interface: eth0, Received: 30},
+			},
+			want: []InterfaceStats{
+				{Interface: eth0, Received: 60, Dropped: 3, IfDropped: 1, DecodeErrors: 1},
+				{Interface: eth1, Received: 12, Dropped: 3},
+			},
+		},
+		{
+			name: "no sources",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sumByInterface(tt.perSource)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("interface %d = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+
+			// Window deltas then line up one entry per interface
+			delta := Stats{Interfaces: got}.Since(Stats{Interfaces: got})
+			for _, s := range delta.Interfaces {
+				if s.Received != 0 || s.Dropped != 0 {
+					t.Errorf("%s delta against itself = %+v", s.Interface.Name, s)
+				}
+			}
+		})
+	}
+}
+
+func TestTapSeesEveryPacket(t *testing.T) {
+	// 80 untagged packets and 80 on VLAN 10, of which VLAN 10 is
+	// selected and then sampled 1 in 4
+	var packets []testPacket
+	for i, p := range flows(40) {
+		packets = append(packets, p)
+		tagged := p
+		tagged.id = uint16(100 + i)
+		tagged.vlans = []uint16{10}
+		packets = append(packets, tagged)
+	}
+
+	cfg := DefaultConfig()
+	cfg.VLANs = []int{10}
+	cfg.SampleRate = 4
+	cfg.Source = NewSliceSource(layers.LinkTypeEthernet, rawPackets(t, packets))
+	e, err := NewEngine(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tap, analyzed recorder
+	e.AddTap("tap", tap.handle)
+	e.AddHandler("analyzer", analyzed.handle)
+	if err := e.Start(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tap.packets) != len(packets) {
+		t.Errorf("tap saw %d packets, want all %d", len(tap.packets), len(packets))
+	}
+	for _, p := range tap.packets {
+		if p.weight != 1 {
+			t.Fatalf("tap saw weight %d, want unsampled packets", p.weight)
+		}
+	}
+	if len(analyzed.packets) != 20 {
+		t.Errorf("handler saw %d packets, want 20", len(analyzed.packets))
+	}
+
+	stats := map[string]int64{}
+	for _, h := range e.HandlerStats() {
+		stats[h.Name] = h.Packets
+	}
+	if stats["tap"] != int64(len(packets)) || stats["analyzer"] != 20 {
+		t.Errorf("handler stats = %v, want tap %d and analyzer 20", stats, len(packets))
+	}
+}
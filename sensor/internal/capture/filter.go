@@ -0,0 +1,98 @@
+package capture
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// ErrNoPcap is returned for features that need libpcap when the sensor
+// was built with the nopcap tag
+var ErrNoPcap = errors.New("not available: sensor was built without libpcap (nopcap)")
+
+// BuildFilter combines the configured BPF expression and exclusion rules
+// into a single BPF expression. It returns "" when nothing is filtered.
+func BuildFilter(cfg Config) (string, error) {
+	var parts []string
+
+	if expr := strings.TrimSpace(cfg.Filter); expr != "" {
+		parts = append(parts, "("+expr+")")
+	}
+
+	for _, host := range cfg.ExcludeHosts {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return "", fmt.Errorf("invalid excluded host %q", host)
+		}
+		parts = append(parts, "not host "+ip.String())
+	}
+
+	for _, cidr := range cfg.ExcludeNets {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return "", fmt.Errorf("invalid excluded subnet %q: %w", cidr, err)
+		}
+		parts = append(parts, "not net "+ipNet.String())
+	}
+
+	return strings.Join(parts, " and "), nil
+}
+
+// ValidateFilter compiles a BPF expression to check its syntax
+func ValidateFilter(expr string, linkType layers.LinkType, snapLen int32) error {
+	if expr == "" {
+		return nil
+	}
+	if _, err := compileBPF(linkType, snapLen, expr); err != nil {
+		return fmt.Errorf("invalid capture filter %q: %w", expr, err)
+	}
+	return nil
+}
+
+// bpfSetter is implemented by sources that filter in the kernel or libpcap
+type bpfSetter interface {
+	SetBPFFilter(expr string) error
+}
+
+// applyFilter installs the filter on the source, falling back to
+// matching packets in user space for sources without BPF support
+func applyFilter(source PacketSource, expr string, snapLen int32) (PacketSource, error) {
+	if expr == "" {
+		return source, nil
+	}
+
+	if setter, ok := source.(bpfSetter); ok {
+		if err := setter.SetBPFFilter(expr); err != nil {
+			return nil, fmt.Errorf("failed to set capture filter: %w", err)
+		}
+		return source, nil
+	}
+
+	match, err := newBPFMatcher(source.LinkType(), snapLen, expr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile capture filter: %w", err)
+	}
+	return &filteredSource{PacketSource: source, match: match}, nil
+}
+
+// filteredSource drops packets that do not match a compiled BPF program
+type filteredSource struct {
+	PacketSource
+	match func(gopacket.CaptureInfo, []byte) bool
+}
+
+func (f *filteredSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := f.PacketSource.ReadPacketData()
+		if err != nil {
+			return data, ci, err
+		}
+		if f.match(ci, data) {
+			return data, ci, nil
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package capture
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/pcapgo"
+)
+
+// maxQuarantined caps the packets written to the quarantine file, so a
+// handler that fails on every packet cannot fill the disk
+const maxQuarantined = 1000
+
+// HandlerPanic describes a packet handler that panicked. The engine
+// recovers the panic and carries on with the remaining handlers.
+type HandlerPanic struct {
+	Handler     string
+	Value       any    // Value passed to panic
+	Stack       []byte // Stack of the panicking goroutine
+	Count       int64  // Panics from this handler so far, including this one
+	Quarantined bool   // The packet was written to the quarantine file
+}
+
+// HandlerStats reports the cumulative cost and failures of one handler
+type HandlerStats struct {
+	Name        string
+	Packets     int64
+	Time        time.Duration // Time spent in the handler
+	Panics      int64
+	Quarantined int64 // Packets that made it panic and were quarantined
+}
+
+// handler is a registered packet handler with its counters
+type handler struct {
+	name        string
+	fn          PacketHandler
+	tap         bool // Sees packets before VLAN selection and sampling
+	packets     atomic.Int64
+	nanos       atomic.Int64
+	panics      atomic.Int64
+	quarantined atomic.Int64
+}
+
+// run calls the handler, recovering a panic
+func (h *handler) run(e *Engine, packet *PacketMeta) {
+	defer func() {
+		if r := recover(); r != nil {
+			e.handlerPanicked(h, packet, r, debug.Stack())
+		}
+	}()
+	h.fn(packet)
+}
+
+// handlerPanicked counts a recovered panic, quarantines the packet and
+// reports it
+func (e *Engine) handlerPanicked(h *handler, packet *PacketMeta, value any, stack []byte) {
+	p := HandlerPanic{
+		Handler: h.name,
+		Value:   value,
+		Stack:   stack,
+		Count:   h.panics.Add(1),
+	}
+	if e.quarantine != nil {
+		if err := e.quarantine.write(packet); err == nil {
+			h.quarantined.Add(1)
+			p.Quarantined = true
+		}
+	}
+	if e.cfg.OnPanic != nil {
+		e.cfg.OnPanic(p)
+	}
+}
+
+// HandlerStats returns the counters of every handler in the order added
+func (e *Engine) HandlerStats() []HandlerStats {
+	e.handlerMutex.RLock()
+	defer e.handlerMutex.RUnlock()
+
+	result := make([]HandlerStats, 0, len(e.handlers))
+	for _, h := range e.handlers {
+		result = append(result, HandlerStats{
+			Name:        h.name,
+			Packets:     h.packets.Load(),
+			Time:        time.Duration(h.nanos.Load()),
+			Panics:      h.panics.Load(),
+			Quarantined: h.quarantined.Load(),
+		})
+	}
+	return result
+}
+
+// quarantine writes packets that made a handler panic to a pcapng file,
+// so they can be replayed with --read to reproduce the failure. The file
+// is only created once a packet is quarantined.
+type quarantine struct {
+	path string
+
+	mu      sync.Mutex
+	file    *os.File
+	writer  *pcapgo.NgWriter
+	ifaces  map[string]int // pcapng interface IDs
+	packets int
+	created bool  // Later captures append a new pcapng section
+	err     error // Set once the file cannot be written
+}
+
+// write appends a packet, flushing so the file is usable even if the
+// sensor later crashes
+func (q *quarantine) write(packet *PacketMeta) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.err != nil {
+		return q.err
+	}
+	if q.packets >= maxQuarantined {
+		return fmt.Errorf("quarantine limit of %d packets reached", maxQuarantined)
+	}
+
+	intf := pcapgo.DefaultNgInterface
+	intf.Name = packet.Interface.Name
+	intf.LinkType = packet.LinkType
+
+	if q.writer == nil {
+		mode := os.O_TRUNC
+		if q.created {
+			mode = os.O_APPEND
+		}
+		if err := os.MkdirAll(filepath.Dir(q.path), 0755); err != nil {
+			q.err = fmt.Errorf("failed to create quarantine directory: %w", err)
+			return q.err
+		}
+		f, err := os.OpenFile(q.path, os.O_WRONLY|os.O_CREATE|mode, 0600)
+		if err != nil {
+			q.err = fmt.Errorf("failed to create quarantine file: %w", err)
+			return q.err
+		}
+		writer, err := pcapgo.NewNgWriterInterface(f, intf, pcapgo.DefaultNgWriterOptions)
+		if err != nil {
+			f.Close()
+			q.err = fmt.Errorf("failed to write quarantine header: %w", err)
+			return q.err
+		}
+		q.file = f
+		q.writer = writer
+		q.created = true
+		q.ifaces = map[string]int{intf.Name: 0}
+	}
+
+	id, ok := q.ifaces[intf.Name]
+	if !ok {
+		var err error
+		if id, err = q.writer.AddInterface(intf); err != nil {
+			q.err = fmt.Errorf("failed to add quarantine interface: %w", err)
+			return q.err
+		}
+		q.ifaces[intf.Name] = id
+	}
+
+	ci := gopacket.CaptureInfo{
+		Timestamp:      packet.Timestamp,
+		CaptureLength:  len(packet.Data),
+		Length:         packet.Length,
+		InterfaceIndex: id,
+	}
+	if err := q.writer.WritePacket(ci, packet.Data); err != nil {
+		q.err = fmt.Errorf("failed to write quarantined packet: %w", err)
+		return q.err
+	}
+	if err := q.writer.Flush(); err != nil {
+		q.err = fmt.Errorf("failed to write quarantined packet: %w", err)
+		return q.err
+	}
+	q.packets++
+	return nil
+}
+
+// close closes the file at the end of a capture
+func (q *quarantine) close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.file == nil {
+		return nil
+	}
+	err := q.file.Close()
+	q.file = nil
+	q.writer = nil
+	q.ifaces = nil
+	return err
+}
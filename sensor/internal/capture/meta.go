@@ -0,0 +1,394 @@
+package capture
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// TCP flag bits as reported in PacketMeta.TCPFlags
+const (
+	TCPFlagFIN uint8 = 1 << iota
+	TCPFlagSYN
+	TCPFlagRST
+	TCPFlagPSH
+	TCPFlagACK
+	TCPFlagURG
+)
+
+// PacketMeta is a packet decoded in a single pass, with the fields the
+// analyzers share extracted up front. It is only valid until the handler
+// returns: the value, its layers and Data are reused for later packets,
+// so handlers must copy anything they keep.
+type PacketMeta struct {
+	Timestamp time.Time
+	Size      int // Captured bytes
+	Length    int // Original length on the wire
+	Interface Interface
+	LinkType  layers.LinkType
+	Data      []byte
+
+	VLANs            []uint16 // 802.1Q VLAN IDs, outermost first; two with QinQ
+	VLAN             string   // VLAN tag as "100", or "100.20" for QinQ; empty when untagged
+	SrcMAC, DstMAC   string   // Empty on links without hardware addresses; cooked captures only carry the source
+	SrcIP, DstIP     string
+	SrcPort, DstPort uint16
+	Protocol         string // TCP, UDP, ICMP, ICMPv6, ARP, IPv4, IPv6 or Other
+	TTL              int    // IPv4 TTL or IPv6 hop limit, zero for non-IP packets
+	TCPFlags         uint8  // TCPFlag* bits, zero for non-TCP packets
+	Weight           int64  // Packets this one stands for: the sampling rate when sampled, otherwise 1
+
+	// Decoded layers. Only those reported by Has hold this packet's data.
+	Ethernet  layers.Ethernet
+	LinuxSLL  layers.LinuxSLL
+	LinuxSLL2 layers.LinuxSLL2
+	Loopback  layers.Loopback
+	Dot1Q     dot1QStack
+	ARP       layers.ARP
+	IPv4      layers.IPv4
+	IPv6      layers.IPv6
+	TCP       layers.TCP
+	UDP       layers.UDP
+	ICMPv4    layers.ICMPv4
+	ICMPv6    layers.ICMPv6
+	ICMPv6RS  layers.ICMPv6RouterSolicitation
+	ICMPv6RA  layers.ICMPv6RouterAdvertisement
+	ICMPv6NS  layers.ICMPv6NeighborSolicitation
+	ICMPv6NA  layers.ICMPv6NeighborAdvertisement
+	DNS       layers.DNS
+	DHCPv4    layers.DHCPv4
+	DHCPv6    layers.DHCPv6
+	Payload   gopacket.Payload
+
+	decoded    []gopacket.LayerType
+	parser     *gopacket.DecodingLayerParser
+	parserIPv6 *gopacket.DecodingLayerParser // Raw IP links, for IPv6 packets
+	decoder    *Decoder
+}
+
+// Decoder decodes packets of one link type into reusable PacketMeta values
+type Decoder struct {
+	linkType layers.LinkType
+	first    gopacket.LayerType
+	rawIP    bool // Packets start at an IPv4 or IPv6 header
+	pool     sync.Pool
+}
+
+// NewDecoder creates a decoder for packets of the given link type
+func NewDecoder(linkType layers.LinkType) *Decoder {
+	d := &Decoder{linkType: linkType}
+	d.first, d.rawIP = linkLayerType(linkType)
+	d.pool.New = func() any {
+		return d.newMeta()
+	}
+	return d
+}
+
+// Link types some platforms report for raw IP instead of LinkTypeRaw
+const (
+	linkTypeRawAlt     layers.LinkType = 12
+	linkTypeRawOpenBSD layers.LinkType = 14
+)
+
+// linkLayerType returns the first layer to decode for a link type, and
+// whether packets are raw IP whose version picks the first layer.
+// gopacket's own mapping only covers link types with a registered layer.
+func linkLayerType(linkType layers.LinkType) (gopacket.LayerType, bool) {
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		return layers.LayerTypeEthernet, false
+	case layers.LinkTypeLinuxSLL:
+		return layers.LayerTypeLinuxSLL, false
+	case layers.LinkTypeLinuxSLL2:
+		return layers.LayerTypeLinuxSLL2, false
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		return layers.LayerTypeLoopback, false
+	case layers.LinkTypeRaw, linkTypeRawAlt, linkTypeRawOpenBSD:
+		return layers.LayerTypeIPv4, true
+	case layers.LinkTypeIPv4:
+		return layers.LayerTypeIPv4, false
+	case layers.LinkTypeIPv6:
+		return layers.LayerTypeIPv6, false
+	}
+	return linkType.LayerType(), false
+}
+
+// newMeta allocates a PacketMeta with parsers bound to its layers
+func (d *Decoder) newMeta() *PacketMeta {
+	m := &PacketMeta{
+		decoded: make([]gopacket.LayerType, 0, 8),
+		decoder: d,
+	}
+	m.parser = m.newParser(d.first)
+	if d.rawIP {
+		m.parserIPv6 = m.newParser(layers.LayerTypeIPv6)
+	}
+	return m
+}
+
+// newParser creates a parser starting at the given layer
+func (m *PacketMeta) newParser(first gopacket.LayerType) *gopacket.DecodingLayerParser {
+	parser := gopacket.NewDecodingLayerParser(first,
+		&m.Ethernet, &m.LinuxSLL, &m.LinuxSLL2, &m.Loopback, &m.Dot1Q,
+		&m.ARP, &m.IPv4, &m.IPv6, &m.TCP, &m.UDP,
+		&m.ICMPv4, &m.ICMPv6, &m.ICMPv6RS, &m.ICMPv6RA, &m.ICMPv6NS, &m.ICMPv6NA,
+		&m.DNS, &m.DHCPv4, &m.DHCPv6, &m.Payload)
+	// Stop quietly at layers the sensor has no use for
+	parser.IgnoreUnsupported = true
+	return parser
+}
+
+// Decode decodes a packet. On a decode error the layers decoded before
+// the failure are still returned along with the error. The result must
+// be released once it is no longer used.
+func (d *Decoder) Decode(data []byte, ci gopacket.CaptureInfo) (*PacketMeta, error) {
+	m := d.pool.Get().(*PacketMeta)
+	m.reset()
+
+	m.Timestamp = ci.Timestamp
+	m.LinkType = d.linkType
+	m.Data = data
+	m.Size = len(data)
+	m.Length = ci.Length
+	if m.Length < m.Size {
+		m.Length = m.Size
+	}
+
+	parser := m.parser
+	if d.rawIP && len(data) > 0 && data[0]>>4 == 6 {
+		parser = m.parserIPv6
+	}
+	err := parser.DecodeLayers(data, &m.decoded)
+	m.VLANs = m.Dot1Q.ids
+	m.VLAN = vlanTag(m.VLANs)
+
+	// Later layers take precedence, so the protocol is the innermost one
+	m.Protocol = "Other"
+	for _, t := range m.decoded {
+		switch t {
+		case layers.LayerTypeEthernet:
+			m.SrcMAC = m.Ethernet.SrcMAC.String()
+			m.DstMAC = m.Ethernet.DstMAC.String()
+		case layers.LayerTypeLinuxSLL:
+			if m.LinuxSLL.AddrType == uint16(layers.ARPHardwareTypeEthernet) && m.LinuxSLL.AddrLen == 6 {
+				m.SrcMAC = m.LinuxSLL.Addr.String()
+			}
+		case layers.LayerTypeLinuxSLL2:
+			if m.LinuxSLL2.ARPHardwareType == layers.ARPHardwareTypeEthernet && m.LinuxSLL2.AddrLength == 6 {
+				m.SrcMAC = m.LinuxSLL2.Addr.String()
+			}
+		case layers.LayerTypeARP:
+			m.Protocol = "ARP"
+		case layers.LayerTypeIPv4:
+			m.SrcIP = m.IPv4.SrcIP.String()
+			m.DstIP = m.IPv4.DstIP.String()
+			m.TTL = int(m.IPv4.TTL)
+			m.Protocol = "IPv4"
+		case layers.LayerTypeIPv6:
+			m.SrcIP = m.IPv6.SrcIP.String()
+			m.DstIP = m.IPv6.DstIP.String()
+			m.TTL = int(m.IPv6.HopLimit)
+			m.Protocol = "IPv6"
+		case layers.LayerTypeTCP:
+			m.SrcPort = uint16(m.TCP.SrcPort)
+			m.DstPort = uint16(m.TCP.DstPort)
+			m.TCPFlags = tcpFlags(&m.TCP)
+			m.Protocol = "TCP"
+		case layers.LayerTypeUDP:
+			m.SrcPort = uint16(m.UDP.SrcPort)
+			m.DstPort = uint16(m.UDP.DstPort)
+			m.Protocol = "UDP"
+		case layers.LayerTypeICMPv4:
+			m.Protocol = "ICMP"
+		case layers.LayerTypeICMPv6:
+			m.Protocol = "ICMPv6"
+		}
+	}
+
+	return m, err
+}
+
+// reset clears the fields filled in from the previous packet
+func (m *PacketMeta) reset() {
+	m.Timestamp = time.Time{}
+	m.Interface = Interface{}
+	m.Dot1Q.ids = m.Dot1Q.ids[:0]
+	m.SrcMAC, m.DstMAC = "", ""
+	m.SrcIP, m.DstIP = "", ""
+	m.SrcPort, m.DstPort = 0, 0
+	m.TTL = 0
+	m.TCPFlags = 0
+	m.Weight = 1
+	m.decoded = m.decoded[:0]
+}
+
+// Release returns the meta to its decoder for reuse. The engine calls it
+// once every handler has returned.
+func (m *PacketMeta) Release() {
+	m.Data = nil
+	m.decoder.pool.Put(m)
+}
+
+// Has reports whether the packet contains a decoded layer of type t
+func (m *PacketMeta) Has(t gopacket.LayerType) bool {
+	for _, d := range m.decoded {
+		if d == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Subnet returns the capture interface's subnet for untagged packets.
+// Tagged packets belong to a VLAN whose subnet is not known.
+func (m *PacketMeta) Subnet() string {
+	if m.VLAN != "" {
+		return ""
+	}
+	return m.Interface.Subnet
+}
+
+// Layers returns the types of the decoded layers, outermost first
+func (m *PacketMeta) Layers() []gopacket.LayerType {
+	return m.decoded
+}
+
+// layer returns the decoded layer of type t
+func (m *PacketMeta) layer(t gopacket.LayerType) gopacket.Layer {
+	switch t {
+	case layers.LayerTypeEthernet:
+		return &m.Ethernet
+	case layers.LayerTypeLinuxSLL:
+		return &m.LinuxSLL
+	case layers.LayerTypeLinuxSLL2:
+		return &m.LinuxSLL2
+	case layers.LayerTypeLoopback:
+		return &m.Loopback
+	case layers.LayerTypeDot1Q:
+		return &m.Dot1Q
+	case layers.LayerTypeARP:
+		return &m.ARP
+	case layers.LayerTypeIPv4:
+		return &m.IPv4
+	case layers.LayerTypeIPv6:
+		return &m.IPv6
+	case layers.LayerTypeTCP:
+		return &m.TCP
+	case layers.LayerTypeUDP:
+		return &m.UDP
+	case layers.LayerTypeICMPv4:
+		return &m.ICMPv4
+	case layers.LayerTypeICMPv6:
+		return &m.ICMPv6
+	case layers.LayerTypeICMPv6RouterSolicitation:
+		return &m.ICMPv6RS
+	case layers.LayerTypeICMPv6RouterAdvertisement:
+		return &m.ICMPv6RA
+	case layers.LayerTypeICMPv6NeighborSolicitation:
+		return &m.ICMPv6NS
+	case layers.LayerTypeICMPv6NeighborAdvertisement:
+		return &m.ICMPv6NA
+	case layers.LayerTypeDNS:
+		return &m.DNS
+	case layers.LayerTypeDHCPv4:
+		return &m.DHCPv4
+	case layers.LayerTypeDHCPv6:
+		return &m.DHCPv6
+	case gopacket.LayerTypePayload:
+		return &m.Payload
+	}
+	return nil
+}
+
+// HeaderLength returns the length of the packet's protocol headers,
+// excluding any application payload
+func (m *PacketMeta) HeaderLength() int {
+	n := 0
+	for _, t := range m.decoded {
+		layer := m.layer(t)
+		if _, ok := layer.(gopacket.ApplicationLayer); ok || layer == nil {
+			break
+		}
+		n += len(layer.LayerContents())
+	}
+	if n > len(m.Data) {
+		n = len(m.Data)
+	}
+	return n
+}
+
+// FlowHash returns a hash of the packet's network and transport
+// endpoints that is identical for both directions of a flow.
+// Non-IP packets hash by their link-layer endpoints.
+func (m *PacketMeta) FlowHash() uint64 {
+	var h uint64
+	switch {
+	case m.Has(layers.LayerTypeIPv4):
+		h = m.IPv4.NetworkFlow().FastHash()
+	case m.Has(layers.LayerTypeIPv6):
+		h = m.IPv6.NetworkFlow().FastHash()
+	case m.Has(layers.LayerTypeEthernet):
+		return m.Ethernet.LinkFlow().FastHash()
+	default:
+		return 0
+	}
+
+	switch m.Protocol {
+	case "TCP":
+		h ^= m.TCP.TransportFlow().FastHash()
+	case "UDP":
+		h ^= m.UDP.TransportFlow().FastHash()
+	}
+	return h
+}
+
+// dot1QStack decodes 802.1Q tags, keeping the VLAN ID of each one so
+// that both tags of a QinQ frame are known
+type dot1QStack struct {
+	layers.Dot1Q
+	ids []uint16
+}
+
+// DecodeFromBytes decodes one tag and records its VLAN ID
+func (d *dot1QStack) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if err := d.Dot1Q.DecodeFromBytes(data, df); err != nil {
+		return err
+	}
+	d.ids = append(d.ids, d.VLANIdentifier)
+	return nil
+}
+
+// vlanTag formats VLAN IDs as a tag, joining QinQ IDs with a dot
+func vlanTag(ids []uint16) string {
+	switch len(ids) {
+	case 0:
+		return ""
+	case 1:
+		return strconv.Itoa(int(ids[0]))
+	}
+	tag := strconv.Itoa(int(ids[0]))
+	for _, id := range ids[1:] {
+		tag += "." + strconv.Itoa(int(id))
+	}
+	return tag
+}
+
+// tcpFlags packs the TCP header flags into TCPFlag* bits
+func tcpFlags(tcp *layers.TCP) uint8 {
+	var flags uint8
+	for _, f := range []struct {
+		set bool
+		bit uint8
+	}{
+		{tcp.FIN, TCPFlagFIN}, {tcp.SYN, TCPFlagSYN}, {tcp.RST, TCPFlagRST},
+		{tcp.PSH, TCPFlagPSH}, {tcp.ACK, TCPFlagACK}, {tcp.URG, TCPFlagURG},
+	} {
+		if f.set {
+			flags |= f.bit
+		}
+	}
+	return flags
+}
@@ -0,0 +1,77 @@
+package capture
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// syntheticPackets returns count packets spread over the given number
+// of TCP and UDP flows, as seen on a busy link
+func syntheticPackets(tb testing.TB, count, flows int) []RawPacket {
+	tb.Helper()
+
+	templates := make([][]byte, flows)
+	for i := range templates {
+		p := testPacket{
+			src:   fmt.Sprintf("10.0.%d.%d", i>>8&0xff, i&0xff),
+			dst:   "10.0.255.1",
+			sport: uint16(40000 + i%20000),
+			dport: 443,
+			tcp:   i%4 != 2,
+		}
+		if !p.tcp {
+			p.dport = 123
+		}
+		templates[i] = p.bytes(tb)
+	}
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	packets := make([]RawPacket, count)
+	for i := range packets {
+		packets[i] = RawPacket{
+			Data: templates[i%flows],
+			Info: gopacket.CaptureInfo{Timestamp: base.Add(time.Duration(i) * time.Microsecond)},
+		}
+	}
+	return packets
+}
+
+// BenchmarkDecode compares single-pass decoding into a PacketMeta with
+// the per-layer lookups on a gopacket.Packet it replaced
+func BenchmarkDecode(b *testing.B) {
+	packets := syntheticPackets(b, 1024, 1024)
+
+	b.Run("gopacket.Packet lookups", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			pkt := packets[i%len(packets)]
+			packet := gopacket.NewPacket(pkt.Data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+			if eth, ok := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); ok {
+				_, _ = eth.SrcMAC.String(), eth.DstMAC.String()
+			}
+			if ip, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+				_, _ = ip.SrcIP.String(), ip.DstIP.String()
+			}
+			for _, t := range []gopacket.LayerType{
+				layers.LayerTypeTCP, layers.LayerTypeUDP, layers.LayerTypeICMPv4, layers.LayerTypeICMPv6,
+				layers.LayerTypeARP, layers.LayerTypeDNS, layers.LayerTypeDHCPv4,
+			} {
+				packet.Layer(t)
+			}
+		}
+	})
+
+	b.Run("PacketMeta single pass", func(b *testing.B) {
+		decoder := NewDecoder(layers.LinkTypeEthernet)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			pkt := packets[i%len(packets)]
+			packet, _ := decoder.Decode(pkt.Data, pkt.Info)
+			packet.Release()
+		}
+	})
+}
@@ -0,0 +1,49 @@
+//go:build nopcap
+
+package capture
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+// DefaultBackend is the live capture backend used unless configured
+// otherwise; without libpcap only AF_PACKET is available
+const DefaultBackend = BackendAFPacket
+
+// blockForever is unused without libpcap; afpacket reads block on poll
+const blockForever = -10 * time.Millisecond
+
+// openPcapLive is unavailable without libpcap
+func openPcapLive(ifaceName string, snapLen int32, promisc bool, timeout time.Duration) (PacketSource, error) {
+	return nil, fmt.Errorf("failed to open interface %s: pcap backend %w; use --backend afpacket", ifaceName, ErrNoPcap)
+}
+
+// openOffline reads a capture file with the pure-Go pcap/pcapng readers
+func openOffline(path string) (PacketSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture file %s: %w", path, err)
+	}
+	src, err := NewReaderSource(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to open capture file %s: %w", path, err)
+	}
+	return src, nil
+}
+
+// compileBPF is unavailable without libpcap, which provides the compiler
+func compileBPF(linkType layers.LinkType, snapLen int32, expr string) ([]bpf.RawInstruction, error) {
+	return nil, fmt.Errorf("BPF filters %w", ErrNoPcap)
+}
+
+// newBPFMatcher is unavailable without libpcap, which provides the compiler
+func newBPFMatcher(linkType layers.LinkType, snapLen int32, expr string) (func(gopacket.CaptureInfo, []byte) bool, error) {
+	return nil, fmt.Errorf("BPF filters %w", ErrNoPcap)
+}
@@ -0,0 +1,47 @@
+package capture
+
+import (
+	"context"
+	"time"
+)
+
+// pacer delays replayed packets so they are delivered at the same
+// rate they were originally captured
+type pacer struct {
+	enabled   bool
+	wallStart time.Time // Wall clock time the first packet was delivered
+	pktStart  time.Time // Capture timestamp of the first packet
+}
+
+func newPacer(enabled bool) *pacer {
+	return &pacer{enabled: enabled}
+}
+
+// wait blocks until the packet with the given capture timestamp is due.
+// It returns false if the context was cancelled while waiting.
+func (p *pacer) wait(ctx context.Context, ts time.Time) bool {
+	if !p.enabled || ts.IsZero() {
+		return true
+	}
+
+	if p.pktStart.IsZero() {
+		p.wallStart = time.Now()
+		p.pktStart = ts
+		return true
+	}
+
+	delay := ts.Sub(p.pktStart) - time.Since(p.wallStart)
+	if delay <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
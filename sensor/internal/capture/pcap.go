@@ -0,0 +1,78 @@
+//go:build !nopcap
+
+package capture
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+// DefaultBackend is the live capture backend used unless configured otherwise
+const DefaultBackend = BackendPcap
+
+// blockForever makes live reads wait for packets instead of timing out
+const blockForever = pcap.BlockForever
+
+// pcapSource is a live interface or capture file opened through libpcap
+type pcapSource struct {
+	*pcap.Handle
+}
+
+// openPcapLive opens a live capture through libpcap
+func openPcapLive(ifaceName string, snapLen int32, promisc bool, timeout time.Duration) (PacketSource, error) {
+	handle, err := pcap.OpenLive(ifaceName, snapLen, promisc, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open interface %s: %w", ifaceName, err)
+	}
+	return &pcapSource{handle}, nil
+}
+
+// openOffline opens a capture file through libpcap
+func openOffline(path string) (PacketSource, error) {
+	handle, err := pcap.OpenOffline(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture file %s: %w", path, err)
+	}
+	return &pcapSource{handle}, nil
+}
+
+// captureStats reports libpcap's counters. Capture files have none.
+func (s *pcapSource) captureStats() (InterfaceStats, error) {
+	ps, err := s.Handle.Stats()
+	if err != nil {
+		return InterfaceStats{}, err
+	}
+	return InterfaceStats{
+		Received:  int64(ps.PacketsReceived),
+		Dropped:   int64(ps.PacketsDropped),
+		IfDropped: int64(ps.PacketsIfDropped),
+	}, nil
+}
+
+// compileBPF compiles a BPF expression into raw instructions
+func compileBPF(linkType layers.LinkType, snapLen int32, expr string) ([]bpf.RawInstruction, error) {
+	insns, err := pcap.CompileBPFFilter(linkType, int(snapLen), expr)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]bpf.RawInstruction, len(insns))
+	for i, insn := range insns {
+		raw[i] = bpf.RawInstruction{Op: insn.Code, Jt: insn.Jt, Jf: insn.Jf, K: insn.K}
+	}
+	return raw, nil
+}
+
+// newBPFMatcher compiles a BPF expression for matching packets in user space
+func newBPFMatcher(linkType layers.LinkType, snapLen int32, expr string) (func(gopacket.CaptureInfo, []byte) bool, error) {
+	program, err := pcap.NewBPF(linkType, int(snapLen), expr)
+	if err != nil {
+		return nil, err
+	}
+	return program.Matches, nil
+}
@@ -0,0 +1,91 @@
+package capture
+
+import (
+	"fmt"
+
+	"github.com/gopacket/gopacket/layers"
+)
+
+// Sampling modes
+const (
+	SampleByPacket = "packet" // Every Nth packet
+	SampleByFlow   = "flow"   // Every packet of 1 in N flows, chosen by flow hash
+)
+
+// validateSampling checks the sampling settings, filling in the default mode
+func validateSampling(cfg *Config) error {
+	if cfg.SampleRate < 0 {
+		return fmt.Errorf("sampling rate must not be negative")
+	}
+	switch cfg.SampleMode {
+	case "":
+		cfg.SampleMode = SampleByPacket
+	case SampleByPacket, SampleByFlow:
+	default:
+		return fmt.Errorf("unknown sampling mode %q (use %s or %s)", cfg.SampleMode, SampleByPacket, SampleByFlow)
+	}
+	return nil
+}
+
+// sample reports whether a packet is analyzed under the sampling rate,
+// and sets the weight of sampled packets to the rate so counters can be
+// scaled up. Discovery packets are always analyzed with a weight of one.
+func (e *Engine) sample(packet *PacketMeta) bool {
+	n := uint64(e.cfg.SampleRate)
+	if n <= 1 || isDiscovery(packet) {
+		return true
+	}
+
+	var keep bool
+	if e.cfg.SampleMode == SampleByFlow {
+		// Mix the hash so the flows kept don't all land on the same
+		// workers, which also pick by flow hash modulo
+		keep = (packet.FlowHash()*0x9E3779B97F4A7C15)>>32%n == 0
+	} else {
+		keep = (e.sampleCount.Add(1)-1)%n == 0
+	}
+
+	if !keep {
+		e.skipped.Add(1)
+		return false
+	}
+	packet.Weight = int64(n)
+	return true
+}
+
+// Ports of the discovery protocols that are never sampled out
+const (
+	portNBNS   = 137
+	portDHCPS  = 67
+	portDHCPC  = 68
+	portDHCP6C = 546
+	portDHCP6S = 547
+	portMDNS   = 5353
+	portLLMNR  = 5355
+)
+
+// isDiscovery reports whether a packet belongs to a protocol used for
+// device discovery (ARP, IPv6 Neighbor Discovery, DHCP, DHCPv6, mDNS,
+// NBNS, LLMNR), which is rare but carries most of the inventory
+func isDiscovery(packet *PacketMeta) bool {
+	if packet.Has(layers.LayerTypeARP) {
+		return true
+	}
+	if packet.Protocol == "ICMPv6" {
+		switch packet.ICMPv6.TypeCode.Type() {
+		case layers.ICMPv6TypeRouterSolicitation, layers.ICMPv6TypeRouterAdvertisement,
+			layers.ICMPv6TypeNeighborSolicitation, layers.ICMPv6TypeNeighborAdvertisement:
+			return true
+		}
+	}
+	if packet.Protocol != "UDP" {
+		return false
+	}
+	for _, port := range [2]uint16{packet.SrcPort, packet.DstPort} {
+		switch port {
+		case portDHCPS, portDHCPC, portDHCP6C, portDHCP6S, portMDNS, portNBNS, portLLMNR:
+			return true
+		}
+	}
+	return false
+}
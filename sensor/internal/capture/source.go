@@ -0,0 +1,259 @@
+package capture
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+)
+
+// PacketSource supplies raw packets to the engine. Live interfaces,
+// capture files, streams and in-memory packet slices all implement it.
+type PacketSource interface {
+	// ReadPacketData returns the next packet, or io.EOF when the source is exhausted
+	ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error)
+	// LinkType returns the link-layer type of the packets
+	LinkType() layers.LinkType
+	// Close releases the underlying resources
+	Close()
+}
+
+// taggedSource is an open source along with the interface it reads from
+type taggedSource struct {
+	PacketSource
+	iface    Interface
+	counters sourceCounters
+}
+
+// readPackets decodes packets from the source, tags them with the
+// source interface and hands them to deliver until the source or
+// context ends, or deliver returns false. Delivered packets are
+// released by the receiver.
+func (t *taggedSource) readPackets(ctx context.Context, deliver func(*PacketMeta) bool) {
+	decoder := NewDecoder(t.LinkType())
+
+	for ctx.Err() == nil {
+		data, ci, err := t.ReadPacketData()
+		if err != nil {
+			if !retryRead(err) {
+				return
+			}
+			continue
+		}
+
+		packet, err := decoder.Decode(data, ci)
+		t.counters.packets.Add(1)
+		if err != nil {
+			t.counters.decodeErrors.Add(1)
+		}
+		packet.Interface = t.iface
+		if !deliver(packet) {
+			packet.Release()
+			return
+		}
+	}
+}
+
+// retryRead reports whether a read error is transient. Timeouts and
+// unknown errors are retried after a short pause; end of stream and
+// closed sources are not.
+func retryRead(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.ErrClosedPipe) || errors.Is(err, os.ErrClosed) ||
+		errors.Is(err, syscall.EBADF) {
+		return false
+	}
+	time.Sleep(5 * time.Millisecond)
+	return true
+}
+
+// pcapng section header block type, used to tell pcapng from pcap streams
+const pcapngMagic = 0x0A0D0D0A
+
+// OpenLive opens a live capture on a network interface
+func OpenLive(ifaceName string, snapLen int32, promisc bool, timeout time.Duration) (PacketSource, error) {
+	return openPcapLive(ifaceName, snapLen, promisc, timeout)
+}
+
+// Injector is a live interface that can transmit as well as capture,
+// used by active discovery
+type Injector interface {
+	PacketSource
+	WritePacketData(data []byte) error
+	SetBPFFilter(expr string) error
+}
+
+// OpenInjector opens an interface for sending and receiving raw frames
+// through the given capture backend
+func OpenInjector(backend, ifaceName string) (Injector, error) {
+	if backend == "" {
+		backend = DefaultBackend
+	}
+
+	var source PacketSource
+	switch backend {
+	case BackendPcap:
+		var err error
+		if source, err = OpenLive(ifaceName, 65535, true, blockForever); err != nil {
+			return nil, err
+		}
+	case BackendAFPacket:
+		sources, err := openAFPacket(ifaceName, 65535, true, 1, 4<<20, 0)
+		if err != nil {
+			return nil, err
+		}
+		source = sources[0]
+	default:
+		return nil, fmt.Errorf("unknown capture backend %q", backend)
+	}
+
+	injector, ok := source.(Injector)
+	if !ok {
+		source.Close()
+		return nil, fmt.Errorf("the %s backend cannot transmit packets", backend)
+	}
+	return injector, nil
+}
+
+// OpenFile opens a pcap or pcapng file for reading. A path of "-" reads
+// from stdin, and named pipes are streamed without seeking.
+func OpenFile(path string) (PacketSource, error) {
+	if path == "-" {
+		return NewReaderSource(os.Stdin)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture file %s: %w", path, err)
+	}
+
+	if info.Mode()&os.ModeNamedPipe != 0 {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open named pipe %s: %w", path, err)
+		}
+		src, err := NewReaderSource(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return src, nil
+	}
+
+	return openOffline(path)
+}
+
+// readerSource reads a pcap or pcapng stream with the pure-Go readers
+type readerSource struct {
+	gopacket.PacketDataSource
+	linkType layers.LinkType
+	closer   io.Closer
+}
+
+// NewReaderSource creates a packet source from a pcap or pcapng stream,
+// detecting the format from the leading magic number. If r is an
+// io.Closer it is closed with the source.
+func NewReaderSource(r io.Reader) (PacketSource, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read capture header: %w", err)
+	}
+
+	src := &readerSource{}
+	if c, ok := r.(io.Closer); ok {
+		src.closer = c
+	}
+
+	if binary.LittleEndian.Uint32(magic) == pcapngMagic {
+		ng, err := pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pcapng stream: %w", err)
+		}
+		src.PacketDataSource = ng
+		src.linkType = ng.LinkType()
+	} else {
+		pr, err := pcapgo.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pcap stream: %w", err)
+		}
+		src.PacketDataSource = pr
+		src.linkType = pr.LinkType()
+	}
+
+	return src, nil
+}
+
+func (s *readerSource) LinkType() layers.LinkType {
+	return s.linkType
+}
+
+func (s *readerSource) Close() {
+	if s.closer != nil {
+		s.closer.Close()
+	}
+}
+
+// RawPacket is a packet held in memory for a SliceSource
+type RawPacket struct {
+	Data []byte
+	Info gopacket.CaptureInfo
+}
+
+// SliceSource replays an in-memory slice of packets, which makes
+// analyzers testable without a network interface
+type SliceSource struct {
+	mu       sync.Mutex
+	linkType layers.LinkType
+	packets  []RawPacket
+	next     int
+}
+
+// NewSliceSource creates a source that yields the given packets in order.
+// Missing capture lengths are filled in from the packet data.
+func NewSliceSource(linkType layers.LinkType, packets []RawPacket) *SliceSource {
+	return &SliceSource{
+		linkType: linkType,
+		packets:  packets,
+	}
+}
+
+// ReadPacketData returns the next packet or io.EOF once all are consumed
+func (s *SliceSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.next >= len(s.packets) {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+
+	pkt := s.packets[s.next]
+	s.next++
+
+	ci := pkt.Info
+	if ci.CaptureLength == 0 {
+		ci.CaptureLength = len(pkt.Data)
+	}
+	if ci.Length == 0 {
+		ci.Length = len(pkt.Data)
+	}
+	return pkt.Data, ci, nil
+}
+
+// LinkType returns the link type the packets were built with
+func (s *SliceSource) LinkType() layers.LinkType {
+	return s.linkType
+}
+
+// Close is a no-op for in-memory sources
+func (s *SliceSource) Close() {}
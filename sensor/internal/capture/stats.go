@@ -0,0 +1,168 @@
+package capture
+
+import "sync/atomic"
+
+// Stats reports capture health: packets lost before they reached the
+// sensor, packets that could not be decoded, and dispatch backlog.
+// Counters are cumulative since the capture started.
+type Stats struct {
+	Received       int64 // Packets delivered by the sources
+	Dropped        int64 // Dropped by the kernel because the buffer was full
+	IfDropped      int64 // Dropped by the interface or driver
+	DecodeErrors   int64 // Packets with an undecodable layer
+	QueueHighWater int   // Deepest worker queue seen
+	QueueCapacity  int   // Per-worker queue size, zero without a worker pool
+	QueueStalls    int64 // Times capture blocked on a full worker queue
+	Skipped        int64 // Packets left out by sampling
+	Interfaces     []InterfaceStats
+	Handlers       []HandlerStats
+}
+
+// InterfaceStats holds the source counters for one capture interface,
+// summed over its sockets when afpacket fans out to several
+type InterfaceStats struct {
+	Interface    Interface
+	Received     int64
+	Dropped      int64
+	IfDropped    int64
+	DecodeErrors int64
+}
+
+// DropRate returns the fraction of packets offered to the sensor that
+// were dropped by the kernel or interface
+func (s Stats) DropRate() float64 {
+	lost := s.Dropped + s.IfDropped
+	if lost <= 0 {
+		return 0
+	}
+	return float64(lost) / float64(s.Received+lost)
+}
+
+// Since returns the counters accumulated after prev was taken.
+// The queue high-water mark is kept as-is.
+func (s Stats) Since(prev Stats) Stats {
+	result := s
+	result.Received -= prev.Received
+	result.Dropped -= prev.Dropped
+	result.IfDropped -= prev.IfDropped
+	result.DecodeErrors -= prev.DecodeErrors
+	result.QueueStalls -= prev.QueueStalls
+	result.Skipped -= prev.Skipped
+
+	result.Interfaces = make([]InterfaceStats, len(s.Interfaces))
+	for i, cur := range s.Interfaces {
+		for _, old := range prev.Interfaces {
+			if old.Interface == cur.Interface {
+				cur.Received -= old.Received
+				cur.Dropped -= old.Dropped
+				cur.IfDropped -= old.IfDropped
+				cur.DecodeErrors -= old.DecodeErrors
+				break
+			}
+		}
+		result.Interfaces[i] = cur
+	}
+
+	result.Handlers = make([]HandlerStats, len(s.Handlers))
+	for i, cur := range s.Handlers {
+		for _, old := range prev.Handlers {
+			if old.Name == cur.Name {
+				cur.Packets -= old.Packets
+				cur.Time -= old.Time
+				cur.Panics -= old.Panics
+				cur.Quarantined -= old.Quarantined
+				break
+			}
+		}
+		result.Handlers[i] = cur
+	}
+	return result
+}
+
+// statsSource is implemented by sources that report kernel capture
+// statistics. Only the Received and drop counters are filled in.
+type statsSource interface {
+	captureStats() (InterfaceStats, error)
+}
+
+// sourceCounters counts what the engine itself observed from a source
+type sourceCounters struct {
+	packets      atomic.Int64
+	decodeErrors atomic.Int64
+}
+
+// queueStats tracks worker queue backlog
+type queueStats struct {
+	capacity  atomic.Int64
+	highWater atomic.Int64
+	stalls    atomic.Int64
+}
+
+// stats snapshots the source's counters. Kernel statistics are used
+// when the source provides them, otherwise the packets read are counted.
+func (t *taggedSource) stats() InterfaceStats {
+	result := InterfaceStats{
+		Interface:    t.iface,
+		Received:     t.counters.packets.Load(),
+		DecodeErrors: t.counters.decodeErrors.Load(),
+	}
+
+	if ss, ok := t.PacketSource.(statsSource); ok {
+		if ks, err := ss.captureStats(); err == nil {
+			result.Received = ks.Received
+			result.Dropped = ks.Dropped
+			result.IfDropped = ks.IfDropped
+		}
+	}
+	return result
+}
+
+// Stats returns capture health counters. While capturing they are read
+// from the open sources; afterwards the final values are returned.
+func (e *Engine) Stats() Stats {
+	e.sourceMutex.Lock()
+	perSource := e.finalStats
+	if e.sources != nil {
+		perSource = make([]InterfaceStats, 0, len(e.sources))
+		for _, src := range e.sources {
+			perSource = append(perSource, src.stats())
+		}
+	}
+	e.sourceMutex.Unlock()
+
+	stats := Stats{
+		QueueHighWater: int(e.queue.highWater.Load()),
+		QueueCapacity:  int(e.queue.capacity.Load()),
+		QueueStalls:    e.queue.stalls.Load(),
+		Skipped:        e.skipped.Load(),
+		Interfaces:     sumByInterface(perSource),
+		Handlers:       e.HandlerStats(),
+	}
+	for _, s := range perSource {
+		stats.Received += s.Received
+		stats.Dropped += s.Dropped
+		stats.IfDropped += s.IfDropped
+		stats.DecodeErrors += s.DecodeErrors
+	}
+	return stats
+}
+
+// sumByInterface adds up the counters of sources reading the same
+// interface, keeping the interfaces in the order they were opened
+func sumByInterface(perSource []InterfaceStats) []InterfaceStats {
+	result := make([]InterfaceStats, 0, len(perSource))
+	index := make(map[Interface]int, len(perSource))
+	for _, s := range perSource {
+		i, ok := index[s.Interface]
+		if !ok {
+			index[s.Interface] = len(result)
+			result = append(result, s)
+			continue
+		}
+		result[i].Received += s.Received
+		result[i].Dropped += s.Dropped
+		result[i].IfDropped += s.IfDropped
+		result[i].DecodeErrors += s.DecodeErrors
+	}
+	return result
+}
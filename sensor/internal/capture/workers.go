@@ -0,0 +1,61 @@
+package capture
+
+import "sync"
+
+// workerPool dispatches packets to a fixed set of workers. Packets are
+// sharded by symmetric flow hash, so both directions of a flow are
+// handled by the same worker, in capture order.
+type workerPool struct {
+	queues []chan *PacketMeta
+	stats  *queueStats
+	wg     sync.WaitGroup
+}
+
+// newWorkerPool starts n workers, each with a queue of queueSize packets.
+// Queue depth and stalls are recorded in stats.
+func newWorkerPool(n, queueSize int, stats *queueStats, handle func(*PacketMeta)) *workerPool {
+	w := &workerPool{
+		queues: make([]chan *PacketMeta, n),
+		stats:  stats,
+	}
+	stats.capacity.Store(int64(queueSize))
+
+	for i := range w.queues {
+		queue := make(chan *PacketMeta, queueSize)
+		w.queues[i] = queue
+
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for packet := range queue {
+				handle(packet)
+			}
+		}()
+	}
+
+	return w
+}
+
+// submit queues a packet on its flow's worker, blocking while the queue is full.
+// It is only called from the capture loop, so the high-water update needs no CAS.
+func (w *workerPool) submit(packet *PacketMeta) {
+	queue := w.queues[packet.FlowHash()%uint64(len(w.queues))]
+	select {
+	case queue <- packet:
+	default:
+		w.stats.stalls.Add(1)
+		queue <- packet
+	}
+
+	if depth := int64(len(queue)); depth > w.stats.highWater.Load() {
+		w.stats.highWater.Store(depth)
+	}
+}
+
+// stop waits for the workers to drain their queues and exit
+func (w *workerPool) stop() {
+	for _, queue := range w.queues {
+		close(queue)
+	}
+	w.wg.Wait()
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Config holds sensor settings read from a JSON file. Omitted settings
+// leave the corresponding command-line default in effect, and flags given
+// explicitly on the command line take precedence over the file. Settings
+// whose zero value is meaningful are pointers, so that an explicit 0 or
+// false can be told from an omitted one.
+type Config struct {
+	Output          string   `json:"output,omitempty"`          // Output directory for summary files
+	Interval        *int     `json:"interval,omitempty"`        // Daemon summary interval in minutes
+	Retain          *int     `json:"retain,omitempty"`          // Number of summary files to keep (0 keeps all)
+	Filter          string   `json:"filter,omitempty"`          // BPF capture filter
+	ExcludeSelf     *bool    `json:"excludeSelf,omitempty"`     // Ignore the sensor's own traffic
+	ExcludeHosts    []string `json:"excludeHosts,omitempty"`    // IP addresses to ignore
+	ExcludeNets     []string `json:"excludeNets,omitempty"`     // CIDR subnets to ignore
+	VLANs           []int    `json:"vlans,omitempty"`           // VLAN IDs to analyze (0 = untagged)
+	DropWarn        *float64 `json:"dropWarn,omitempty"`        // Drop percentage that flags a summary as incomplete (0 disables)
+	Targets         []string `json:"targets,omitempty"`         // Addresses, CIDR prefixes and ranges to probe actively
+	ActivePPS       *int     `json:"activePps,omitempty"`       // Active probe packets per second
+	SNMPCommunities []string `json:"snmpCommunities,omitempty"` // Communities tried by --snmp, kept off the command line
+}
+
+// Load reads and parses a config file
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	if cfg.Interval != nil && *cfg.Interval < 1 {
+		return nil, fmt.Errorf("config file %s: interval must be at least 1 minute", path)
+	}
+	if cfg.Retain != nil && *cfg.Retain < 0 {
+		return nil, fmt.Errorf("config file %s: retain must not be negative", path)
+	}
+
+	for _, id := range cfg.VLANs {
+		if id < 0 || id > 4094 {
+			return nil, fmt.Errorf("config file %s: VLAN ID %d must be between 0 and 4094", path, id)
+		}
+	}
+
+	if cfg.DropWarn != nil && (*cfg.DropWarn < 0 || *cfg.DropWarn > 100) {
+		return nil, fmt.Errorf("config file %s: dropWarn must be a percentage between 0 and 100", path)
+	}
+
+	for _, community := range cfg.SNMPCommunities {
+		if community == "" {
+			return nil, fmt.Errorf("config file %s: snmpCommunities must not contain empty strings", path)
+		}
+	}
+
+	if cfg.ActivePPS != nil && *cfg.ActivePPS < 1 {
+		return nil, fmt.Errorf("config file %s: activePps must be positive", path)
+	}
+
+	return &cfg, nil
+}
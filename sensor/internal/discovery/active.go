@@ -2,25 +2,42 @@ package discovery
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/asset_discovery/sensor/internal/capture"
 	"github.com/asset_discovery/sensor/internal/oui"
+	"github.com/asset_discovery/sensor/internal/output"
 	"github.com/gopacket/gopacket"
 	"github.com/gopacket/gopacket/layers"
-	"github.com/gopacket/gopacket/pcap"
 )
 
 // ActiveDiscovery performs active network scanning
 type ActiveDiscovery struct {
-	registry  *DeviceRegistry
-	oui       *oui.Lookup
-	ifaceName string
-	localIP   net.IP
-	localMAC  net.HardwareAddr
-	subnet    *net.IPNet
+	registry   *DeviceRegistry
+	oui        *oui.Lookup
+	ifaceName  string
+	localIP    net.IP
+	localMAC   net.HardwareAddr
+	subnet     *net.IPNet
+	backend    string // Capture backend used to send and receive probes
+	mdns       bool   // Browse DNS-SD services after the sweep
+	ssdp       bool   // Search for UPnP devices after the sweep
+	onSignal   func(key string, signal output.Signal)
+	onTTL      func(key string, ttl int)
+	onRekey    func(oldKey, newKey string)
+	targets    []ipRange    // Addresses to probe; the subnet's hosts when empty
+	scope      []*net.IPNet // Other subnets swept in the same run
+	rate       int          // Probe packets per second
+	ping       []string     // Ping methods to sweep with after the ARP sweep
+	pingPorts  []int        // TCP ports of SYN and ACK pings
+	probePorts []int        // Ports SYN-probed on discovered devices
+	probeHosts int          // Most devices port-probed
+	names      bool         // Query discovered hosts for their names
+	snmp       []string     // SNMP communities to query discovered hosts with
 }
 
 // NewActiveDiscovery creates a new active discovery instance
@@ -32,34 +49,143 @@ func NewActiveDiscovery(registry *DeviceRegistry, ouiLookup *oui.Lookup, ifaceNa
 		localIP:   localIP,
 		localMAC:  localMAC,
 		subnet:    subnet,
+		rate:      DefaultRate,
+		pingPorts: DefaultPingPorts,
 	}
 }
 
+// SetBackend selects the capture backend used for probing
+func (a *ActiveDiscovery) SetBackend(backend string) {
+	a.backend = backend
+}
+
+// SetTargets restricts probing to IPv4 addresses, CIDR prefixes and
+// dash ranges such as "10.1.0.10-10.1.0.50"
+func (a *ActiveDiscovery) SetTargets(specs []string) error {
+	targets, err := parseTargets(specs)
+	if err != nil {
+		return err
+	}
+	a.targets = targets
+	return nil
+}
+
+// SetScope adds the subnets swept on other interfaces in the same run,
+// so follow-up probes of discovered devices reach the devices found there
+func (a *ActiveDiscovery) SetScope(subnets []*net.IPNet) {
+	a.scope = subnets
+}
+
+// SetRate sets the packets-per-second budget of the sweep
+func (a *ActiveDiscovery) SetRate(pps int) {
+	if pps > 0 {
+		a.rate = pps
+	}
+}
+
+// SweepSize returns the number of addresses the ARP sweep probes
+func (a *ActiveDiscovery) SweepSize() uint64 {
+	return countRanges(a.sweepRanges())
+}
+
+// Timeout returns how long a run can be expected to take: the sweeps at
+// the configured rate, plus the fixed waits of the other probes
+func (a *ActiveDiscovery) Timeout() time.Duration {
+	probes := a.SweepSize() + a.pingProbes() + a.nameProbes() + a.snmpProbes() + a.portProbes()
+	return time.Duration(probes)*time.Second/time.Duration(a.rate) + 30*time.Second
+}
+
+// sweepRanges returns the addresses to ARP for: the targets within the
+// subnet, since ARP only reaches the local link, or the subnet's hosts
+func (a *ActiveDiscovery) sweepRanges() []ipRange {
+	if a.subnet == nil || a.subnet.IP.To4() == nil {
+		return nil
+	}
+	hosts := hostRange(a.subnet)
+	if len(a.targets) == 0 {
+		return []ipRange{hosts}
+	}
+	return intersectRanges(a.targets, hosts)
+}
+
+// CheckSize returns an error if the whole subnet would be swept and it
+// holds more than MaxSubnetSweep addresses
+func (a *ActiveDiscovery) CheckSize() error {
+	if a.subnet == nil || a.subnet.IP.To4() == nil || len(a.targets) > 0 {
+		return nil
+	}
+	if n := hostRange(a.subnet).size(); n > MaxSubnetSweep {
+		return fmt.Errorf("subnet %s has %d addresses, more than the %d swept without targets", a.subnet, n, MaxSubnetSweep)
+	}
+	return nil
+}
+
 // Run performs active discovery
 func (a *ActiveDiscovery) Run(ctx context.Context) error {
 	if a.subnet == nil {
 		return fmt.Errorf("no subnet configured for active discovery")
 	}
+	if err := a.CheckSize(); err != nil {
+		return err
+	}
 
 	// ARP sweep
 	if err := a.arpSweep(ctx); err != nil {
 		return fmt.Errorf("ARP sweep failed: %w", err)
 	}
 
+	if len(a.ping) > 0 {
+		if err := a.pingSweep(ctx); err != nil {
+			return fmt.Errorf("ping sweep failed: %w", err)
+		}
+	}
+
+	if a.mdns {
+		if err := a.mdnsBrowse(ctx); err != nil {
+			return fmt.Errorf("mDNS browse failed: %w", err)
+		}
+	}
+
+	if a.ssdp {
+		if err := a.ssdpSearch(ctx); err != nil {
+			return fmt.Errorf("SSDP search failed: %w", err)
+		}
+	}
+
+	if a.names {
+		if err := a.queryNames(ctx); err != nil {
+			return fmt.Errorf("name queries failed: %w", err)
+		}
+	}
+
+	if len(a.snmp) > 0 {
+		if err := a.querySNMP(ctx); err != nil {
+			return fmt.Errorf("SNMP query failed: %w", err)
+		}
+	}
+
+	// Last, so every discovery method contributes hosts
+	if len(a.probePorts) > 0 {
+		if err := a.portProbe(ctx); err != nil {
+			return fmt.Errorf("port probe failed: %w", err)
+		}
+	}
+
 	return nil
 }
 
 // arpSweep sends ARP requests to all IPs in the subnet
 func (a *ActiveDiscovery) arpSweep(ctx context.Context) error {
 	// Open handle for sending
-	handle, err := pcap.OpenLive(a.ifaceName, 65535, true, pcap.BlockForever)
+	handle, err := capture.OpenInjector(a.backend, a.ifaceName)
 	if err != nil {
 		return fmt.Errorf("failed to open interface: %w", err)
 	}
 	defer handle.Close()
 
-	// Set BPF filter to capture ARP replies
-	if err := handle.SetBPFFilter("arp"); err != nil {
+	// Set BPF filter to capture ARP replies; without libpcap every
+	// frame is read and non-ARP ones are skipped below
+	if err := handle.SetBPFFilter("arp"); err != nil && !errors.Is(err, capture.ErrNoPcap) {
 		return fmt.Errorf("failed to set BPF filter: %w", err)
 	}
 
@@ -73,27 +199,16 @@ func (a *ActiveDiscovery) arpSweep(ctx context.Context) error {
 		a.listenARPReplies(ctx, handle, responseChan)
 	}()
 
-	// Calculate IP range
-	ips := a.enumerateSubnet()
-
-	// Send ARP requests
-	for _, ip := range ips {
-		select {
-		case <-ctx.Done():
-			close(responseChan)
-			wg.Wait()
-			return nil
-		default:
-		}
-
-		if err := a.sendARPRequest(handle, ip); err != nil {
-			// Log but continue
-			continue
+	// Send ARP requests within the rate budget
+	pace := newPacer(a.rate)
+	forEachIP(a.sweepRanges(), func(ip net.IP) bool {
+		if ip.Equal(a.localIP) {
+			return true
 		}
-
-		// Small delay to avoid flooding
-		time.Sleep(10 * time.Millisecond)
-	}
+		return pace.send(ctx, func() error {
+			return a.sendARPRequest(handle, ip)
+		})
+	})
 
 	// Wait for responses
 	select {
@@ -108,7 +223,7 @@ func (a *ActiveDiscovery) arpSweep(ctx context.Context) error {
 }
 
 // listenARPReplies listens for ARP reply packets
-func (a *ActiveDiscovery) listenARPReplies(ctx context.Context, handle *pcap.Handle, done <-chan struct{}) {
+func (a *ActiveDiscovery) listenARPReplies(ctx context.Context, handle capture.Injector, done <-chan struct{}) {
 	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
 
 	for {
@@ -137,19 +252,21 @@ func (a *ActiveDiscovery) listenARPReplies(ctx context.Context, handle *pcap.Han
 			srcIP := net.IP(arp.SourceProtAddress).String()
 
 			if srcMAC != "" && srcIP != "" {
-				device := a.registry.GetOrCreate(srcMAC)
-				device.AddIP(srcIP)
-				device.DiscoverySource = "active-arp"
-				if device.Vendor == "" {
-					device.Vendor = a.oui.GetVendor(srcMAC)
-				}
+				a.registry.Upsert(srcMAC, func(device *Device) {
+					device.AddIP(srcIP)
+					device.AddSegment(a.ifaceName, a.subnet.String(), "")
+					device.DiscoverySource = "active-arp"
+					if device.Vendor == "" {
+						device.Vendor = a.oui.GetVendor(srcMAC)
+					}
+				})
 			}
 		}
 	}
 }
 
 // sendARPRequest sends an ARP request for the given IP
-func (a *ActiveDiscovery) sendARPRequest(handle *pcap.Handle, targetIP net.IP) error {
+func (a *ActiveDiscovery) sendARPRequest(handle capture.Injector, targetIP net.IP) error {
 	// Build Ethernet frame
 	eth := layers.Ethernet{
 		SrcMAC:       a.localMAC,
@@ -183,42 +300,3 @@ func (a *ActiveDiscovery) sendARPRequest(handle *pcap.Handle, targetIP net.IP) e
 
 	return handle.WritePacketData(buf.Bytes())
 }
-
-// enumerateSubnet returns all IPs in the subnet
-func (a *ActiveDiscovery) enumerateSubnet() []net.IP {
-	var ips []net.IP
-
-	// Get network address
-	network := a.subnet.IP.Mask(a.subnet.Mask)
-
-	// Calculate number of hosts
-	ones, bits := a.subnet.Mask.Size()
-	hostBits := bits - ones
-
-	// Limit to reasonable size (max 1024 hosts)
-	maxHosts := 1 << hostBits
-	if maxHosts > 1024 {
-		maxHosts = 1024
-	}
-
-	// Enumerate IPs
-	for i := 1; i < maxHosts-1; i++ { // Skip network and broadcast
-		ip := make(net.IP, 4)
-		copy(ip, network.To4())
-
-		// Add offset
-		ip[3] += byte(i & 0xff)
-		ip[2] += byte((i >> 8) & 0xff)
-		ip[1] += byte((i >> 16) & 0xff)
-		ip[0] += byte((i >> 24) & 0xff)
-
-		// Skip our own IP
-		if ip.Equal(a.localIP) {
-			continue
-		}
-
-		ips = append(ips, ip)
-	}
-
-	return ips
-}
@@ -1,22 +1,43 @@
 package discovery
 
 import (
+	"bytes"
+	"net"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/asset_discovery/sensor/internal/capture"
 	"github.com/asset_discovery/sensor/internal/output"
 )
 
 // Device represents a discovered network device
 type Device struct {
 	MAC             string
-	IPs             map[string]bool // Set of IP addresses
+	IPs             map[string]bool   // Set of IP addresses
+	AddressTypes    map[string]string // IPv6 address types known from how the address was learned, e.g. "dhcpv6"
+	IPv6Prefixes    map[string]bool   // Prefixes advertised in Router Advertisements
 	Vendor          string
 	Hostname        string
+	DUID            string                        // DHCPv6 DHCP Unique Identifier
+	VendorClass     string                        // DHCP vendor class (option 60, or DHCPv6 option 16)
+	Workgroup       string                        // NetBIOS workgroup or domain
+	NetBIOSNames    map[string]bool               // Names held, as NAME<suffix>
+	LoggedInUser    string                        // User name from a node status name table
+	Roles           map[string]bool               // Services the device announces, e.g. "file-server"
+	Services        map[string]output.ServiceInfo // DNS-SD services by type and instance name
+	UPnP            *output.UPnPInfo              // Identity from the UPnP device description
+	SNMP            *output.SNMPInfo              // SNMP system group
+	RTT             time.Duration                 // Round-trip time of the first ping answered
+	TTL             int                           // TTL of that reply, as received
+	Ports           map[int]string                // TCP port states from the port probe
 	OSGuess         string
+	OSVersion       string
 	Confidence      float64
 	SignalsUsed     []output.Signal
-	DiscoverySource string // "passive", "active-arp", "active-mdns", etc.
+	DiscoverySource string                      // "passive", "active-arp", "active-mdns", etc.
+	Segments        map[output.SegmentInfo]bool // Interfaces/subnets the device was seen on
 	FirstSeen       time.Time
 	LastSeen        time.Time
 }
@@ -27,6 +48,13 @@ func NewDevice(mac string) *Device {
 	return &Device{
 		MAC:             mac,
 		IPs:             make(map[string]bool),
+		AddressTypes:    make(map[string]string),
+		IPv6Prefixes:    make(map[string]bool),
+		NetBIOSNames:    make(map[string]bool),
+		Roles:           make(map[string]bool),
+		Services:        make(map[string]output.ServiceInfo),
+		Ports:           make(map[int]string),
+		Segments:        make(map[output.SegmentInfo]bool),
 		DiscoverySource: "passive",
 		FirstSeen:       now,
 		LastSeen:        now,
@@ -48,6 +76,141 @@ func (d *Device) GetIPs() []string {
 	return result
 }
 
+// GetIPv6Addresses returns the device's IPv6 addresses with their type,
+// sorted
+func (d *Device) GetIPv6Addresses() []output.IPv6Address {
+	var result []output.IPv6Address
+	for ip := range d.IPs {
+		addr := net.ParseIP(ip)
+		if addr == nil || addr.To4() != nil {
+			continue
+		}
+		addrType, ok := d.AddressTypes[ip]
+		if !ok {
+			addrType = classifyIPv6(addr)
+		}
+		result = append(result, output.IPv6Address{Address: ip, Type: addrType})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Address < result[j].Address
+	})
+	return result
+}
+
+// AddIPv6Prefix records a prefix the device advertises as a router
+func (d *Device) AddIPv6Prefix(prefix string) {
+	d.IPv6Prefixes[prefix] = true
+}
+
+// GetIPv6Prefixes returns the advertised prefixes, sorted
+func (d *Device) GetIPv6Prefixes() []string {
+	result := make([]string, 0, len(d.IPv6Prefixes))
+	for prefix := range d.IPv6Prefixes {
+		result = append(result, prefix)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// AddNetBIOSName records a NetBIOS name the device holds
+func (d *Device) AddNetBIOSName(name string) {
+	d.NetBIOSNames[name] = true
+}
+
+// GetNetBIOSNames returns the device's NetBIOS names, sorted
+func (d *Device) GetNetBIOSNames() []string {
+	result := make([]string, 0, len(d.NetBIOSNames))
+	for name := range d.NetBIOSNames {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// AddRole records a service role the device announces
+func (d *Device) AddRole(role string) {
+	d.Roles[role] = true
+}
+
+// GetRoles returns the device's roles, sorted
+func (d *Device) GetRoles() []string {
+	result := make([]string, 0, len(d.Roles))
+	for role := range d.Roles {
+		result = append(result, role)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// AddService records a DNS-SD service the device advertises
+func (d *Device) AddService(svc output.ServiceInfo) {
+	d.Services[svc.Type+"/"+svc.Name] = svc
+}
+
+// GetServices returns the device's services, sorted by type and name
+func (d *Device) GetServices() []output.ServiceInfo {
+	result := make([]output.ServiceInfo, 0, len(d.Services))
+	for _, svc := range d.Services {
+		result = append(result, svc)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Type != result[j].Type {
+			return result[i].Type < result[j].Type
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// GetPorts returns the probed TCP ports and their states, sorted by port
+func (d *Device) GetPorts() []output.PortInfo {
+	result := make([]output.PortInfo, 0, len(d.Ports))
+	for port, state := range d.Ports {
+		result = append(result, output.PortInfo{Port: port, Protocol: "tcp", State: state})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Port < result[j].Port
+	})
+	return result
+}
+
+// AddSegment records an interface/subnet/VLAN the device was seen on
+func (d *Device) AddSegment(iface, subnet, vlan string) {
+	if iface == "" && vlan == "" {
+		return
+	}
+	d.Segments[output.SegmentInfo{Interface: iface, Subnet: subnet, VLAN: vlan}] = true
+}
+
+// inVLAN reports whether the device was seen on the VLAN, or untagged
+// when vlan is empty
+func (d *Device) inVLAN(vlan string) bool {
+	if vlan == "" {
+		return true
+	}
+	for seg := range d.Segments {
+		if seg.VLAN == vlan {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSegments returns the segments the device was seen on, sorted by interface
+func (d *Device) GetSegments() []output.SegmentInfo {
+	result := make([]output.SegmentInfo, 0, len(d.Segments))
+	for seg := range d.Segments {
+		result = append(result, seg)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Interface != result[j].Interface {
+			return result[i].Interface < result[j].Interface
+		}
+		return result[i].VLAN < result[j].VLAN
+	})
+	return result
+}
+
 // ToInfo converts the device to output format
 func (d *Device) ToInfo() output.DeviceInfo {
 	signals := make([]string, 0, len(d.SignalsUsed))
@@ -58,27 +221,262 @@ func (d *Device) ToInfo() output.DeviceInfo {
 	return output.DeviceInfo{
 		MAC:             d.MAC,
 		IPs:             d.GetIPs(),
+		IPv6Addresses:   d.GetIPv6Addresses(),
+		IPv6Prefixes:    d.GetIPv6Prefixes(),
 		Vendor:          d.Vendor,
 		Hostname:        d.Hostname,
+		DUID:            d.DUID,
+		VendorClass:     d.VendorClass,
+		Workgroup:       d.Workgroup,
+		NetBIOSNames:    d.GetNetBIOSNames(),
+		LoggedInUser:    d.LoggedInUser,
+		Roles:           d.GetRoles(),
+		Services:        d.GetServices(),
+		UPnP:            d.UPnP,
+		SNMP:            d.SNMP,
+		RTTMs:           float64(d.RTT.Microseconds()) / 1000,
+		TTL:             d.TTL,
+		Ports:           d.GetPorts(),
 		OSGuess:         d.OSGuess,
+		OSVersion:       d.OSVersion,
 		Confidence:      d.Confidence,
 		SignalsUsed:     signals,
 		DiscoverySource: d.DiscoverySource,
+		SeenOn:          d.GetSegments(),
 		FirstSeen:       d.FirstSeen,
 		LastSeen:        d.LastSeen,
 	}
 }
 
+// ipKeyPrefix marks the registry keys of devices identified by IP
+// address, seen on links that carry no hardware addresses
+const ipKeyPrefix = "ip:"
+
 // DeviceRegistry tracks all discovered devices
 type DeviceRegistry struct {
 	mu      sync.RWMutex
-	devices map[string]*Device // keyed by MAC
+	devices map[string]*Device // keyed by MAC, or ipKeyPrefix + IP
+	ipOwner map[string]string  // IP keys resolved to a MAC-keyed device
 }
 
 // NewDeviceRegistry creates a new device registry
 func NewDeviceRegistry() *DeviceRegistry {
 	return &DeviceRegistry{
 		devices: make(map[string]*Device),
+		ipOwner: make(map[string]string),
+	}
+}
+
+// newKeyedDevice creates the device for a registry key. Devices keyed
+// by IP address have no MAC.
+func newKeyedDevice(key string) *Device {
+	if strings.HasPrefix(key, ipKeyPrefix) {
+		return NewDevice("")
+	}
+	return NewDevice(key)
+}
+
+// PacketKey returns the registry key of a packet's sender. This is its
+// MAC address where the link provides one. Otherwise (tunnels, raw IP,
+// loopback and some cooked captures) it is the device already known to
+// use the source IP, or an identity keyed by that IP and VLAN. Only
+// unicast IPs inside the capture interface's subnet, when known, are
+// used, so remote peers behind a tunnel are not taken for local devices.
+// It returns "" when the sender cannot be identified.
+func (r *DeviceRegistry) PacketKey(packet *capture.PacketMeta) string {
+	if packet.SrcMAC != "" {
+		return packet.SrcMAC
+	}
+	if !isLocalUnicast(packet.SrcIP, packet.Subnet()) {
+		return ""
+	}
+	ip, vlan := packet.SrcIP, packet.VLAN
+	key := ipKeyPrefix + ip
+	if vlan != "" {
+		key = ipKeyPrefix + vlan + "/" + ip
+	}
+
+	r.mu.RLock()
+	owner, resolved := r.ipOwner[key]
+	_, known := r.devices[key]
+	r.mu.RUnlock()
+	if resolved {
+		return owner
+	}
+	if known {
+		return key
+	}
+
+	// First sighting: attribute the IP to a device learned by MAC
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for k, device := range r.devices {
+		if !strings.HasPrefix(k, ipKeyPrefix) && device.IPs[ip] && device.inVLAN(vlan) {
+			r.ipOwner[key] = k
+			return k
+		}
+	}
+	return key
+}
+
+// isLocalUnicast reports whether ip is a unicast address within subnet.
+// Any unicast address is accepted when the subnet is unknown.
+func isLocalUnicast(ip, subnet string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil || addr.IsUnspecified() || addr.IsMulticast() || addr.Equal(net.IPv4bcast) {
+		return false
+	}
+	if subnet == "" {
+		return true
+	}
+	_, network, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return true
+	}
+	return network.Contains(addr) && !addr.Equal(broadcastAddr(network))
+}
+
+// broadcastAddr returns the directed broadcast address of an IPv4 network
+func broadcastAddr(network *net.IPNet) net.IP {
+	ip := network.IP.To4()
+	if ip == nil || len(network.Mask) != net.IPv4len {
+		return nil
+	}
+	result := make(net.IP, net.IPv4len)
+	for i := range ip {
+		result[i] = ip[i] | ^network.Mask[i]
+	}
+	return result
+}
+
+// IPKey returns the registry key of the device using an IP address: the
+// device learned by MAC that holds it, or an identity keyed by the IP.
+// Active probes that only see the IP layer use it to find their target.
+func (r *DeviceRegistry) IPKey(ip string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for key, device := range r.devices {
+		if !strings.HasPrefix(key, ipKeyPrefix) && device.IPs[ip] {
+			return key
+		}
+	}
+	return ipKeyPrefix + ip
+}
+
+// IPv4Hosts returns the lowest IPv4 address of every device that has
+// one, keyed by registry key
+func (r *DeviceRegistry) IPv4Hosts() map[string]net.IP {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	hosts := make(map[string]net.IP)
+	for key, device := range r.devices {
+		for ip := range device.IPs {
+			addr := net.ParseIP(ip).To4()
+			if addr == nil || !addr.IsGlobalUnicast() {
+				continue
+			}
+			if lowest, ok := hosts[key]; !ok || bytes.Compare(addr, lowest) < 0 {
+				hosts[key] = addr
+			}
+		}
+	}
+	return hosts
+}
+
+// ResolveIP records that the device using an IP address has the given
+// MAC, as an active probe's answer can reveal, and returns its key and
+// the IP keys it replaces. A device keyed by the IP, untagged or on a
+// VLAN, is re-keyed by the MAC, or merged into the device already known
+// by it. When the IP is in use on several VLANs the answer cannot be
+// attributed, and the IP-keyed devices are left alone.
+func (r *DeviceRegistry) ResolveIP(ip, mac string) (string, []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var keys []string
+	for key := range r.devices {
+		if key == ipKeyPrefix+ip || (strings.HasPrefix(key, ipKeyPrefix) && strings.HasSuffix(key, "/"+ip)) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) != 1 {
+		return mac, nil
+	}
+
+	key := keys[0]
+	device := r.devices[key]
+	delete(r.devices, key)
+	r.ipOwner[key] = mac
+	if known, ok := r.devices[mac]; ok {
+		known.merge(device)
+		return mac, keys
+	}
+	device.MAC = mac
+	r.devices[mac] = device
+	return mac, keys
+}
+
+// merge adds what is known about other, the same device under another
+// key, to d
+func (d *Device) merge(other *Device) {
+	for ip := range other.IPs {
+		d.IPs[ip] = true
+	}
+	for ip, t := range other.AddressTypes {
+		d.AddressTypes[ip] = t
+	}
+	for prefix := range other.IPv6Prefixes {
+		d.IPv6Prefixes[prefix] = true
+	}
+	for seg := range other.Segments {
+		d.Segments[seg] = true
+	}
+	for role := range other.Roles {
+		d.Roles[role] = true
+	}
+	for name := range other.NetBIOSNames {
+		d.NetBIOSNames[name] = true
+	}
+	for key, svc := range other.Services {
+		d.Services[key] = svc
+	}
+	for port, state := range other.Ports {
+		d.Ports[port] = state
+	}
+	if d.Hostname == "" {
+		d.Hostname = other.Hostname
+	}
+	if d.Workgroup == "" {
+		d.Workgroup = other.Workgroup
+	}
+	if (d.Vendor == "" || d.Vendor == "Unknown") && other.Vendor != "" {
+		d.Vendor = other.Vendor
+	}
+	if d.DUID == "" {
+		d.DUID = other.DUID
+	}
+	if d.VendorClass == "" {
+		d.VendorClass = other.VendorClass
+	}
+	if d.LoggedInUser == "" {
+		d.LoggedInUser = other.LoggedInUser
+	}
+	if d.UPnP == nil {
+		d.UPnP = other.UPnP
+	}
+	if d.SNMP == nil {
+		d.SNMP = other.SNMP
+	}
+	if d.RTT == 0 {
+		d.RTT, d.TTL = other.RTT, other.TTL
+	}
+	if d.DiscoverySource == "passive" {
+		d.DiscoverySource = other.DiscoverySource
+	}
+	if other.FirstSeen.Before(d.FirstSeen) {
+		d.FirstSeen = other.FirstSeen
 	}
 }
 
@@ -92,11 +490,27 @@ func (r *DeviceRegistry) GetOrCreate(mac string) *Device {
 		return device
 	}
 
-	device := NewDevice(mac)
+	device := newKeyedDevice(mac)
 	r.devices[mac] = device
 	return device
 }
 
+// Upsert runs fn on the device with the given key, creating it if needed.
+// fn runs under the registry lock, so concurrent packet handlers can
+// safely update the same device.
+func (r *DeviceRegistry) Upsert(key string, fn func(*Device)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	device, ok := r.devices[key]
+	if !ok {
+		device = newKeyedDevice(key)
+		r.devices[key] = device
+	}
+	fn(device)
+	device.LastSeen = time.Now()
+}
+
 // Get returns a device by MAC address, or nil if not found
 func (r *DeviceRegistry) Get(mac string) *Device {
 	r.mu.RLock()
@@ -136,9 +550,11 @@ func (r *DeviceRegistry) Count() int {
 
 // ToInfoSlice converts all devices to output format
 func (r *DeviceRegistry) ToInfoSlice() []output.DeviceInfo {
-	devices := r.All()
-	result := make([]output.DeviceInfo, 0, len(devices))
-	for _, d := range devices {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	result := make([]output.DeviceInfo, 0, len(r.devices))
+	for _, d := range r.devices {
 		result = append(result, d.ToInfo())
 	}
 	return result
@@ -0,0 +1,271 @@
+package discovery
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/asset_discovery/sensor/internal/capture"
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// DHCPv6 options not named by gopacket
+const dhcpv6OptClientLinkLayerAddr layers.DHCPv6Opt = 79 // RFC 6939, added by relays
+
+// maxRelayHops bounds the unwrapping of nested relay messages
+const maxRelayHops = 8
+
+// DUID types (RFC 8415)
+const (
+	duidLLT = 1
+	duidEN  = 2
+	duidLL  = 3
+)
+
+// DHCPv6Client is what a DHCPv6 message reveals about the client it was
+// sent by or to
+type DHCPv6Client struct {
+	MAC              string // Client's link-layer address, from the frame, a relay or the DUID
+	DUID             string // Colon-separated hex
+	DUIDType         uint16
+	DUIDEnterprise   uint32 // IANA enterprise number of a DUID-EN
+	Hostname         string // First label of the client FQDN option
+	FQDNFlags        byte
+	HasFQDN          bool
+	VendorClass      string
+	VendorEnterprise uint32
+	Addresses        []string // Addresses leased in a Reply
+}
+
+// ParseDHCPv6 decodes the client identity in a DHCPv6 message, unwrapping
+// relayed messages. It returns nil for packets that are not DHCPv6 or
+// carry no client identifier.
+func ParseDHCPv6(packet *capture.PacketMeta) *DHCPv6Client {
+	if !packet.Has(layers.LayerTypeDHCPv6) {
+		return nil
+	}
+
+	msg := &packet.DHCPv6
+	var relayMAC string
+	relayed := false
+	for hops := 0; isRelay(msg.MsgType); hops++ {
+		if hops == maxRelayHops {
+			return nil
+		}
+		// The relay closest to the client is the innermost, so its
+		// link-layer address option wins
+		var inner []byte
+		for _, opt := range msg.Options {
+			switch opt.Code {
+			case layers.DHCPv6OptRelayMessage:
+				inner = opt.Data
+			case dhcpv6OptClientLinkLayerAddr:
+				if len(opt.Data) == 8 && binary.BigEndian.Uint16(opt.Data) == uint16(layers.ARPHardwareTypeEthernet) {
+					relayMAC = formatMAC(opt.Data[2:])
+				}
+			}
+		}
+		if inner == nil {
+			return nil
+		}
+		next := &layers.DHCPv6{}
+		if err := next.DecodeFromBytes(inner, gopacket.NilDecodeFeedback); err != nil {
+			return nil
+		}
+		msg = next
+		relayed = true
+	}
+
+	client := &DHCPv6Client{}
+	var duidMAC string
+	for _, opt := range msg.Options {
+		switch opt.Code {
+		case layers.DHCPv6OptClientID:
+			duidMAC = client.parseDUID(opt.Data)
+		case layers.DHCPv6OptClientFQDN:
+			if len(opt.Data) >= 2 {
+				client.HasFQDN = true
+				client.FQDNFlags = opt.Data[0]
+				client.Hostname = firstLabel(opt.Data[1:])
+			}
+		case layers.DHCPv6OptVendorClass:
+			// Enterprise number, then length-prefixed class data
+			if len(opt.Data) >= 6 {
+				client.VendorEnterprise = binary.BigEndian.Uint32(opt.Data)
+				n := int(binary.BigEndian.Uint16(opt.Data[4:]))
+				if 6+n <= len(opt.Data) {
+					client.VendorClass = string(opt.Data[6 : 6+n])
+				}
+			}
+		case layers.DHCPv6OptIANA:
+			if msg.MsgType == layers.DHCPv6MsgTypeReply && len(opt.Data) >= 12 {
+				client.Addresses = append(client.Addresses, leasedAddresses(opt.Data[12:])...)
+			}
+		case layers.DHCPv6OptIATA:
+			if msg.MsgType == layers.DHCPv6MsgTypeReply && len(opt.Data) >= 4 {
+				client.Addresses = append(client.Addresses, leasedAddresses(opt.Data[4:])...)
+			}
+		}
+	}
+	if client.DUID == "" {
+		return nil
+	}
+
+	// Outside a relay the frame is addressed from or to the client
+	switch {
+	case relayed:
+		client.MAC = relayMAC
+	case fromServer(msg.MsgType):
+		if !isBroadcastOrMulticast(packet.DstMAC) {
+			client.MAC = packet.DstMAC
+		}
+	default:
+		client.MAC = packet.SrcMAC
+	}
+	if client.MAC == "" {
+		client.MAC = duidMAC
+	}
+	return client
+}
+
+// parseDUID records the DUID and returns the MAC address a DUID-LLT or
+// DUID-LL embeds. That is the MAC of the interface the DUID was first
+// generated on, which is not always the one in use.
+func (c *DHCPv6Client) parseDUID(data []byte) string {
+	if len(data) < 2 {
+		return ""
+	}
+	c.DUID = net.HardwareAddr(data).String()
+	c.DUIDType = binary.BigEndian.Uint16(data)
+
+	var hwAddr []byte
+	switch c.DUIDType {
+	case duidLLT:
+		// Hardware type, time, link-layer address
+		if len(data) >= 8 && binary.BigEndian.Uint16(data[2:]) == uint16(layers.ARPHardwareTypeEthernet) {
+			hwAddr = data[8:]
+		}
+	case duidLL:
+		if len(data) >= 4 && binary.BigEndian.Uint16(data[2:]) == uint16(layers.ARPHardwareTypeEthernet) {
+			hwAddr = data[4:]
+		}
+	case duidEN:
+		if len(data) >= 6 {
+			c.DUIDEnterprise = binary.BigEndian.Uint32(data[2:])
+		}
+	}
+	mac := formatMAC(hwAddr)
+	if mac == "" || isBroadcastOrMulticast(mac) {
+		return ""
+	}
+	return mac
+}
+
+// leasedAddresses returns the addresses of the IA Address options within
+// an IA_NA or IA_TA, skipping those with a zero valid lifetime and IAs
+// carrying an error status
+func leasedAddresses(options []byte) []string {
+	var addrs []string
+	for len(options) >= 4 {
+		code := layers.DHCPv6Opt(binary.BigEndian.Uint16(options))
+		n := int(binary.BigEndian.Uint16(options[2:]))
+		if 4+n > len(options) {
+			break
+		}
+		data := options[4 : 4+n]
+		options = options[4+n:]
+
+		switch code {
+		case layers.DHCPv6OptIAAddr:
+			// Address, preferred and valid lifetimes
+			if len(data) >= 24 && binary.BigEndian.Uint32(data[20:]) != 0 {
+				addrs = append(addrs, net.IP(data[:16]).String())
+			}
+		case layers.DHCPv6OptStatusCode:
+			if len(data) >= 2 && binary.BigEndian.Uint16(data) != 0 {
+				return nil
+			}
+		}
+	}
+	return addrs
+}
+
+// firstLabel returns the first label of a DNS wire-format name
+func firstLabel(name []byte) string {
+	if len(name) == 0 {
+		return ""
+	}
+	n := int(name[0])
+	if n == 0 || 1+n > len(name) {
+		return ""
+	}
+	return string(name[1 : 1+n])
+}
+
+// isRelay reports whether a message type wraps another message
+func isRelay(t layers.DHCPv6MsgType) bool {
+	return t == layers.DHCPv6MsgTypeRelayForward || t == layers.DHCPv6MsgTypeRelayReply
+}
+
+// fromServer reports whether a message type is sent by a server
+func fromServer(t layers.DHCPv6MsgType) bool {
+	switch t {
+	case layers.DHCPv6MsgTypeAdvertise, layers.DHCPv6MsgTypeReply, layers.DHCPv6MsgTypeReconfigure:
+		return true
+	}
+	return false
+}
+
+// DHCPv6Key returns the registry key of a DHCPv6 client: its MAC address,
+// or the device already known by its DUID when no MAC is available.
+// It returns "" when the client cannot be identified.
+func (r *DeviceRegistry) DHCPv6Key(client *DHCPv6Client) string {
+	if client.MAC != "" {
+		return client.MAC
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for key, device := range r.devices {
+		if device.DUID == client.DUID {
+			return key
+		}
+	}
+	return ""
+}
+
+// processDHCPv6 records the DUID, hostname, vendor class and leased
+// addresses of DHCPv6 clients
+func (p *PassiveDiscovery) processDHCPv6(packet *capture.PacketMeta) {
+	client := ParseDHCPv6(packet)
+	if client == nil {
+		return
+	}
+	key := p.registry.DHCPv6Key(client)
+	if key == "" {
+		return
+	}
+
+	// Relayed messages were not seen on the client's segment
+	iface, subnet, vlan := packet.Interface, packet.Subnet(), packet.VLAN
+	relayed := isRelay(packet.DHCPv6.MsgType)
+	p.registry.Upsert(key, func(device *Device) {
+		if !relayed {
+			device.AddSegment(iface.Name, subnet, vlan)
+		}
+		if device.Vendor == "" && device.MAC != "" {
+			device.Vendor = p.oui.GetVendor(device.MAC)
+		}
+		device.DUID = client.DUID
+		if device.Hostname == "" && client.Hostname != "" {
+			device.Hostname = client.Hostname
+		}
+		if client.VendorClass != "" {
+			device.VendorClass = client.VendorClass
+		}
+		for _, addr := range client.Addresses {
+			device.AddIP(addr)
+			device.AddressTypes[addr] = "dhcpv6"
+		}
+	})
+}
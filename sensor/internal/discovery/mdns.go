@@ -0,0 +1,247 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/asset_discovery/sensor/internal/output"
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"golang.org/x/net/ipv4"
+)
+
+// mdnsGroup is the IPv4 mDNS multicast group
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+const (
+	// dnssdServices enumerates the service types on the link (RFC 6763)
+	dnssdServices = "_services._dns-sd._udp.local"
+
+	mdnsWait        = time.Second // Time to collect answers after each round of queries
+	maxServiceTypes = 64          // Service types queried, in case a responder lists many
+)
+
+// mdnsService is an advertised service instance and the address that
+// announced it
+type mdnsService struct {
+	responder string
+	info      output.ServiceInfo
+	resolved  bool // SRV record seen
+	hasTXT    bool
+}
+
+// mdnsBrowser browses DNS-SD services with legacy unicast queries
+// (RFC 6762 section 6.7): queries are sent from an ephemeral port, so
+// responders answer directly to it and no multicast membership is needed
+type mdnsBrowser struct {
+	conn  *net.UDPConn
+	dest  *net.UDPAddr
+	id    uint16
+	types map[string]bool
+	// Instances by full name, e.g. "Living Room._googlecast._tcp.local"
+	instances map[string]*mdnsService
+}
+
+// SetMDNS enables DNS-SD service browsing after the ARP sweep
+func (a *ActiveDiscovery) SetMDNS(enabled bool) {
+	a.mdns = enabled
+}
+
+// mdnsBrowse asks the link for its DNS-SD services and records each one
+// on the device that answered
+func (a *ActiveDiscovery) mdnsBrowse(ctx context.Context) error {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: a.localIP})
+	if err != nil {
+		return fmt.Errorf("failed to open mDNS socket: %w", err)
+	}
+	defer conn.Close()
+
+	// Send the multicast queries out of the probed interface
+	if ifi, err := net.InterfaceByName(a.ifaceName); err == nil {
+		if err := ipv4.NewPacketConn(conn).SetMulticastInterface(ifi); err != nil {
+			return fmt.Errorf("failed to select mDNS interface: %w", err)
+		}
+	}
+
+	b := &mdnsBrowser{
+		conn:      conn,
+		dest:      mdnsGroup,
+		types:     make(map[string]bool),
+		instances: make(map[string]*mdnsService),
+	}
+	if err := b.browse(ctx); err != nil {
+		return err
+	}
+	a.recordServices(b.instances)
+	return nil
+}
+
+// browse enumerates service types, then the instances of each type, then
+// resolves instances whose SRV or TXT records were not volunteered
+func (b *mdnsBrowser) browse(ctx context.Context) error {
+	if err := b.query(ctx, question(dnssdServices, layers.DNSTypePTR)); err != nil {
+		return err
+	}
+
+	var questions []layers.DNSQuestion
+	for t := range b.types {
+		if len(questions) == maxServiceTypes {
+			break
+		}
+		questions = append(questions, question(t, layers.DNSTypePTR))
+	}
+	if err := b.query(ctx, questions...); err != nil {
+		return err
+	}
+
+	questions = questions[:0]
+	for name, svc := range b.instances {
+		if !svc.resolved {
+			questions = append(questions, question(name, layers.DNSTypeSRV))
+		}
+		if !svc.hasTXT {
+			questions = append(questions, question(name, layers.DNSTypeTXT))
+		}
+	}
+	return b.query(ctx, questions...)
+}
+
+// query sends one query per question and collects answers for mdnsWait
+func (b *mdnsBrowser) query(ctx context.Context, questions ...layers.DNSQuestion) error {
+	if len(questions) == 0 {
+		return nil
+	}
+	for _, q := range questions {
+		b.id++
+		msg := &layers.DNS{ID: b.id, Questions: []layers.DNSQuestion{q}}
+		buf := gopacket.NewSerializeBuffer()
+		if err := msg.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+			return fmt.Errorf("failed to build mDNS query: %w", err)
+		}
+		if _, err := b.conn.WriteToUDP(buf.Bytes(), b.dest); err != nil {
+			return fmt.Errorf("failed to send mDNS query: %w", err)
+		}
+	}
+
+	deadline := time.Now().Add(mdnsWait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := b.conn.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+
+	data := make([]byte, 9000)
+	for {
+		n, from, err := b.conn.ReadFromUDP(data)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil
+			}
+			return fmt.Errorf("failed to read mDNS response: %w", err)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		var msg layers.DNS
+		if err := msg.DecodeFromBytes(data[:n], gopacket.NilDecodeFeedback); err != nil || !msg.QR {
+			continue
+		}
+		b.handle(from.IP.String(), &msg)
+	}
+}
+
+// handle records the service types, instances, SRV and TXT records of a
+// response. Responders volunteer related records as additionals, so
+// both sections are read.
+func (b *mdnsBrowser) handle(from string, msg *layers.DNS) {
+	records := append(msg.Answers, msg.Additionals...)
+	for _, rr := range records {
+		if rr.Type == layers.DNSTypePTR {
+			name, target := strings.ToLower(string(rr.Name)), string(rr.PTR)
+			if name == dnssdServices {
+				b.types[strings.ToLower(target)] = true
+				continue
+			}
+			serviceType := strings.TrimSuffix(name, ".local")
+			// DNS names are case-insensitive: "Printer._IPP._tcp.local"
+			// is an instance of "_ipp._tcp.local"
+			cut := len(target) - len(name) - 1
+			if cut <= 0 || !strings.EqualFold(target[cut:], "."+name) || !strings.HasPrefix(serviceType, "_") {
+				continue
+			}
+			instance := target[:cut]
+			if _, known := b.instances[strings.ToLower(target)]; !known {
+				b.instances[strings.ToLower(target)] = &mdnsService{
+					responder: from,
+					info:      output.ServiceInfo{Name: instance, Type: serviceType},
+				}
+			}
+		}
+	}
+
+	for _, rr := range records {
+		svc := b.instances[strings.ToLower(string(rr.Name))]
+		if svc == nil {
+			continue
+		}
+		switch rr.Type {
+		case layers.DNSTypeSRV:
+			svc.info.Port = int(rr.SRV.Port)
+			svc.info.Host = string(rr.SRV.Name)
+			svc.resolved = true
+		case layers.DNSTypeTXT:
+			svc.info.TXT = parseTXT(rr.TXTs)
+			svc.hasTXT = true
+		}
+	}
+}
+
+// parseTXT splits DNS-SD TXT strings into keys and values. Keys without
+// a value (boolean attributes) map to "".
+func parseTXT(txts [][]byte) map[string]string {
+	result := make(map[string]string)
+	for _, txt := range txts {
+		if len(txt) == 0 {
+			continue
+		}
+		key, value, _ := strings.Cut(string(txt), "=")
+		if _, dup := result[key]; !dup && key != "" {
+			result[key] = value
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// question builds a DNS question in the IN class
+func question(name string, qtype layers.DNSType) layers.DNSQuestion {
+	return layers.DNSQuestion{Name: []byte(name), Type: qtype, Class: layers.DNSClassIN}
+}
+
+// recordServices attaches browsed services to the devices that
+// announced them, taking the hostname from the SRV target
+func (a *ActiveDiscovery) recordServices(instances map[string]*mdnsService) {
+	for _, svc := range instances {
+		key := a.registry.IPKey(svc.responder)
+		info := svc.info
+		hostname := strings.TrimSuffix(info.Host, ".local")
+		a.registry.Upsert(key, func(device *Device) {
+			device.AddIP(svc.responder)
+			device.AddSegment(a.ifaceName, a.subnet.String(), "")
+			device.AddService(info)
+			device.DiscoverySource = "active-mdns"
+			if device.Hostname == "" && hostname != "" {
+				device.Hostname = hostname
+			}
+		})
+	}
+}
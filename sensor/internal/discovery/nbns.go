@@ -0,0 +1,297 @@
+package discovery
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// NBNS (NetBIOS Name Service, RFC 1002) header flags and opcodes
+const (
+	nbnsResponse = 0x8000
+
+	nbnsOpQuery        = 0
+	nbnsOpRegistration = 5
+	nbnsOpRefresh      = 8
+	nbnsOpRefreshAlt   = 9 // Sent by Windows instead of 8
+
+	nbnsTypeNB     = 0x20
+	nbnsTypeNBSTAT = 0x21
+
+	nbnsGroup = 0x8000 // NB_FLAGS/NAME_FLAGS group name bit
+)
+
+// NetBIOS name suffixes, the 16th byte of a name
+const (
+	nbSuffixWorkstation       = 0x00
+	nbSuffixMasterBrowse      = 0x01 // With the __MSBROWSE__ name
+	nbSuffixMessenger         = 0x03 // Registered for the computer and the logged-in user
+	nbSuffixDomainMaster      = 0x1B
+	nbSuffixDomainControllers = 0x1C
+	nbSuffixMasterBrowser     = 0x1D
+	nbSuffixBrowserElection   = 0x1E
+	nbSuffixFileServer        = 0x20
+)
+
+// msBrowseName is the group name registered by master browsers
+const msBrowseName = "\x01\x02__MSBROWSE__\x02"
+
+// netbiosName is a decoded NetBIOS name
+type netbiosName struct {
+	Name   string // Up to 15 characters, trailing padding removed
+	Suffix byte
+	Group  bool
+}
+
+// nbnsInfo holds the names an NBNS packet claims for its sender
+type nbnsInfo struct {
+	Names   []netbiosName
+	Address string // IPv4 address the names were claimed for; empty for node status
+	MAC     string // Unit ID of a node status response, if not zero
+}
+
+// parseNBNS decodes the names an NBNS packet claims for its sender:
+// those in name registrations and refreshes, positive name query
+// responses, and the name table of a node status response. Queries,
+// releases and negative responses return nil.
+func parseNBNS(data []byte) *nbnsInfo {
+	if len(data) < 12 {
+		return nil
+	}
+	flags := binary.BigEndian.Uint16(data[2:])
+	opcode := (flags >> 11) & 0xF
+	rcode := flags & 0xF
+	qdCount := int(binary.BigEndian.Uint16(data[4:]))
+	rrCount := int(binary.BigEndian.Uint16(data[6:])) + int(binary.BigEndian.Uint16(data[8:])) +
+		int(binary.BigEndian.Uint16(data[10:]))
+
+	if flags&nbnsResponse != 0 {
+		if rcode != 0 || (opcode != nbnsOpQuery && opcode != nbnsOpRegistration && opcode != nbnsOpRefresh) {
+			return nil
+		}
+	} else if opcode != nbnsOpRegistration && opcode != nbnsOpRefresh && opcode != nbnsOpRefreshAlt {
+		return nil
+	}
+
+	// Skip the questions
+	off := 12
+	for i := 0; i < qdCount; i++ {
+		_, next, ok := readNBNSName(data, off)
+		if !ok || next+4 > len(data) {
+			return nil
+		}
+		off = next + 4
+	}
+
+	info := &nbnsInfo{}
+	for i := 0; i < rrCount; i++ {
+		name, next, ok := readNBNSName(data, off)
+		if !ok || next+10 > len(data) {
+			break
+		}
+		rrType := binary.BigEndian.Uint16(data[next:])
+		rdLength := int(binary.BigEndian.Uint16(data[next+8:]))
+		rdata := data[next+10:]
+		if rdLength > len(rdata) {
+			break
+		}
+		rdata = rdata[:rdLength]
+		off = next + 10 + rdLength
+
+		switch rrType {
+		case nbnsTypeNB:
+			// One NB_FLAGS and NB_ADDRESS pair per address the name maps to
+			decoded, ok := decodeNetBIOSName(name)
+			if !ok || len(rdata) < 6 {
+				continue
+			}
+			decoded.Group = binary.BigEndian.Uint16(rdata)&nbnsGroup != 0
+			info.Names = append(info.Names, decoded)
+			if info.Address == "" {
+				info.Address = formatIP(rdata[2:6])
+			}
+		case nbnsTypeNBSTAT:
+			names, mac := parseNodeStatus(rdata)
+			info.Names = append(info.Names, names...)
+			info.MAC = mac
+		}
+	}
+
+	if len(info.Names) == 0 {
+		return nil
+	}
+	return info
+}
+
+// parseNodeStatus decodes the name table of a node status response and
+// the unit ID that starts the statistics after it: the MAC address of
+// the responding adapter, or zeros (Samba)
+func parseNodeStatus(rdata []byte) ([]netbiosName, string) {
+	if len(rdata) < 1 {
+		return nil, ""
+	}
+	count := int(rdata[0])
+	names := make([]netbiosName, 0, count)
+	off := 1
+	for i := 0; i < count && off+18 <= len(rdata); i, off = i+1, off+18 {
+		entry := rdata[off : off+18]
+		names = append(names, netbiosName{
+			Name:   trimNetBIOSName(entry[:15]),
+			Suffix: entry[15],
+			Group:  binary.BigEndian.Uint16(entry[16:])&nbnsGroup != 0,
+		})
+	}
+
+	var mac string
+	if len(names) == count && off+6 <= len(rdata) {
+		if unitID := rdata[off : off+6]; !isZero(unitID) {
+			mac = formatMAC(unitID)
+		}
+	}
+	return names, mac
+}
+
+// isZero reports whether every byte of b is zero
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// readNBNSName returns the first label of the name at off, following a
+// compression pointer if there is one, and the offset after the name.
+// NetBIOS scope labels are skipped.
+func readNBNSName(data []byte, off int) (label []byte, next int, ok bool) {
+	jumps := 0
+	for off < len(data) {
+		n := int(data[off])
+		switch {
+		case n == 0:
+			if next == 0 {
+				next = off + 1
+			}
+			return label, next, label != nil
+		case n&0xC0 == 0xC0:
+			if off+2 > len(data) || jumps >= 4 {
+				return nil, 0, false
+			}
+			if next == 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(data[off:]) & 0x3FFF)
+			jumps++
+		case n&0xC0 != 0 || off+1+n > len(data):
+			return nil, 0, false
+		default:
+			if label == nil {
+				label = data[off+1 : off+1+n]
+			}
+			off += 1 + n
+		}
+	}
+	return nil, 0, false
+}
+
+// decodeNetBIOSName reverses the first-level encoding of a NetBIOS name,
+// in which each byte of the 16-byte name is split into two nibbles
+// carried as the letters 'A' to 'P'
+func decodeNetBIOSName(label []byte) (netbiosName, bool) {
+	if len(label) != 32 {
+		return netbiosName{}, false
+	}
+	var raw [16]byte
+	for i := range raw {
+		hi, lo := label[2*i]-'A', label[2*i+1]-'A'
+		if hi > 15 || lo > 15 {
+			return netbiosName{}, false
+		}
+		raw[i] = hi<<4 | lo
+	}
+	return netbiosName{Name: trimNetBIOSName(raw[:15]), Suffix: raw[15]}, true
+}
+
+// trimNetBIOSName removes the space or NUL padding of a raw name
+func trimNetBIOSName(raw []byte) string {
+	return strings.TrimRight(string(raw), " \x00")
+}
+
+// printableName reports whether a NetBIOS name is plain text that can
+// serve as a hostname or workgroup
+func printableName(name string) bool {
+	if name == "" || name == "*" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] < 0x20 || name[i] > 0x7E {
+			return false
+		}
+	}
+	return true
+}
+
+// applyNetBIOSNames records the names a device holds and the hostname,
+// workgroup or domain, and roles they imply
+func applyNetBIOSNames(device *Device, names []netbiosName) {
+	for _, n := range names {
+		if printableName(n.Name) {
+			device.AddNetBIOSName(fmt.Sprintf("%s<%02X>", n.Name, n.Suffix))
+		}
+		if n.Name == msBrowseName && n.Suffix == nbSuffixMasterBrowse {
+			device.AddRole("master-browser")
+			continue
+		}
+		if !printableName(n.Name) {
+			continue
+		}
+
+		switch {
+		case n.Suffix == nbSuffixWorkstation && !n.Group:
+			device.AddRole("workstation")
+			if device.Hostname == "" {
+				device.Hostname = n.Name
+			}
+		case n.Suffix == nbSuffixFileServer && !n.Group:
+			device.AddRole("file-server")
+			if device.Hostname == "" {
+				device.Hostname = n.Name
+			}
+		case n.Suffix == nbSuffixDomainMaster && !n.Group:
+			device.AddRole("domain-master-browser")
+			device.Workgroup = n.Name
+		case n.Suffix == nbSuffixDomainControllers && n.Group:
+			device.AddRole("domain-controller")
+			device.Workgroup = n.Name
+		case n.Suffix == nbSuffixMasterBrowser && !n.Group:
+			device.AddRole("master-browser")
+			if device.Workgroup == "" {
+				device.Workgroup = n.Name
+			}
+		case (n.Suffix == nbSuffixWorkstation || n.Suffix == nbSuffixBrowserElection) && n.Group:
+			if device.Workgroup == "" {
+				device.Workgroup = n.Name
+			}
+		}
+	}
+}
+
+// loggedInUser returns the user name in a node status name table: a
+// unique messenger name that is not the computer's own. Windows
+// registers it for the user logged on at the console; versions since
+// Vista rarely do.
+func loggedInUser(names []netbiosName) string {
+	computer := make(map[string]bool)
+	for _, n := range names {
+		if !n.Group && (n.Suffix == nbSuffixWorkstation || n.Suffix == nbSuffixFileServer) {
+			computer[n.Name] = true
+		}
+	}
+	for _, n := range names {
+		if n.Suffix == nbSuffixMessenger && !n.Group && !computer[n.Name] && printableName(n.Name) {
+			return n.Name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,245 @@
+package discovery
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+const (
+	nbnsPort  = 137
+	llmnrPort = 5355
+
+	// nameQueryWait is the time to collect answers after the last query
+	nameQueryWait = 2 * time.Second
+
+	// maxNameHosts bounds the hosts asked for their names per run
+	maxNameHosts = 1024
+)
+
+// nbstatQuery is a node status request for the wildcard name "*"
+// (RFC 1002 section 4.2.17), minus the transaction ID
+var nbstatQuery = func() []byte {
+	msg := []byte{
+		0x00, 0x00, // Flags: query, no recursion
+		0x00, 0x01, // One question
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x20, // Encoded name length
+	}
+	// "*" padded with NULs, first-level encoded
+	raw := [16]byte{'*'}
+	for _, b := range raw {
+		msg = append(msg, 'A'+(b>>4), 'A'+(b&0x0F))
+	}
+	msg = append(msg, 0x00) // Root label
+	msg = binary.BigEndian.AppendUint16(msg, nbnsTypeNBSTAT)
+	return binary.BigEndian.AppendUint16(msg, 1) // Class IN
+}()
+
+// nameAnswers are the answers one host gave to the name queries
+type nameAnswers struct {
+	nbstat   *nbnsInfo
+	hostname string // From the LLMNR PTR answer
+}
+
+// SetNameQueries enables NetBIOS node status and reverse LLMNR queries
+// to each IPv4 host discovered so far on a swept subnet or within the
+// targets
+func (a *ActiveDiscovery) SetNameQueries(enabled bool) {
+	a.names = enabled
+}
+
+// nameProbes returns the most packets the name queries can send
+func (a *ActiveDiscovery) nameProbes() uint64 {
+	if !a.names {
+		return 0
+	}
+	return 2 * maxNameHosts
+}
+
+// nameQueries tracks the name queries sent and the answers to them
+type nameQueries struct {
+	mu      sync.Mutex
+	sent    map[string]uint16 // Transaction ID of the queries sent to each IP
+	answers map[string]*nameAnswers
+}
+
+// queryNames asks the discovered hosts in scope for their NetBIOS name
+// table and, over LLMNR, for the name of their address, which reaches
+// Windows hosts that never broadcast
+func (a *ActiveDiscovery) queryNames(ctx context.Context) error {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: a.localIP})
+	if err != nil {
+		return fmt.Errorf("failed to open name query socket: %w", err)
+	}
+
+	q := &nameQueries{
+		sent:    make(map[string]uint16),
+		answers: make(map[string]*nameAnswers),
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		data := make([]byte, 4096)
+		for {
+			n, from, err := conn.ReadFromUDP(data)
+			if err != nil {
+				return
+			}
+			q.handle(from, data[:n])
+		}
+	}()
+
+	pace := newPacer(a.rate)
+	var id uint16
+query:
+	for _, ip := range a.scopedHosts(maxNameHosts) {
+		id++
+		nbstat := binary.BigEndian.AppendUint16(nil, id)
+		llmnr, err := llmnrPTRQuery(id, ip)
+		if err != nil {
+			conn.Close()
+			wg.Wait()
+			return err
+		}
+		q.mu.Lock()
+		q.sent[ip.String()] = id
+		q.mu.Unlock()
+		for _, msg := range []struct {
+			data []byte
+			port int
+		}{{append(nbstat, nbstatQuery...), nbnsPort}, {llmnr, llmnrPort}} {
+			if !pace.send(ctx, func() error {
+				_, err := conn.WriteToUDP(msg.data, &net.UDPAddr{IP: ip, Port: msg.port})
+				return err
+			}) {
+				break query
+			}
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(nameQueryWait):
+	}
+	conn.Close()
+	wg.Wait()
+
+	a.recordNames(q.answers)
+	return nil
+}
+
+// handle records an answer. Only the host asked may answer, with the
+// transaction ID of its query, so stray or spoofed replies cannot name
+// a device or link it to a MAC.
+func (q *nameQueries) handle(from *net.UDPAddr, data []byte) {
+	if len(data) < 2 {
+		return
+	}
+	ip := from.IP.String()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if id, ok := q.sent[ip]; !ok || binary.BigEndian.Uint16(data) != id {
+		return
+	}
+
+	switch from.Port {
+	case nbnsPort:
+		if info := parseNBNS(data); info != nil {
+			q.answer(ip).nbstat = info
+		}
+	case llmnrPort:
+		if name := parseLLMNRPTR(data); name != "" {
+			q.answer(ip).hostname = name
+		}
+	}
+}
+
+// answer returns the answers of a host, creating them if needed
+func (q *nameQueries) answer(ip string) *nameAnswers {
+	if q.answers[ip] == nil {
+		q.answers[ip] = &nameAnswers{}
+	}
+	return q.answers[ip]
+}
+
+// llmnrPTRQuery builds a reverse lookup of ip, which LLMNR responders
+// answer when asked by unicast (RFC 4795 section 2.4)
+func llmnrPTRQuery(id uint16, ip net.IP) ([]byte, error) {
+	ip4 := ip.To4()
+	name := fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0])
+	msg := &layers.DNS{ID: id, Questions: []layers.DNSQuestion{question(name, layers.DNSTypePTR)}}
+	buf := gopacket.NewSerializeBuffer()
+	if err := msg.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		return nil, fmt.Errorf("failed to build LLMNR query: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// parseLLMNRPTR returns the host name in an LLMNR PTR answer
+func parseLLMNRPTR(data []byte) string {
+	var msg layers.DNS
+	if err := msg.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil || !msg.QR {
+		return ""
+	}
+	for _, rr := range msg.Answers {
+		if rr.Type == layers.DNSTypePTR {
+			return strings.TrimSuffix(string(rr.PTR), ".")
+		}
+	}
+	return ""
+}
+
+// SetRekeyHandler sets the function called when a device known by IP
+// is re-keyed by the MAC a name query revealed, so state kept under the
+// old key can follow it
+func (a *ActiveDiscovery) SetRekeyHandler(fn func(oldKey, newKey string)) {
+	a.onRekey = fn
+}
+
+// recordNames attaches the answers to the devices that gave them. A node
+// status response carries the adapter's MAC, which links a device known
+// only by IP, such as a routed one, to its hardware address.
+func (a *ActiveDiscovery) recordNames(answers map[string]*nameAnswers) {
+	for ip, ans := range answers {
+		if ans.nbstat == nil && ans.hostname == "" {
+			continue
+		}
+		key := a.registry.IPKey(ip)
+		var mac string
+		if ans.nbstat != nil && ans.nbstat.MAC != "" && strings.HasPrefix(key, ipKeyPrefix) {
+			mac = ans.nbstat.MAC
+			var replaced []string
+			key, replaced = a.registry.ResolveIP(ip, mac)
+			if a.onRekey != nil {
+				for _, old := range replaced {
+					a.onRekey(old, key)
+				}
+			}
+		}
+
+		a.registry.Upsert(key, func(device *Device) {
+			device.AddIP(ip)
+			if mac != "" && device.Vendor == "" {
+				device.Vendor = a.oui.GetVendor(mac)
+			}
+			if ans.nbstat != nil {
+				applyNetBIOSNames(device, ans.nbstat.Names)
+				if user := loggedInUser(ans.nbstat.Names); user != "" {
+					device.LoggedInUser = user
+				}
+			}
+			if device.Hostname == "" && ans.hostname != "" {
+				device.Hostname = ans.hostname
+			}
+		})
+	}
+}
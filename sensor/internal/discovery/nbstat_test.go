@@ -0,0 +1,59 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// llmnrPTRAnswer builds an LLMNR answer naming the host behind ip
+func llmnrPTRAnswer(t *testing.T, id uint16, ip, name string) []byte {
+	t.Helper()
+	msg := &layers.DNS{
+		ID: id,
+		QR: true,
+		Answers: []layers.DNSResourceRecord{{
+			Name:  []byte(ip + ".in-addr.arpa"),
+			Type:  layers.DNSTypePTR,
+			Class: layers.DNSClassIN,
+			TTL:   30,
+			PTR:   []byte(name),
+		}},
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := msg.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestNameQueriesMatchReplies(t *testing.T) {
+	queried := net.IPv4(10, 0, 0, 5)
+	tests := []struct {
+		name   string
+		from   net.IP
+		id     uint16
+		accept bool
+	}{
+		{"answer", queried, 7, true},
+		{"wrong transaction ID", queried, 8, false},
+		{"host not queried", net.IPv4(10, 0, 0, 6), 7, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &nameQueries{
+				sent:    map[string]uint16{queried.String(): 7},
+				answers: make(map[string]*nameAnswers),
+			}
+			from := &net.UDPAddr{IP: tt.from, Port: llmnrPort}
+			q.handle(from, llmnrPTRAnswer(t, tt.id, "5.0.0.10", "desk-07"))
+
+			ans := q.answers[tt.from.String()]
+			if accepted := ans != nil && ans.hostname == "desk-07"; accepted != tt.accept {
+				t.Errorf("reply accepted: %v, want %v", accepted, tt.accept)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package discovery
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/asset_discovery/sensor/internal/capture"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// ndHopLimit is the hop limit of every valid Neighbor Discovery message
+// (RFC 4861), which therefore never comes from off-link
+const ndHopLimit = 255
+
+// Router Advertisement prefix information flags
+const (
+	prefixOnLink     = 0x80
+	prefixAutonomous = 0x40 // Hosts form SLAAC addresses in the prefix
+)
+
+// processND learns IPv6 addresses and routers from Neighbor Discovery:
+// the addresses hosts solicit from, probe during duplicate address
+// detection and advertise, and the prefixes routers advertise
+func (p *PassiveDiscovery) processND(packet *capture.PacketMeta) {
+	if packet.Protocol != "ICMPv6" || packet.IPv6.HopLimit != ndHopLimit {
+		return
+	}
+
+	var (
+		addrs    []string
+		llAddr   string // Link-layer address option
+		router   bool
+		prefixes []string
+	)
+	switch {
+	case packet.Has(layers.LayerTypeICMPv6NeighborSolicitation):
+		ns := &packet.ICMPv6NS
+		llAddr = linkLayerOption(ns.Options, layers.ICMPv6OptSourceAddress)
+		// Duplicate address detection probes come from the unspecified
+		// address and carry the tentative address as the target
+		if packet.IPv6.SrcIP.IsUnspecified() {
+			addrs = append(addrs, ns.TargetAddress.String())
+		}
+	case packet.Has(layers.LayerTypeICMPv6NeighborAdvertisement):
+		na := &packet.ICMPv6NA
+		llAddr = linkLayerOption(na.Options, layers.ICMPv6OptTargetAddress)
+		addrs = append(addrs, na.TargetAddress.String())
+		router = na.Router()
+	case packet.Has(layers.LayerTypeICMPv6RouterSolicitation):
+		llAddr = linkLayerOption(packet.ICMPv6RS.Options, layers.ICMPv6OptSourceAddress)
+	case packet.Has(layers.LayerTypeICMPv6RouterAdvertisement):
+		ra := &packet.ICMPv6RA
+		llAddr = linkLayerOption(ra.Options, layers.ICMPv6OptSourceAddress)
+		router = true
+		prefixes = advertisedPrefixes(ra.Options)
+	default:
+		return
+	}
+
+	// ND never crosses a router, so the frame's source is the sender.
+	// The link-layer address option identifies it on links without
+	// hardware addresses.
+	mac := packet.SrcMAC
+	if mac == "" {
+		mac = llAddr
+	}
+	if mac == "" || isBroadcastOrMulticast(mac) {
+		return
+	}
+	if !packet.IPv6.SrcIP.IsUnspecified() {
+		addrs = append(addrs, packet.SrcIP)
+	}
+
+	iface, subnet, vlan := packet.Interface, packet.Subnet(), packet.VLAN
+	p.registry.Upsert(mac, func(device *Device) {
+		device.AddSegment(iface.Name, subnet, vlan)
+		if device.Vendor == "" {
+			device.Vendor = p.oui.GetVendor(mac)
+		}
+		for _, addr := range addrs {
+			device.AddIP(addr)
+		}
+		if router {
+			device.AddRole("ipv6-router")
+		}
+		for _, prefix := range prefixes {
+			device.AddIPv6Prefix(prefix)
+		}
+	})
+}
+
+// linkLayerOption returns the MAC address carried in a source or target
+// link-layer address option
+func linkLayerOption(options layers.ICMPv6Options, optType layers.ICMPv6Opt) string {
+	for _, opt := range options {
+		if opt.Type == optType {
+			return formatMAC(opt.Data)
+		}
+	}
+	return ""
+}
+
+// advertisedPrefixes returns the on-link or autonomous prefixes of a
+// Router Advertisement's prefix information options, in CIDR notation
+func advertisedPrefixes(options layers.ICMPv6Options) []string {
+	var prefixes []string
+	for _, opt := range options {
+		// Prefix length, flags, valid and preferred lifetimes, reserved, prefix
+		if opt.Type != layers.ICMPv6OptPrefixInfo || len(opt.Data) < 30 {
+			continue
+		}
+		length, flags := int(opt.Data[0]), opt.Data[1]
+		if length > 128 || flags&(prefixOnLink|prefixAutonomous) == 0 {
+			continue
+		}
+		prefix := net.IP(opt.Data[14:30]).Mask(net.CIDRMask(length, 128))
+		prefixes = append(prefixes, prefix.String()+"/"+strconv.Itoa(length))
+	}
+	return prefixes
+}
+
+// classifyIPv6 labels an IPv6 address by how its interface ID was formed.
+// Addresses assigned by DHCPv6 cannot be told apart this way and are
+// labeled when the lease is seen.
+func classifyIPv6(addr net.IP) string {
+	if addr.IsLinkLocalUnicast() {
+		return "link-local"
+	}
+	iid := addr.To16()[8:]
+	switch {
+	case iid[3] == 0xff && iid[4] == 0xfe:
+		// Modified EUI-64, built from a MAC address
+		return "slaac"
+	case iid[0]|iid[1]|iid[2]|iid[3]|iid[4]|iid[5] == 0:
+		// Short interface IDs such as ::1 or ::53 are set by hand
+		return "static"
+	}
+	return "privacy"
+}
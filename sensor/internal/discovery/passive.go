@@ -1,9 +1,10 @@
 package discovery
 
 import (
+	"strings"
+
 	"github.com/asset_discovery/sensor/internal/capture"
 	"github.com/asset_discovery/sensor/internal/oui"
-	"github.com/gopacket/gopacket"
 	"github.com/gopacket/gopacket/layers"
 )
 
@@ -22,10 +23,9 @@ func NewPassiveDiscovery(registry *DeviceRegistry, ouiLookup *oui.Lookup) *Passi
 }
 
 // ProcessPacket extracts device information from a packet
-func (p *PassiveDiscovery) ProcessPacket(packet gopacket.Packet) {
-	// Extract MACs
-	srcMAC, _ := capture.ExtractMACs(packet)
-	if srcMAC == "" || srcMAC == "ff:ff:ff:ff:ff:ff" {
+func (p *PassiveDiscovery) ProcessPacket(packet *capture.PacketMeta) {
+	srcMAC := packet.SrcMAC
+	if srcMAC == "ff:ff:ff:ff:ff:ff" {
 		return
 	}
 
@@ -34,56 +34,62 @@ func (p *PassiveDiscovery) ProcessPacket(packet gopacket.Packet) {
 		return
 	}
 
-	// Get or create device
-	device := p.registry.GetOrCreate(srcMAC)
+	// Neighbor Discovery names its sender by link-layer address even
+	// on links that carry none
+	p.processND(packet)
 
-	// Add vendor if not set
-	if device.Vendor == "" {
-		device.Vendor = p.oui.GetVendor(srcMAC)
+	// Links without hardware addresses identify devices by IP
+	key := p.registry.PacketKey(packet)
+	if key == "" {
+		return
 	}
 
-	// Extract and add IP
-	srcIP, _ := capture.ExtractIPs(packet)
-	if srcIP != "" && !isBroadcastIP(srcIP) {
-		device.AddIP(srcIP)
-	}
+	// Decode before taking the registry lock
+	srcIP := packet.SrcIP
+	hostname := p.extractMDNSHostname(packet)
+	netbios := p.extractNBNS(packet)
+	iface, subnet, vlan := packet.Interface, packet.Subnet(), packet.VLAN
+
+	p.registry.Upsert(key, func(device *Device) {
+		device.AddSegment(iface.Name, subnet, vlan)
+
+		// Add vendor if not set
+		if device.Vendor == "" && srcMAC != "" {
+			device.Vendor = p.oui.GetVendor(srcMAC)
+		}
+
+		// Add IP
+		if srcIP != "" && !isBroadcastIP(srcIP) {
+			device.AddIP(srcIP)
+		}
 
-	// Try to extract hostname from various protocols
-	p.extractHostname(packet, device)
+		// Add hostname from mDNS if not already known
+		if hostname != "" && device.Hostname == "" {
+			device.Hostname = hostname
+		}
+
+		// Add hostname, workgroup and roles from NetBIOS names
+		applyNetBIOSNames(device, netbios)
+	})
 
 	// Process ARP for additional IP-MAC mappings
 	p.processARP(packet)
 
 	// Process DHCP for hostname and IP info
 	p.processDHCP(packet)
-}
-
-// extractHostname tries to extract hostname from various protocols
-func (p *PassiveDiscovery) extractHostname(packet gopacket.Packet, device *Device) {
-	// Try mDNS
-	if hostname := p.extractMDNSHostname(packet); hostname != "" && device.Hostname == "" {
-		device.Hostname = hostname
-	}
-
-	// Try NBNS
-	if hostname := p.extractNBNSHostname(packet); hostname != "" && device.Hostname == "" {
-		device.Hostname = hostname
-	}
+	p.processDHCPv6(packet)
 }
 
 // extractMDNSHostname extracts hostname from mDNS packets
-func (p *PassiveDiscovery) extractMDNSHostname(packet gopacket.Packet) string {
-	dnsLayer := packet.Layer(layers.LayerTypeDNS)
-	if dnsLayer == nil {
+func (p *PassiveDiscovery) extractMDNSHostname(packet *capture.PacketMeta) string {
+	if !packet.Has(layers.LayerTypeDNS) {
 		return ""
 	}
-
-	_, dstPort, proto := capture.ExtractPorts(packet)
-	if proto != "UDP" || dstPort != 5353 {
+	if packet.Protocol != "UDP" || packet.DstPort != 5353 {
 		return ""
 	}
 
-	dns := dnsLayer.(*layers.DNS)
+	dns := &packet.DNS
 
 	// Look for hostname in answers
 	for _, answer := range dns.Answers {
@@ -104,27 +110,29 @@ func (p *PassiveDiscovery) extractMDNSHostname(packet gopacket.Packet) string {
 	return ""
 }
 
-// extractNBNSHostname extracts hostname from NBNS packets
-func (p *PassiveDiscovery) extractNBNSHostname(packet gopacket.Packet) string {
+// extractNBNS returns the NetBIOS names an NBNS packet claims for its
+// sender. Names claimed for another address, as a WINS server does when
+// answering for a client, are ignored.
+func (p *PassiveDiscovery) extractNBNS(packet *capture.PacketMeta) []netbiosName {
 	// NBNS uses UDP port 137
-	_, dstPort, proto := capture.ExtractPorts(packet)
-	if proto != "UDP" || (dstPort != 137 && dstPort != 138) {
-		return ""
+	if packet.Protocol != "UDP" || (packet.SrcPort != 137 && packet.DstPort != 137) {
+		return nil
 	}
 
-	// NBNS name decoding is complex - simplified version
-	// Full implementation would decode the NetBIOS name from the payload
-	return ""
+	info := parseNBNS(packet.UDP.Payload)
+	if info == nil || (info.Address != "" && info.Address != packet.SrcIP) {
+		return nil
+	}
+	return info.Names
 }
 
 // processARP extracts IP-MAC mappings from ARP packets
-func (p *PassiveDiscovery) processARP(packet gopacket.Packet) {
-	arpLayer := packet.Layer(layers.LayerTypeARP)
-	if arpLayer == nil {
+func (p *PassiveDiscovery) processARP(packet *capture.PacketMeta) {
+	if !packet.Has(layers.LayerTypeARP) {
 		return
 	}
 
-	arp := arpLayer.(*layers.ARP)
+	arp := &packet.ARP
 
 	// Process sender
 	if arp.Operation == layers.ARPReply || arp.Operation == layers.ARPRequest {
@@ -132,51 +140,88 @@ func (p *PassiveDiscovery) processARP(packet gopacket.Packet) {
 		srcIP := formatIP(arp.SourceProtAddress)
 
 		if srcMAC != "" && srcIP != "" && !isBroadcastOrMulticast(srcMAC) {
-			device := p.registry.GetOrCreate(srcMAC)
-			device.AddIP(srcIP)
-			if device.Vendor == "" {
-				device.Vendor = p.oui.GetVendor(srcMAC)
-			}
+			iface, subnet, vlan := packet.Interface, packet.Subnet(), packet.VLAN
+			p.registry.Upsert(srcMAC, func(device *Device) {
+				device.AddIP(srcIP)
+				device.AddSegment(iface.Name, subnet, vlan)
+				if device.Vendor == "" {
+					device.Vendor = p.oui.GetVendor(srcMAC)
+				}
+			})
 		}
 	}
 }
 
 // processDHCP extracts information from DHCP packets
-func (p *PassiveDiscovery) processDHCP(packet gopacket.Packet) {
+func (p *PassiveDiscovery) processDHCP(packet *capture.PacketMeta) {
 	// DHCP uses UDP 67/68
-	_, dstPort, proto := capture.ExtractPorts(packet)
-	if proto != "UDP" || (dstPort != 67 && dstPort != 68) {
+	if packet.Protocol != "UDP" || (packet.DstPort != 67 && packet.DstPort != 68) {
 		return
 	}
 
 	// Parse DHCP layer (gopacket has DHCPv4 support)
-	dhcpLayer := packet.Layer(layers.LayerTypeDHCPv4)
-	if dhcpLayer == nil {
+	if !packet.Has(layers.LayerTypeDHCPv4) {
 		return
 	}
 
-	dhcp := dhcpLayer.(*layers.DHCPv4)
+	dhcp := &packet.DHCPv4
 	srcMAC := formatMAC(dhcp.ClientHWAddr)
 
 	if srcMAC == "" || isBroadcastOrMulticast(srcMAC) {
 		return
 	}
 
-	device := p.registry.GetOrCreate(srcMAC)
-
-	// Get hostname from DHCP options
-	for _, opt := range dhcp.Options {
-		if opt.Type == layers.DHCPOptHostname {
-			if device.Hostname == "" {
-				device.Hostname = string(opt.Data)
+	iface, subnet, vlan := packet.Interface, packet.Subnet(), packet.VLAN
+	p.registry.Upsert(srcMAC, func(device *Device) {
+		device.AddSegment(iface.Name, subnet, vlan)
+
+		// Get hostname from DHCP options, preferring option 12 over
+		// the client FQDN (option 81)
+		var fqdnHost string
+		for _, opt := range dhcp.Options {
+			if opt.Type == layers.DHCPOptHostname {
+				if device.Hostname == "" {
+					device.Hostname = string(opt.Data)
+				}
+			}
+			if opt.Type == DHCPOptClientFQDN {
+				fqdnHost = parseClientFQDN(opt.Data)
+			}
+			if opt.Type == layers.DHCPOptClassID {
+				device.VendorClass = string(opt.Data)
 			}
 		}
-	}
+		if device.Hostname == "" && fqdnHost != "" {
+			device.Hostname = fqdnHost
+		}
+
+		// Add client IP if assigned
+		if dhcp.YourClientIP != nil && !dhcp.YourClientIP.IsUnspecified() {
+			device.AddIP(dhcp.YourClientIP.String())
+		}
+	})
+}
 
-	// Add client IP if assigned
-	if dhcp.YourClientIP != nil && !dhcp.YourClientIP.IsUnspecified() {
-		device.AddIP(dhcp.YourClientIP.String())
+// DHCPOptClientFQDN is DHCP option 81 (RFC 4702), not named by gopacket
+const DHCPOptClientFQDN layers.DHCPOpt = 81
+
+// parseClientFQDN returns the host part of a DHCP client FQDN option.
+// The name follows the flags and two RCODE bytes, in DNS wire format
+// when the E flag is set and as plain ASCII otherwise.
+func parseClientFQDN(data []byte) string {
+	if len(data) < 4 {
+		return ""
+	}
+	name := data[3:]
+	if data[0]&0x04 != 0 {
+		n := int(name[0])
+		if n == 0 || 1+n > len(name) {
+			return ""
+		}
+		return string(name[1 : 1+n])
 	}
+	host, _, _ := strings.Cut(string(name), ".")
+	return host
 }
 
 // Helper functions
@@ -235,5 +280,5 @@ func isBroadcastOrMulticast(mac string) bool {
 }
 
 func isBroadcastIP(ip string) bool {
-	return ip == "255.255.255.255" || ip == "0.0.0.0"
+	return ip == "255.255.255.255" || ip == "0.0.0.0" || ip == "::"
 }
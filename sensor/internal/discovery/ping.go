@@ -0,0 +1,400 @@
+package discovery
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// Ping methods
+const (
+	PingEcho      = "echo"      // ICMP echo request
+	PingTimestamp = "timestamp" // ICMP timestamp request, often let through where echo is filtered
+	PingSYN       = "syn"       // TCP SYN, answered with SYN-ACK or RST
+	PingACK       = "ack"       // TCP ACK, answered with RST by hosts behind stateless filters
+)
+
+// pingWait is the time to collect replies after the last probe
+const pingWait = 2 * time.Second
+
+// DefaultPingPorts are the TCP ports SYN and ACK pings are sent to
+var DefaultPingPorts = []int{80, 443}
+
+// pingReply is the first reply a host sent to a ping
+type pingReply struct {
+	rtt    time.Duration
+	ttl    int    // Zero where the platform does not report it
+	source string // "active-icmp" or "active-tcp"
+}
+
+// pinger sends ICMP and TCP pings over raw IP sockets, so routed hosts
+// are reached through the routing table, and matches the replies
+type pinger struct {
+	icmp    *ipv4.PacketConn
+	tcp     *ipv4.PacketConn
+	id      uint16 // ICMP identifier
+	port    uint16 // TCP source port
+	ports   []int  // TCP destination ports
+	mu      sync.Mutex
+	sent    map[string]time.Time // Send time by probe, see probeKey
+	replies map[string]*pingReply
+}
+
+// SetPing enables ping sweeps with the given methods ("echo",
+// "timestamp", "syn", "ack") after the ARP sweep. The targets are
+// swept, or the subnet when none are set.
+func (a *ActiveDiscovery) SetPing(methods []string) error {
+	for _, m := range methods {
+		switch m {
+		case PingEcho, PingTimestamp, PingSYN, PingACK:
+		default:
+			return fmt.Errorf("unknown ping method %q", m)
+		}
+	}
+	a.ping = methods
+	return nil
+}
+
+// SetPingPorts sets the TCP ports SYN and ACK pings are sent to
+func (a *ActiveDiscovery) SetPingPorts(ports []int) error {
+	for _, port := range ports {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid ping port %d", port)
+		}
+	}
+	a.pingPorts = ports
+	return nil
+}
+
+// SetTTLHandler sets the function ping replies report their TTL to,
+// keyed by device registry key
+func (a *ActiveDiscovery) SetTTLHandler(fn func(key string, ttl int)) {
+	a.onTTL = fn
+}
+
+// pingRanges returns the addresses to ping
+func (a *ActiveDiscovery) pingRanges() []ipRange {
+	if len(a.targets) > 0 {
+		return a.targets
+	}
+	if a.subnet == nil || a.subnet.IP.To4() == nil {
+		return nil
+	}
+	return []ipRange{hostRange(a.subnet)}
+}
+
+// pingProbes returns the number of packets the ping sweep sends
+func (a *ActiveDiscovery) pingProbes() uint64 {
+	perHost := 0
+	for _, m := range a.ping {
+		if m == PingSYN || m == PingACK {
+			perHost += len(a.pingPorts)
+		} else {
+			perHost++
+		}
+	}
+	return countRanges(a.pingRanges()) * uint64(perHost)
+}
+
+// pingSweep pings every target with each enabled method and records the
+// hosts that answer
+func (a *ActiveDiscovery) pingSweep(ctx context.Context) error {
+	p := &pinger{
+		id:      uint16(rand.Intn(1 << 16)),
+		port:    randomPort(),
+		ports:   a.pingPorts,
+		sent:    make(map[string]time.Time),
+		replies: make(map[string]*pingReply),
+	}
+
+	var wg sync.WaitGroup
+	for _, m := range a.ping {
+		var err error
+		switch {
+		case (m == PingEcho || m == PingTimestamp) && p.icmp == nil:
+			p.icmp, err = listenRaw("ip4:icmp", a.localIP)
+			if err == nil {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					p.readICMP()
+				}()
+			}
+		case (m == PingSYN || m == PingACK) && p.tcp == nil:
+			p.tcp, err = listenRaw("ip4:tcp", a.localIP)
+			if err == nil {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					p.readTCP()
+				}()
+			}
+		}
+		if err != nil {
+			p.close()
+			wg.Wait()
+			return err
+		}
+	}
+
+	pace := newPacer(a.rate)
+	var seq uint16
+	forEachIP(a.pingRanges(), func(ip net.IP) bool {
+		if ip.Equal(a.localIP) {
+			return true
+		}
+		for _, m := range a.ping {
+			ports := []int{0}
+			if m == PingSYN || m == PingACK {
+				ports = p.ports
+			}
+			for _, port := range ports {
+				if !pace.send(ctx, func() error {
+					seq++
+					return p.send(m, ip, port, seq)
+				}) {
+					return false
+				}
+			}
+		}
+		return true
+	})
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(pingWait):
+	}
+	p.close()
+	wg.Wait()
+
+	a.recordPings(p.replies)
+	return nil
+}
+
+// listenRaw opens a raw IPv4 socket for a protocol, reporting the TTL of
+// received packets where the platform supports it
+func listenRaw(network string, localIP net.IP) (*ipv4.PacketConn, error) {
+	conn, err := net.ListenPacket(network, localIP.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s socket: %w", network, err)
+	}
+	pc := ipv4.NewPacketConn(conn)
+	_ = pc.SetControlMessage(ipv4.FlagTTL, true)
+	return pc, nil
+}
+
+// close closes the sockets, ending the readers
+func (p *pinger) close() {
+	if p.icmp != nil {
+		p.icmp.Close()
+	}
+	if p.tcp != nil {
+		p.tcp.Close()
+	}
+}
+
+// probeKey identifies a probe so its reply can be timed
+func probeKey(method string, ip net.IP, port int) string {
+	return method + "/" + ip.String() + "/" + strconv.Itoa(port)
+}
+
+// send sends one probe
+func (p *pinger) send(method string, ip net.IP, port int, seq uint16) error {
+	var (
+		data []byte
+		conn = p.icmp
+		err  error
+	)
+	switch method {
+	case PingEcho:
+		msg := icmp.Message{
+			Type: ipv4.ICMPTypeEcho,
+			Body: &icmp.Echo{ID: int(p.id), Seq: int(seq)},
+		}
+		data, err = msg.Marshal(nil)
+	case PingTimestamp:
+		// Identifier, sequence number, originate, receive and transmit
+		// timestamps; the last two are filled in by the responder
+		body := make([]byte, 16)
+		binary.BigEndian.PutUint16(body, p.id)
+		binary.BigEndian.PutUint16(body[2:], seq)
+		binary.BigEndian.PutUint32(body[4:], msSinceMidnight(time.Now()))
+		msg := icmp.Message{Type: ipv4.ICMPTypeTimestamp, Body: &icmp.RawBody{Data: body}}
+		data, err = msg.Marshal(nil)
+	case PingSYN, PingACK:
+		conn = p.tcp
+		data, err = tcpProbe(p.tcp, p.port, ip, port, method == PingSYN)
+	}
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.sent[probeKey(method, ip, port)] = time.Now()
+	p.mu.Unlock()
+	_, err = conn.WriteTo(data, nil, &net.IPAddr{IP: ip})
+	return err
+}
+
+// tcpProbe builds a SYN or ACK segment to be sent on conn; the kernel
+// adds the IP header
+func tcpProbe(conn *ipv4.PacketConn, srcPort uint16, ip net.IP, port int, syn bool) ([]byte, error) {
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(port),
+		Seq:     rand.Uint32(),
+		Window:  1024,
+	}
+	if syn {
+		tcp.SYN = true
+	} else {
+		tcp.ACK = true
+		tcp.Ack = rand.Uint32()
+	}
+	// Only used for the checksum pseudo-header
+	ipLayer := &layers.IPv4{Protocol: layers.IPProtocolTCP, DstIP: ip}
+	if src, ok := conn.LocalAddr().(*net.IPAddr); ok {
+		ipLayer.SrcIP = src.IP
+	}
+	if err := tcp.SetNetworkLayerForChecksum(ipLayer); err != nil {
+		return nil, err
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := tcp.SerializeTo(buf, opts); err != nil {
+		return nil, fmt.Errorf("failed to build TCP probe: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// readICMP collects echo and timestamp replies carrying our identifier
+func (p *pinger) readICMP() {
+	data := make([]byte, 1500)
+	for {
+		n, cm, from, err := p.icmp.ReadFrom(data)
+		if err != nil {
+			return
+		}
+		msg, err := icmp.ParseMessage(1, data[:n])
+		if err != nil {
+			continue
+		}
+
+		var method string
+		switch msg.Type {
+		case ipv4.ICMPTypeEchoReply:
+			if echo, ok := msg.Body.(*icmp.Echo); ok && echo.ID == int(p.id) {
+				method = PingEcho
+			}
+		case ipv4.ICMPTypeTimestampReply:
+			if raw, ok := msg.Body.(*icmp.RawBody); ok && len(raw.Data) >= 16 && binary.BigEndian.Uint16(raw.Data) == p.id {
+				method = PingTimestamp
+			}
+		}
+		if method != "" {
+			p.reply(method, from, 0, cm, "active-icmp")
+		}
+	}
+}
+
+// readTCP collects SYN-ACK and RST replies to our probes
+func (p *pinger) readTCP() {
+	data := make([]byte, 1500)
+	for {
+		n, cm, from, err := p.tcp.ReadFrom(data)
+		if err != nil {
+			return
+		}
+		var tcp layers.TCP
+		if err := tcp.DecodeFromBytes(data[:n], gopacket.NilDecodeFeedback); err != nil {
+			continue
+		}
+		if uint16(tcp.DstPort) != p.port || !(tcp.RST || tcp.SYN && tcp.ACK) {
+			continue
+		}
+
+		// A SYN-ACK or RST answers a SYN, only a RST answers an ACK
+		port := int(tcp.SrcPort)
+		p.reply(PingSYN, from, port, cm, "active-tcp")
+		if tcp.RST {
+			p.reply(PingACK, from, port, cm, "active-tcp")
+		}
+	}
+}
+
+// reply records the first answered probe of a host
+func (p *pinger) reply(method string, from net.Addr, port int, cm *ipv4.ControlMessage, source string) {
+	addr, ok := from.(*net.IPAddr)
+	if !ok {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sent, ok := p.sent[probeKey(method, addr.IP, port)]
+	ip := addr.IP.String()
+	if !ok || p.replies[ip] != nil {
+		return
+	}
+	r := &pingReply{rtt: time.Since(sent), source: source}
+	if cm != nil {
+		r.ttl = cm.TTL
+	}
+	p.replies[ip] = r
+}
+
+// recordPings adds the hosts that answered as devices, keyed by IP unless
+// already known by MAC, and reports their TTLs
+func (a *ActiveDiscovery) recordPings(replies map[string]*pingReply) {
+	for ip, reply := range replies {
+		key := a.registry.IPKey(ip)
+		// Routed hosts are not on the probed segment
+		onLink := a.subnet.Contains(net.ParseIP(ip))
+		a.registry.Upsert(key, func(device *Device) {
+			device.AddIP(ip)
+			if onLink {
+				device.AddSegment(a.ifaceName, a.subnet.String(), "")
+			}
+			// Earlier probes and passive sightings keep what they recorded
+			if device.RTT == 0 {
+				device.RTT = reply.rtt
+			}
+			if device.TTL == 0 {
+				device.TTL = reply.ttl
+			}
+			// Devices start out as "passive" until a probe finds them
+			if device.DiscoverySource == "" || device.DiscoverySource == "passive" {
+				device.DiscoverySource = reply.source
+			}
+		})
+
+		if a.onTTL != nil && reply.ttl > 0 {
+			a.onTTL(key, reply.ttl)
+		}
+	}
+}
+
+// randomPort returns a source port for raw TCP probes, in the range
+// Linux uses for ephemeral ports
+func randomPort() uint16 {
+	return uint16(32768 + rand.Intn(28232))
+}
+
+// msSinceMidnight returns the ICMP timestamp of t: milliseconds since
+// midnight UTC (RFC 792)
+func msSinceMidnight(t time.Time) uint32 {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return uint32(t.Sub(midnight).Milliseconds())
+}
@@ -0,0 +1,273 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/asset_discovery/sensor/internal/output"
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"golang.org/x/net/ipv4"
+)
+
+// Port states
+const (
+	PortOpen     = "open"
+	PortClosed   = "closed"
+	PortFiltered = "filtered"
+)
+
+const (
+	// portProbeWait is the time to collect answers after the last SYN
+	portProbeWait = 2 * time.Second
+
+	// MaxProbePorts bounds the port list, keeping the probe light
+	MaxProbePorts = 32
+
+	// DefaultProbeHosts is the default cap on hosts port-probed per run
+	DefaultProbeHosts = 256
+)
+
+// DefaultProbePorts are SSH, HTTP(S), SMB, RDP, raw printing and RTSP
+var DefaultProbePorts = []int{22, 80, 443, 445, 3389, 9100, 554}
+
+// printerPorts are the ports of printing protocols: raw (JetDirect),
+// LPD and IPP
+var printerPorts = []int{9100, 515, 631}
+
+// portScanner sends one SYN per host and port over a raw socket and
+// classifies the answers
+type portScanner struct {
+	conn   *ipv4.PacketConn
+	port   uint16 // Source port
+	mu     sync.Mutex
+	states map[string]map[int]string // By host IP, then port; unanswered probes are absent
+}
+
+// SetPortProbe enables a SYN probe of the given ports on each device
+// discovered so far on a swept subnet or within the targets, at most
+// maxHosts of them
+func (a *ActiveDiscovery) SetPortProbe(ports []int, maxHosts int) error {
+	if len(ports) > MaxProbePorts {
+		return fmt.Errorf("at most %d probe ports are allowed", MaxProbePorts)
+	}
+	for _, port := range ports {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid probe port %d", port)
+		}
+	}
+	if maxHosts < 1 {
+		return fmt.Errorf("probe host cap must be positive")
+	}
+	a.probePorts = ports
+	a.probeHosts = maxHosts
+	return nil
+}
+
+// portProbes returns the most packets the port probe can send
+func (a *ActiveDiscovery) portProbes() uint64 {
+	return uint64(len(a.probePorts)) * uint64(a.probeHosts)
+}
+
+// discoveredHosts returns an IPv4 address of each device discovered so
+// far, in address order and at most limit of them. The sensor's own
+// address is skipped.
+func (a *ActiveDiscovery) discoveredHosts(limit int) []net.IP {
+	var hosts []net.IP
+	seen := make(map[string]bool)
+	for _, ip := range a.registry.IPv4Hosts() {
+		if !ip.Equal(a.localIP) && !seen[ip.String()] {
+			seen[ip.String()] = true
+			hosts = append(hosts, ip)
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return bytes.Compare(hosts[i], hosts[j]) < 0
+	})
+	if len(hosts) > limit {
+		hosts = hosts[:limit]
+	}
+	return hosts
+}
+
+// scopedHosts returns the discovered hosts on a probed subnet or within
+// the targets, in address order and at most limit of them. Devices only
+// seen in passing, such as peers of captured traffic, are left out.
+func (a *ActiveDiscovery) scopedHosts(limit int) []net.IP {
+	var hosts []net.IP
+	for _, ip := range a.discoveredHosts(math.MaxInt) {
+		if len(hosts) == limit {
+			break
+		}
+		if a.inScope(ip) {
+			hosts = append(hosts, ip)
+		}
+	}
+	return hosts
+}
+
+// inScope reports whether ip is on the interface's subnet, on another
+// subnet swept in the same run, or within the targets
+func (a *ActiveDiscovery) inScope(ip net.IP) bool {
+	if a.subnet != nil && a.subnet.Contains(ip) {
+		return true
+	}
+	for _, subnet := range a.scope {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return inRanges(a.targets, ip)
+}
+
+// portProbe SYN-probes the configured ports of discovered devices and
+// records their states
+func (a *ActiveDiscovery) portProbe(ctx context.Context) error {
+	conn, err := listenRaw("ip4:tcp", a.localIP)
+	if err != nil {
+		return err
+	}
+	s := &portScanner{
+		conn:   conn,
+		port:   randomPort(),
+		states: make(map[string]map[int]string),
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.read()
+	}()
+
+	// Only hosts whose probes were all sent are recorded
+	hosts := a.scopedHosts(a.probeHosts)
+	probed := 0
+	pace := newPacer(a.rate)
+probe:
+	for _, ip := range hosts {
+		for _, port := range a.probePorts {
+			data, err := tcpProbe(conn, s.port, ip, port, true)
+			if err != nil {
+				conn.Close()
+				wg.Wait()
+				return err
+			}
+			if !pace.send(ctx, func() error {
+				_, err := conn.WriteTo(data, nil, &net.IPAddr{IP: ip})
+				return err
+			}) {
+				break probe
+			}
+		}
+		probed++
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(portProbeWait):
+	}
+	conn.Close()
+	wg.Wait()
+
+	a.recordPorts(hosts[:probed], s.states)
+	return nil
+}
+
+// read records SYN-ACKs as open ports and RSTs as closed ones
+func (s *portScanner) read() {
+	data := make([]byte, 1500)
+	for {
+		n, _, from, err := s.conn.ReadFrom(data)
+		if err != nil {
+			return
+		}
+		addr, ok := from.(*net.IPAddr)
+		if !ok {
+			continue
+		}
+		var tcp layers.TCP
+		if err := tcp.DecodeFromBytes(data[:n], gopacket.NilDecodeFeedback); err != nil {
+			continue
+		}
+		if uint16(tcp.DstPort) != s.port {
+			continue
+		}
+
+		var state string
+		switch {
+		case tcp.SYN && tcp.ACK:
+			state = PortOpen
+		case tcp.RST:
+			state = PortClosed
+		default:
+			continue
+		}
+		ip := addr.IP.String()
+		s.mu.Lock()
+		if s.states[ip] == nil {
+			s.states[ip] = make(map[int]string)
+		}
+		s.states[ip][int(tcp.SrcPort)] = state
+		s.mu.Unlock()
+	}
+}
+
+// recordPorts attaches the port states of each probed host to its
+// device, marking unanswered ports filtered, and reports what the open
+// ports suggest
+func (a *ActiveDiscovery) recordPorts(hosts []net.IP, states map[string]map[int]string) {
+	for _, addr := range hosts {
+		ip := addr.String()
+		ports := make(map[int]string, len(a.probePorts))
+		open := make(map[int]bool)
+		for _, port := range a.probePorts {
+			state, ok := states[ip][port]
+			if !ok {
+				state = PortFiltered
+			}
+			ports[port] = state
+			open[port] = state == PortOpen
+		}
+
+		key := a.registry.IPKey(ip)
+		a.registry.Upsert(key, func(device *Device) {
+			for port, state := range ports {
+				device.Ports[port] = state
+			}
+			for _, port := range printerPorts {
+				if open[port] {
+					device.AddRole("printer")
+				}
+			}
+		})
+
+		if a.onSignal != nil {
+			for _, signal := range portSignals(open) {
+				a.onSignal(key, signal)
+			}
+		}
+	}
+}
+
+// portSignals derives fingerprinting signals from open ports. SMB and
+// RDP together are characteristic of Windows. Printing ports say nothing
+// about the OS, so they only add the printer role.
+func portSignals(open map[int]bool) []output.Signal {
+	var signals []output.Signal
+	if open[445] && open[3389] {
+		signals = append(signals, output.Signal{
+			Type:   "Ports",
+			Detail: "445+3389",
+			Weight: 0.7,
+			OS:     "Windows",
+		})
+	}
+	return signals
+}
@@ -0,0 +1,389 @@
+package discovery
+
+import (
+	"context"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/asset_discovery/sensor/internal/output"
+)
+
+const (
+	snmpPort = 161
+
+	// snmpWait is the time to collect answers after each round of requests
+	snmpWait = 2 * time.Second
+
+	// maxSNMPHosts bounds the hosts queried per run
+	maxSNMPHosts = 1024
+)
+
+// SNMP versions as carried in messages
+const (
+	snmpV1  = 0
+	snmpV2c = 1
+)
+
+// PDU tags (RFC 3416), context-specific and constructed
+const (
+	snmpGetRequest = 0
+	snmpResponse   = 2
+)
+
+// System group objects (RFC 3418)
+var (
+	oidSysDescr    = asn1.ObjectIdentifier{1, 3, 6, 1, 2, 1, 1, 1, 0}
+	oidSysObjectID = asn1.ObjectIdentifier{1, 3, 6, 1, 2, 1, 1, 2, 0}
+	oidSysUpTime   = asn1.ObjectIdentifier{1, 3, 6, 1, 2, 1, 1, 3, 0}
+	oidSysName     = asn1.ObjectIdentifier{1, 3, 6, 1, 2, 1, 1, 5, 0}
+	oidSysLocation = asn1.ObjectIdentifier{1, 3, 6, 1, 2, 1, 1, 6, 0}
+
+	systemGroup = []asn1.ObjectIdentifier{oidSysDescr, oidSysObjectID, oidSysUpTime, oidSysName, oidSysLocation}
+
+	// oidEnterprises prefixes the sysObjectID of vendor-registered devices
+	oidEnterprises = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1}
+)
+
+// snmpTimeTicks is the application tag of TimeTicks values
+const snmpTimeTicks = 3
+
+// snmpMessage is an SNMPv1 or v2c message
+type snmpMessage struct {
+	Version   int
+	Community []byte
+	PDU       asn1.RawValue
+}
+
+// snmpPDU is a GetRequest or Response PDU
+type snmpPDU struct {
+	RequestID   int32
+	ErrorStatus int
+	ErrorIndex  int
+	VarBinds    []snmpVarBind
+}
+
+// snmpVarBind is an object name and its value
+type snmpVarBind struct {
+	Name  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+// snmpRequest is an outstanding request
+type snmpRequest struct {
+	ip      string
+	version int
+}
+
+// snmpQuerier sends system group requests to SNMP agents
+type snmpQuerier struct {
+	conn        *net.UDPConn
+	port        int           // Agent port
+	wait        time.Duration // Time to collect answers after each round
+	communities []string
+	nextID      int32
+	pending     map[int32]snmpRequest
+	results     map[string]*output.SNMPInfo // By agent IP
+}
+
+// SetSNMP enables a query of the SNMP system group of each discovered
+// IPv4 host on the subnet or within the targets, trying each community
+// with SNMPv2c and then SNMPv1
+func (a *ActiveDiscovery) SetSNMP(communities []string) {
+	a.snmp = communities
+}
+
+// snmpProbes returns the most packets the SNMP query can send
+func (a *ActiveDiscovery) snmpProbes() uint64 {
+	// One request per community and version
+	return 2 * uint64(len(a.snmp)) * maxSNMPHosts
+}
+
+// querySNMP asks the discovered hosts in scope for their SNMP system
+// group and records the answers
+func (a *ActiveDiscovery) querySNMP(ctx context.Context) error {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: a.localIP})
+	if err != nil {
+		return fmt.Errorf("failed to open SNMP socket: %w", err)
+	}
+	defer conn.Close()
+
+	q := &snmpQuerier{
+		conn:        conn,
+		port:        snmpPort,
+		wait:        snmpWait,
+		communities: a.snmp,
+		pending:     make(map[int32]snmpRequest),
+		results:     make(map[string]*output.SNMPInfo),
+	}
+	if err := q.query(ctx, a.scopedHosts(maxSNMPHosts), newPacer(a.rate)); err != nil {
+		return err
+	}
+	a.recordSNMP(q.results)
+	return nil
+}
+
+// query sends requests with SNMPv2c, then SNMPv1 to the agents that did
+// not answer, as v1-only agents drop v2c requests
+func (q *snmpQuerier) query(ctx context.Context, hosts []net.IP, pace *pacer) error {
+	for _, version := range []int{snmpV2c, snmpV1} {
+		sent := false
+		for _, ip := range hosts {
+			if q.results[ip.String()] != nil {
+				continue
+			}
+			for _, community := range q.communities {
+				data, err := q.request(ip, version, community)
+				if err != nil {
+					return err
+				}
+				if !pace.send(ctx, func() error {
+					_, err := q.conn.WriteToUDP(data, &net.UDPAddr{IP: ip, Port: q.port})
+					return err
+				}) {
+					return nil
+				}
+				sent = true
+			}
+		}
+		if !sent {
+			return nil
+		}
+		if err := q.collect(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// request builds a GetRequest for the system group and registers it as
+// outstanding
+func (q *snmpQuerier) request(ip net.IP, version int, community string) ([]byte, error) {
+	q.nextID++
+	pdu := snmpPDU{RequestID: q.nextID}
+	for _, oid := range systemGroup {
+		pdu.VarBinds = append(pdu.VarBinds, snmpVarBind{
+			Name:  oid,
+			Value: asn1.RawValue{Tag: asn1.TagNull},
+		})
+	}
+	pduBytes, err := asn1.MarshalWithParams(pdu, fmt.Sprintf("tag:%d", snmpGetRequest))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build SNMP request: %w", err)
+	}
+	data, err := asn1.Marshal(snmpMessage{
+		Version:   version,
+		Community: []byte(community),
+		PDU:       asn1.RawValue{FullBytes: pduBytes},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to build SNMP request: %w", err)
+	}
+
+	q.pending[q.nextID] = snmpRequest{ip: ip.String(), version: version}
+	return data, nil
+}
+
+// collect reads responses for the querier's wait
+func (q *snmpQuerier) collect(ctx context.Context) error {
+	deadline := time.Now().Add(q.wait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := q.conn.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+
+	data := make([]byte, 65535)
+	for {
+		n, from, err := q.conn.ReadFromUDP(data)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil
+			}
+			return fmt.Errorf("failed to read SNMP response: %w", err)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		id, info, ok := parseSNMPResponse(data[:n])
+		if !ok {
+			continue
+		}
+		// Only the agent asked may answer a request
+		req, known := q.pending[id]
+		if !known || req.ip != from.IP.String() || q.results[req.ip] != nil {
+			continue
+		}
+		if req.version == snmpV1 {
+			info.Version = "v1"
+		} else {
+			info.Version = "v2c"
+		}
+		q.results[req.ip] = info
+	}
+}
+
+// parseSNMPResponse decodes the system group values of a Response PDU
+func parseSNMPResponse(data []byte) (int32, *output.SNMPInfo, bool) {
+	var msg snmpMessage
+	if rest, err := asn1.Unmarshal(data, &msg); err != nil || len(rest) > 0 {
+		return 0, nil, false
+	}
+	if msg.PDU.Class != asn1.ClassContextSpecific || msg.PDU.Tag != snmpResponse {
+		return 0, nil, false
+	}
+	var pdu snmpPDU
+	if _, err := asn1.UnmarshalWithParams(msg.PDU.FullBytes, &pdu, fmt.Sprintf("tag:%d", snmpResponse)); err != nil {
+		return 0, nil, false
+	}
+	if pdu.ErrorStatus != 0 {
+		return 0, nil, false
+	}
+
+	info := &output.SNMPInfo{}
+	for _, vb := range pdu.VarBinds {
+		// noSuchObject and the other v2c exceptions are context-specific
+		v := vb.Value
+		switch {
+		case v.Class == asn1.ClassUniversal && v.Tag == asn1.TagOctetString:
+			s := strings.TrimSpace(strings.ToValidUTF8(string(v.Bytes), ""))
+			switch {
+			case vb.Name.Equal(oidSysDescr):
+				info.SysDescr = s
+			case vb.Name.Equal(oidSysName):
+				info.SysName = s
+			case vb.Name.Equal(oidSysLocation):
+				info.SysLocation = s
+			}
+		case v.Class == asn1.ClassUniversal && v.Tag == asn1.TagOID && vb.Name.Equal(oidSysObjectID):
+			var oid asn1.ObjectIdentifier
+			if _, err := asn1.Unmarshal(v.FullBytes, &oid); err == nil {
+				info.SysObjectID = oid.String()
+				info.Vendor = enterpriseVendor(oid)
+			}
+		case v.Class == asn1.ClassApplication && v.Tag == snmpTimeTicks && vb.Name.Equal(oidSysUpTime):
+			// Unsigned hundredths of a second
+			var ticks uint64
+			for _, b := range v.Bytes {
+				ticks = ticks<<8 | uint64(b)
+			}
+			info.SysUpTime = int64(ticks / 100)
+		}
+	}
+	return pdu.RequestID, info, true
+}
+
+// snmpEnterprises maps IANA private enterprise numbers, as found in
+// sysObjectID, to vendors
+var snmpEnterprises = map[int]string{
+	2:     "IBM",
+	9:     "Cisco",
+	11:    "HP",
+	43:    "3Com",
+	171:   "D-Link",
+	207:   "Allied Telesis",
+	253:   "Xerox",
+	311:   "Microsoft",
+	318:   "APC",
+	367:   "Ricoh",
+	534:   "Eaton",
+	641:   "Lexmark",
+	674:   "Dell",
+	1248:  "Epson",
+	1347:  "Kyocera",
+	1602:  "Canon",
+	1916:  "Extreme Networks",
+	1991:  "Brocade",
+	2011:  "Huawei",
+	2435:  "Brother",
+	2636:  "Juniper",
+	3375:  "F5",
+	4526:  "Netgear",
+	6574:  "Synology",
+	6876:  "VMware",
+	8072:  "Net-SNMP",
+	11863: "TP-Link",
+	12356: "Fortinet",
+	14988: "MikroTik",
+	24681: "QNAP",
+	25461: "Palo Alto Networks",
+	30065: "Arista",
+	41112: "Ubiquiti",
+}
+
+// enterpriseVendor returns the vendor that registered a sysObjectID
+func enterpriseVendor(oid asn1.ObjectIdentifier) string {
+	if len(oid) <= len(oidEnterprises) || !oid[:len(oidEnterprises)].Equal(oidEnterprises) {
+		return ""
+	}
+	return snmpEnterprises[oid[len(oidEnterprises)]]
+}
+
+// recordSNMP attaches the system groups to the devices that answered
+// and reports the signals they carry
+func (a *ActiveDiscovery) recordSNMP(results map[string]*output.SNMPInfo) {
+	for ip, info := range results {
+		key := a.registry.IPKey(ip)
+		a.registry.Upsert(key, func(device *Device) {
+			device.AddIP(ip)
+			device.SNMP = info
+			if device.Hostname == "" && info.SysName != "" {
+				device.Hostname = info.SysName
+			}
+			// Net-SNMP is software, not the device's maker
+			if (device.Vendor == "" || device.Vendor == "Unknown") && info.Vendor != "" && info.Vendor != "Net-SNMP" {
+				device.Vendor = info.Vendor
+			}
+		})
+
+		if a.onSignal != nil {
+			for _, signal := range snmpSignals(info) {
+				a.onSignal(key, signal)
+			}
+		}
+	}
+}
+
+// snmpSignals derives OS signals from sysDescr, whose wording is fixed by
+// each agent: Windows reports "Hardware: ... Software: Windows ...",
+// Net-SNMP on Linux starts with the uname line
+func snmpSignals(info *output.SNMPInfo) []output.Signal {
+	descr := info.SysDescr
+	var osName string
+	switch {
+	case strings.Contains(descr, "Software: Windows"):
+		osName = "Windows"
+	case strings.HasPrefix(descr, "Linux "):
+		osName = "Linux"
+	case strings.HasPrefix(descr, "Darwin "):
+		osName = "macOS"
+	case strings.HasPrefix(descr, "FreeBSD "):
+		osName = "FreeBSD"
+	case strings.Contains(descr, "Cisco IOS"):
+		osName = "Cisco IOS"
+	case strings.HasPrefix(descr, "Juniper Networks") || strings.Contains(descr, "JUNOS"):
+		osName = "Junos"
+	case strings.HasPrefix(descr, "RouterOS"):
+		osName = "RouterOS"
+	}
+	if osName == "" {
+		return nil
+	}
+
+	detail, _, _ := strings.Cut(descr, "\n")
+	if len(detail) > 64 {
+		detail = detail[:64]
+	}
+	return []output.Signal{{
+		Type:   "SNMP",
+		Detail: "sysDescr:" + detail,
+		Weight: 0.9,
+		OS:     osName,
+	}}
+}
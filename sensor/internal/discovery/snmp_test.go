@@ -0,0 +1,274 @@
+package discovery
+
+import (
+	"context"
+	"encoding/asn1"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asset_discovery/sensor/internal/output"
+)
+
+// snmpRequestSeen is a request as received by a test agent
+type snmpRequestSeen struct {
+	version int
+	id      int32
+	from    *net.UDPAddr
+}
+
+// snmpAgent starts an agent on the loopback address that passes each
+// request to answer and sends back the response it returns, if any
+func snmpAgent(t *testing.T, answer func(req snmpRequestSeen) []byte) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		data := make([]byte, 65535)
+		for {
+			n, from, err := conn.ReadFromUDP(data)
+			if err != nil {
+				return
+			}
+			var msg snmpMessage
+			if _, err := asn1.Unmarshal(data[:n], &msg); err != nil {
+				continue
+			}
+			var pdu snmpPDU
+			if _, err := asn1.UnmarshalWithParams(msg.PDU.FullBytes, &pdu, fmt.Sprintf("tag:%d", snmpGetRequest)); err != nil {
+				continue
+			}
+			if resp := answer(snmpRequestSeen{version: msg.Version, id: pdu.RequestID, from: from}); resp != nil {
+				conn.WriteToUDP(resp, from)
+			}
+		}
+	}()
+	return conn
+}
+
+// snmpResponseBytes builds a Response PDU carrying binds
+func snmpResponseBytes(t *testing.T, version int, id int32, binds []snmpVarBind) []byte {
+	t.Helper()
+	pdu, err := asn1.MarshalWithParams(snmpPDU{RequestID: id, VarBinds: binds}, fmt.Sprintf("tag:%d", snmpResponse))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := asn1.Marshal(snmpMessage{
+		Version:   version,
+		Community: []byte("public"),
+		PDU:       asn1.RawValue{FullBytes: pdu},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// octetString returns an OCTET STRING value
+func octetString(s string) asn1.RawValue {
+	return asn1.RawValue{Tag: asn1.TagOctetString, Bytes: []byte(s)}
+}
+
+// systemGroupBinds returns the answer of a Net-SNMP agent on Linux
+func systemGroupBinds(t *testing.T) []snmpVarBind {
+	t.Helper()
+	objectID, err := asn1.Marshal(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 8072, 3, 2, 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []snmpVarBind{
+		{Name: oidSysDescr, Value: octetString("Linux nas 5.10.0 #1 SMP x86_64")},
+		{Name: oidSysObjectID, Value: asn1.RawValue{FullBytes: objectID}},
+		// 4000000000 hundredths, which has the high bit set
+		{Name: oidSysUpTime, Value: asn1.RawValue{Class: asn1.ClassApplication, Tag: snmpTimeTicks, Bytes: []byte{0x00, 0xee, 0x6b, 0x28, 0x00}}},
+		{Name: oidSysName, Value: octetString("nas")},
+		{Name: oidSysLocation, Value: octetString("Rack 2")},
+	}
+}
+
+// runQuerier queries the agent at 127.0.0.1 and returns the results
+func runQuerier(t *testing.T, agent *net.UDPConn) map[string]*output.SNMPInfo {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	q := &snmpQuerier{
+		conn:        conn,
+		port:        agent.LocalAddr().(*net.UDPAddr).Port,
+		wait:        200 * time.Millisecond,
+		communities: []string{"public"},
+		pending:     make(map[int32]snmpRequest),
+		results:     make(map[string]*output.SNMPInfo),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := q.query(ctx, []net.IP{net.IPv4(127, 0, 0, 1)}, newPacer(1000)); err != nil {
+		t.Fatal(err)
+	}
+	return q.results
+}
+
+func TestSNMPQuery(t *testing.T) {
+	agent := snmpAgent(t, func(req snmpRequestSeen) []byte {
+		return snmpResponseBytes(t, req.version, req.id, systemGroupBinds(t))
+	})
+
+	info := runQuerier(t, agent)["127.0.0.1"]
+	if info == nil {
+		t.Fatal("no answer recorded")
+	}
+	if info.Version != "v2c" {
+		t.Errorf("version %q, want v2c", info.Version)
+	}
+	if info.SysDescr != "Linux nas 5.10.0 #1 SMP x86_64" || info.SysName != "nas" || info.SysLocation != "Rack 2" {
+		t.Errorf("system group decoded as %+v", info)
+	}
+	if info.SysObjectID != "1.3.6.1.4.1.8072.3.2.10" || info.Vendor != "Net-SNMP" {
+		t.Errorf("sysObjectID %q, vendor %q", info.SysObjectID, info.Vendor)
+	}
+	if info.SysUpTime != 40000000 {
+		t.Errorf("sysUpTime %d, want 40000000", info.SysUpTime)
+	}
+}
+
+func TestSNMPv1Fallback(t *testing.T) {
+	versions := make(chan int, 16)
+	agent := snmpAgent(t, func(req snmpRequestSeen) []byte {
+		versions <- req.version
+		// v1-only agents drop v2c requests
+		if req.version != snmpV1 {
+			return nil
+		}
+		return snmpResponseBytes(t, req.version, req.id, systemGroupBinds(t))
+	})
+
+	info := runQuerier(t, agent)["127.0.0.1"]
+	if info == nil {
+		t.Fatal("no answer recorded")
+	}
+	if info.Version != "v1" || info.SysName != "nas" {
+		t.Errorf("answer recorded as %+v", info)
+	}
+	if first := <-versions; first != snmpV2c {
+		t.Errorf("first request used version %d, want v2c first", first)
+	}
+}
+
+func TestSNMPRejectsUnexpectedResponses(t *testing.T) {
+	spoofer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+	if err != nil {
+		t.Skipf("no second loopback address: %v", err)
+	}
+	defer spoofer.Close()
+
+	tests := []struct {
+		name   string
+		answer func(req snmpRequestSeen) []byte
+	}{
+		{"spoofed source", func(req snmpRequestSeen) []byte {
+			spoofer.WriteToUDP(snmpResponseBytes(t, req.version, req.id, systemGroupBinds(t)), req.from)
+			return nil
+		}},
+		{"unknown request ID", func(req snmpRequestSeen) []byte {
+			return snmpResponseBytes(t, req.version, req.id+1000, systemGroupBinds(t))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := snmpAgent(t, tt.answer)
+			if results := runQuerier(t, agent); len(results) != 0 {
+				t.Errorf("response accepted: %+v", results["127.0.0.1"])
+			}
+		})
+	}
+}
+
+func TestSNMPNoSuchObject(t *testing.T) {
+	agent := snmpAgent(t, func(req snmpRequestSeen) []byte {
+		binds := systemGroupBinds(t)
+		for i := range binds {
+			if binds[i].Name.Equal(oidSysLocation) || binds[i].Name.Equal(oidSysUpTime) {
+				// noSuchObject exception (RFC 3416)
+				binds[i].Value = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0}
+			}
+		}
+		return snmpResponseBytes(t, req.version, req.id, binds)
+	})
+
+	info := runQuerier(t, agent)["127.0.0.1"]
+	if info == nil {
+		t.Fatal("no answer recorded")
+	}
+	if info.SysLocation != "" || info.SysUpTime != 0 {
+		t.Errorf("missing objects decoded as location %q, uptime %d", info.SysLocation, info.SysUpTime)
+	}
+	if info.SysName != "nas" || info.SysDescr == "" {
+		t.Errorf("present objects decoded as %+v", info)
+	}
+}
+
+func TestEnterpriseVendor(t *testing.T) {
+	tests := []struct {
+		oid  asn1.ObjectIdentifier
+		want string
+	}{
+		{asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 9, 1, 1208}, "Cisco"},
+		{asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41112, 1, 6}, "Ubiquiti"},
+		{asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}, ""},
+		{asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1}, ""},
+		{asn1.ObjectIdentifier{1, 3, 6, 1, 2, 1, 1}, ""},
+	}
+	for _, tt := range tests {
+		if got := enterpriseVendor(tt.oid); got != tt.want {
+			t.Errorf("enterpriseVendor(%s) = %q, want %q", tt.oid, got, tt.want)
+		}
+	}
+}
+
+func TestScopedHosts(t *testing.T) {
+	registry := NewDeviceRegistry()
+	for mac, ip := range map[string]string{
+		"02:00:00:00:00:01": "192.168.1.1",  // The sensor
+		"02:00:00:00:00:02": "192.168.1.20", // On the interface's subnet
+		"02:00:00:00:00:03": "192.168.2.30", // On another swept subnet
+		"02:00:00:00:00:04": "10.9.0.5",     // Within the targets
+		"02:00:00:00:00:05": "172.16.4.4",   // Seen in passing
+	} {
+		registry.Upsert(mac, func(device *Device) { device.AddIP(ip) })
+	}
+
+	_, subnet, _ := net.ParseCIDR("192.168.1.0/24")
+	_, other, _ := net.ParseCIDR("192.168.2.0/24")
+	a := NewActiveDiscovery(registry, nil, "eth1", net.IPv4(192, 168, 1, 1), nil, subnet)
+	if err := a.SetTargets([]string{"10.9.0.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+
+	hostList := func(limit int) string {
+		var got []string
+		for _, ip := range a.scopedHosts(limit) {
+			got = append(got, ip.String())
+		}
+		return strings.Join(got, " ")
+	}
+	if got, want := hostList(maxSNMPHosts), "10.9.0.5 192.168.1.20"; got != want {
+		t.Errorf("hosts on one subnet: %q, want %q", got, want)
+	}
+
+	a.SetScope([]*net.IPNet{other, subnet})
+	if got, want := hostList(maxSNMPHosts), "10.9.0.5 192.168.1.20 192.168.2.30"; got != want {
+		t.Errorf("hosts on both subnets: %q, want %q", got, want)
+	}
+	if got, want := hostList(2), "10.9.0.5 192.168.1.20"; got != want {
+		t.Errorf("hosts capped at 2: %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,338 @@
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asset_discovery/sensor/internal/output"
+	"golang.org/x/net/ipv4"
+)
+
+// ssdpGroup is the IPv4 SSDP multicast group
+var ssdpGroup = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+
+const (
+	ssdpMX   = 2                          // Seconds responders may delay their answer
+	ssdpWait = (ssdpMX + 1) * time.Second // Time to collect answers
+
+	descriptionTimeout  = 3 * time.Second
+	maxDescriptionSize  = 1 << 20 // Bytes read from a description document
+	maxLocations        = 4       // Description URLs tried per responder
+	descriptionFetchers = 8       // Descriptions fetched concurrently
+)
+
+// ssdpResponder is a device that answered an M-SEARCH
+type ssdpResponder struct {
+	server    string   // SERVER header, e.g. "Linux/4.9 UPnP/1.0 MiniUPnPd/2.1"
+	locations []string // Device description URLs
+}
+
+// ssdpSearcher sends M-SEARCH requests and fetches the device
+// descriptions of the responders
+type ssdpSearcher struct {
+	conn   *net.UDPConn
+	dest   *net.UDPAddr
+	client *http.Client
+}
+
+// upnpDescription is the part of a UPnP device description document
+// (UPnP Device Architecture 2.3) that identifies the root device
+type upnpDescription struct {
+	Device struct {
+		DeviceType   string `xml:"deviceType"`
+		FriendlyName string `xml:"friendlyName"`
+		Manufacturer string `xml:"manufacturer"`
+		ModelName    string `xml:"modelName"`
+		ModelNumber  string `xml:"modelNumber"`
+		SerialNumber string `xml:"serialNumber"`
+	} `xml:"device"`
+}
+
+// SetSSDP enables the SSDP/UPnP probe after the ARP sweep
+func (a *ActiveDiscovery) SetSSDP(enabled bool) {
+	a.ssdp = enabled
+}
+
+// SetSignalHandler sets the function active probes report OS
+// fingerprinting signals to, keyed by device registry key
+func (a *ActiveDiscovery) SetSignalHandler(fn func(key string, signal output.Signal)) {
+	a.onSignal = fn
+}
+
+// ssdpSearch finds UPnP devices and records the identity their device
+// descriptions give
+func (a *ActiveDiscovery) ssdpSearch(ctx context.Context) error {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: a.localIP})
+	if err != nil {
+		return fmt.Errorf("failed to open SSDP socket: %w", err)
+	}
+	defer conn.Close()
+
+	// Send the multicast search out of the probed interface
+	if ifi, err := net.InterfaceByName(a.ifaceName); err == nil {
+		if err := ipv4.NewPacketConn(conn).SetMulticastInterface(ifi); err != nil {
+			return fmt.Errorf("failed to select SSDP interface: %w", err)
+		}
+	}
+
+	s := &ssdpSearcher{
+		conn:   conn,
+		dest:   ssdpGroup,
+		client: newDescriptionClient(descriptionTimeout),
+	}
+	responders, err := s.search(ctx)
+	if err != nil {
+		return err
+	}
+	a.recordUPnP(s.describeAll(ctx, responders))
+	return nil
+}
+
+// newDescriptionClient returns the HTTP client that fetches device
+// descriptions. Redirects are not followed, as they could lead off the
+// responder.
+func newDescriptionClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// search multicasts an M-SEARCH for all devices and services and
+// collects the unicast responses, keyed by responder IP
+func (s *ssdpSearcher) search(ctx context.Context) (map[string]*ssdpResponder, error) {
+	request := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + s.dest.String() + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		fmt.Sprintf("MX: %d\r\n", ssdpMX) +
+		"ST: ssdp:all\r\n\r\n"
+	// UDP is lossy, so the search is sent twice as UPnP recommends
+	for i := 0; i < 2; i++ {
+		if _, err := s.conn.WriteToUDP([]byte(request), s.dest); err != nil {
+			return nil, fmt.Errorf("failed to send M-SEARCH: %w", err)
+		}
+	}
+
+	deadline := time.Now().Add(ssdpWait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := s.conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	responders := make(map[string]*ssdpResponder)
+	data := make([]byte, 4096)
+	for {
+		n, from, err := s.conn.ReadFromUDP(data)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return responders, nil
+			}
+			return nil, fmt.Errorf("failed to read SSDP response: %w", err)
+		}
+		if ctx.Err() != nil {
+			return responders, nil
+		}
+
+		location, server, ok := parseSSDPResponse(data[:n])
+		if !ok {
+			continue
+		}
+		ip := from.IP.String()
+		r := responders[ip]
+		if r == nil {
+			r = &ssdpResponder{server: server}
+			responders[ip] = r
+		}
+		if location != "" && len(r.locations) < maxLocations && !containsString(r.locations, location) {
+			r.locations = append(r.locations, location)
+		}
+	}
+}
+
+// parseSSDPResponse returns the LOCATION and SERVER headers of an
+// M-SEARCH response
+func parseSSDPResponse(data []byte) (location, server string, ok bool) {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), nil)
+	if err != nil {
+		return "", "", false
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", false
+	}
+	return resp.Header.Get("Location"), resp.Header.Get("Server"), true
+}
+
+// describeAll fetches a description for every responder, trying each
+// of its locations until one succeeds
+func (s *ssdpSearcher) describeAll(ctx context.Context, responders map[string]*ssdpResponder) map[string]*output.UPnPInfo {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]*output.UPnPInfo, len(responders))
+		slots   = make(chan struct{}, descriptionFetchers)
+	)
+	for ip, r := range responders {
+		wg.Add(1)
+		go func(ip string, r *ssdpResponder) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			info := &output.UPnPInfo{Server: r.server}
+			for _, location := range r.locations {
+				desc, err := s.describe(ctx, ip, location)
+				if err != nil {
+					continue
+				}
+				info.Location = location
+				info.DeviceType = desc.Device.DeviceType
+				info.FriendlyName = desc.Device.FriendlyName
+				info.Manufacturer = desc.Device.Manufacturer
+				info.ModelName = desc.Device.ModelName
+				info.ModelNumber = desc.Device.ModelNumber
+				info.SerialNumber = desc.Device.SerialNumber
+				break
+			}
+
+			mu.Lock()
+			results[ip] = info
+			mu.Unlock()
+		}(ip, r)
+	}
+	wg.Wait()
+	return results
+}
+
+// describe fetches and parses a device description. Only URLs on the
+// responder itself are followed, so a spoofed LOCATION cannot point the
+// sensor at another host.
+func (s *ssdpSearcher) describe(ctx context.Context, responder, location string) (*upnpDescription, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" || u.Hostname() != responder {
+		return nil, fmt.Errorf("description URL %s is not on %s", location, responder)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("description request returned %s", resp.Status)
+	}
+
+	var desc upnpDescription
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, maxDescriptionSize)).Decode(&desc); err != nil {
+		return nil, fmt.Errorf("failed to parse device description: %w", err)
+	}
+	return &desc, nil
+}
+
+// recordUPnP attaches UPnP identities to the responding devices and
+// reports the signals they carry
+func (a *ActiveDiscovery) recordUPnP(results map[string]*output.UPnPInfo) {
+	for ip, info := range results {
+		key := a.registry.IPKey(ip)
+		a.registry.Upsert(key, func(device *Device) {
+			device.AddIP(ip)
+			device.AddSegment(a.ifaceName, a.subnet.String(), "")
+			device.UPnP = info
+			device.DiscoverySource = "active-ssdp"
+			if (device.Vendor == "" || device.Vendor == "Unknown") && info.Manufacturer != "" {
+				device.Vendor = info.Manufacturer
+			}
+		})
+
+		if a.onSignal != nil {
+			for _, signal := range upnpSignals(info) {
+				a.onSignal(key, signal)
+			}
+		}
+	}
+}
+
+// upnpManufacturerOS maps manufacturers whose UPnP devices all run the
+// same OS, lowercased
+var upnpManufacturerOS = map[string]string{
+	"microsoft corporation": "Windows",
+	"synology":              "Linux",
+	"synology inc.":         "Linux",
+	"qnap systems, inc.":    "Linux",
+	"roku":                  "Roku OS",
+}
+
+// upnpSignals derives OS signals from the SERVER header, whose first
+// product token names the OS ("Linux/5.4 UPnP/1.0 ..."), and from the
+// description's manufacturer
+func upnpSignals(info *output.UPnPInfo) []output.Signal {
+	var signals []output.Signal
+
+	product, _, _ := strings.Cut(strings.TrimSpace(info.Server), " ")
+	product = strings.TrimSuffix(product, ",")
+	name, _, _ := strings.Cut(product, "/")
+	var osName string
+	switch lower := strings.ToLower(name); {
+	case strings.HasPrefix(lower, "linux"):
+		osName = "Linux"
+	case strings.Contains(lower, "windows"):
+		osName = "Windows"
+	case lower == "darwin" || strings.HasPrefix(lower, "mac"):
+		osName = "macOS"
+	case lower == "android":
+		osName = "Android"
+	case lower == "freebsd":
+		osName = "FreeBSD"
+	}
+	if osName != "" {
+		signals = append(signals, output.Signal{
+			Type:   "UPnP",
+			Detail: "server:" + product,
+			Weight: 0.9,
+			OS:     osName,
+		})
+	}
+
+	if osName, ok := upnpManufacturerOS[strings.ToLower(info.Manufacturer)]; ok {
+		signals = append(signals, output.Signal{
+			Type:   "UPnP",
+			Detail: "model:" + strings.TrimSpace(info.Manufacturer+" "+info.ModelName),
+			Weight: 0.95,
+			OS:     osName,
+		})
+	}
+	return signals
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
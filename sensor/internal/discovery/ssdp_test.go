@@ -0,0 +1,136 @@
+package discovery
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// namespacedDescription is a device description as UPnP devices serve
+// it, in the device namespace
+const namespacedDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:MediaRenderer:1</deviceType>
+    <friendlyName>Living Room TV</friendlyName>
+    <manufacturer>Roku</manufacturer>
+    <modelName>Roku Ultra</modelName>
+    <modelNumber>4800X</modelNumber>
+    <serialNumber>YH00AB123456</serialNumber>
+  </device>
+</root>`
+
+// describeServer serves handler and returns a searcher whose client
+// times out after timeout, the responder IP and the base URL of the server
+func describeServer(t *testing.T, handler http.HandlerFunc, timeout time.Duration) (*ssdpSearcher, string, string) {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return &ssdpSearcher{client: newDescriptionClient(timeout)}, "127.0.0.1", srv.URL
+}
+
+func TestDescribeNamespacedRoot(t *testing.T) {
+	s, responder, base := describeServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(namespacedDescription))
+	}, time.Second)
+
+	location := base + "/description.xml"
+	results := s.describeAll(context.Background(), map[string]*ssdpResponder{
+		responder: {server: "Roku/9.4 UPnP/1.0", locations: []string{location}},
+	})
+	info := results[responder]
+	if info == nil {
+		t.Fatal("no result for the responder")
+	}
+	if info.Location != location || info.Server != "Roku/9.4 UPnP/1.0" {
+		t.Errorf("location %q, server %q", info.Location, info.Server)
+	}
+	if info.DeviceType != "urn:schemas-upnp-org:device:MediaRenderer:1" || info.FriendlyName != "Living Room TV" ||
+		info.Manufacturer != "Roku" || info.ModelName != "Roku Ultra" ||
+		info.ModelNumber != "4800X" || info.SerialNumber != "YH00AB123456" {
+		t.Errorf("description decoded as %+v", info)
+	}
+}
+
+func TestDescribeMissingField(t *testing.T) {
+	s, responder, base := describeServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<root xmlns="urn:schemas-upnp-org:device-1-0"><device>` +
+			`<friendlyName>NAS</friendlyName><manufacturer>Synology</manufacturer>` +
+			`</device></root>`))
+	}, time.Second)
+
+	desc, err := s.describe(context.Background(), responder, base+"/desc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Device.FriendlyName != "NAS" || desc.Device.Manufacturer != "Synology" {
+		t.Errorf("description decoded as %+v", desc.Device)
+	}
+	if desc.Device.ModelName != "" || desc.Device.SerialNumber != "" {
+		t.Errorf("missing fields should be empty, got %+v", desc.Device)
+	}
+}
+
+func TestDescribeOversizeBody(t *testing.T) {
+	s, responder, base := describeServer(t, func(w http.ResponseWriter, r *http.Request) {
+		// The device element only closes after the size limit
+		w.Write([]byte(`<root><device><friendlyName>`))
+		w.Write([]byte(strings.Repeat("A", maxDescriptionSize)))
+		w.Write([]byte(`</friendlyName></device></root>`))
+	}, time.Second)
+
+	if _, err := s.describe(context.Background(), responder, base+"/desc.xml"); err == nil {
+		t.Error("description larger than the limit was parsed")
+	}
+}
+
+func TestDescribeRedirect(t *testing.T) {
+	followed := make(chan struct{}, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/desc.xml", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/moved.xml", http.StatusFound)
+	})
+	mux.HandleFunc("/moved.xml", func(w http.ResponseWriter, r *http.Request) {
+		followed <- struct{}{}
+		w.Write([]byte(namespacedDescription))
+	})
+	s, responder, base := describeServer(t, mux.ServeHTTP, time.Second)
+
+	if _, err := s.describe(context.Background(), responder, base+"/desc.xml"); err == nil {
+		t.Error("redirected description was accepted")
+	}
+	select {
+	case <-followed:
+		t.Error("redirect was followed")
+	default:
+	}
+}
+
+func TestDescribeOtherHost(t *testing.T) {
+	s, _, base := describeServer(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("description fetched for another responder")
+	}, time.Second)
+
+	if _, err := s.describe(context.Background(), "192.0.2.7", base+"/desc.xml"); err == nil {
+		t.Error("description URL off the responder was accepted")
+	}
+}
+
+func TestDescribeTimeout(t *testing.T) {
+	s, responder, base := describeServer(t, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}, 100*time.Millisecond)
+
+	start := time.Now()
+	if _, err := s.describe(context.Background(), responder, base+"/desc.xml"); err == nil {
+		t.Error("stalled description request succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("request took %v despite the timeout", elapsed)
+	}
+}
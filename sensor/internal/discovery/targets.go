@@ -0,0 +1,219 @@
+package discovery
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultRate is the default packets-per-second budget of active probes
+const DefaultRate = 100
+
+// MaxSubnetSweep bounds the addresses of a subnet swept without targets:
+// a /16, which takes 11 minutes at the default rate. Larger subnets are
+// swept only within explicit targets.
+const MaxSubnetSweep = 1 << 16
+
+// ipRange is an inclusive range of IPv4 addresses
+type ipRange struct {
+	first, last uint32
+}
+
+// size returns the number of addresses in the range
+func (r ipRange) size() uint64 {
+	return uint64(r.last) - uint64(r.first) + 1
+}
+
+// parseTargets parses active probe targets: IPv4 addresses, CIDR
+// prefixes ("10.1.0.0/22") and dash ranges ("10.1.0.10-10.1.0.50").
+// The network and broadcast addresses of prefixes up to /30 are skipped.
+func parseTargets(specs []string) ([]ipRange, error) {
+	var ranges []ipRange
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		r, err := parseTarget(spec)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return mergeRanges(ranges), nil
+}
+
+// parseTarget parses a single target
+func parseTarget(spec string) (ipRange, error) {
+	if strings.Contains(spec, "/") {
+		_, network, err := net.ParseCIDR(spec)
+		if err != nil || network.IP.To4() == nil {
+			return ipRange{}, fmt.Errorf("invalid target prefix %q", spec)
+		}
+		return hostRange(network), nil
+	}
+
+	if from, to, ok := strings.Cut(spec, "-"); ok {
+		first, okFirst := ipv4ToUint(net.ParseIP(strings.TrimSpace(from)))
+		last, okLast := ipv4ToUint(net.ParseIP(strings.TrimSpace(to)))
+		if !okFirst || !okLast || first > last {
+			return ipRange{}, fmt.Errorf("invalid target range %q", spec)
+		}
+		return ipRange{first, last}, nil
+	}
+
+	ip, ok := ipv4ToUint(net.ParseIP(spec))
+	if !ok {
+		return ipRange{}, fmt.Errorf("invalid target address %q", spec)
+	}
+	return ipRange{ip, ip}, nil
+}
+
+// hostRange returns the host addresses of an IPv4 network. /31 and /32
+// networks have no network or broadcast address (RFC 3021).
+func hostRange(network *net.IPNet) ipRange {
+	first, _ := ipv4ToUint(network.IP)
+	ones, _ := network.Mask.Size()
+	last := first | uint32(1<<(32-ones)-1)
+	if ones <= 30 {
+		first, last = first+1, last-1
+	}
+	return ipRange{first, last}
+}
+
+// mergeRanges sorts ranges and joins those that overlap or touch, so
+// no address is probed twice
+func mergeRanges(ranges []ipRange) []ipRange {
+	if len(ranges) < 2 {
+		return ranges
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].first < ranges[j].first
+	})
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if uint64(r.first) <= uint64(last.last)+1 {
+			if r.last > last.last {
+				last.last = r.last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// intersectRanges returns the parts of ranges that lie within bound
+func intersectRanges(ranges []ipRange, bound ipRange) []ipRange {
+	var result []ipRange
+	for _, r := range ranges {
+		first, last := max(r.first, bound.first), min(r.last, bound.last)
+		if first <= last {
+			result = append(result, ipRange{first, last})
+		}
+	}
+	return result
+}
+
+// inRanges reports whether ip is an IPv4 address within ranges
+func inRanges(ranges []ipRange, ip net.IP) bool {
+	n, ok := ipv4ToUint(ip)
+	if !ok {
+		return false
+	}
+	for _, r := range ranges {
+		if n >= r.first && n <= r.last {
+			return true
+		}
+	}
+	return false
+}
+
+// countRanges returns the number of addresses in ranges
+func countRanges(ranges []ipRange) uint64 {
+	var n uint64
+	for _, r := range ranges {
+		n += r.size()
+	}
+	return n
+}
+
+// forEachIP calls fn for every address in ranges until it returns false
+func forEachIP(ranges []ipRange, fn func(net.IP) bool) {
+	for _, r := range ranges {
+		for ip := uint64(r.first); ip <= uint64(r.last); ip++ {
+			if !fn(uintToIPv4(uint32(ip))) {
+				return
+			}
+		}
+	}
+}
+
+// ipv4ToUint converts an IPv4 address to an integer
+func ipv4ToUint(ip net.IP) (uint32, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(ip4), true
+}
+
+// uintToIPv4 converts an integer to an IPv4 address
+func uintToIPv4(n uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// pacer spaces out probes to stay within a packets-per-second budget.
+// A late probe does not let the following ones burst to catch up.
+type pacer struct {
+	interval time.Duration
+	next     time.Time
+}
+
+// newPacer creates a pacer for the given rate
+func newPacer(pps int) *pacer {
+	if pps <= 0 {
+		pps = DefaultRate
+	}
+	return &pacer{interval: time.Second / time.Duration(pps), next: time.Now()}
+}
+
+// wait blocks until the next probe may be sent. It returns false if the
+// context is done first.
+func (p *pacer) wait(ctx context.Context) bool {
+	if d := time.Until(p.next); d > 0 {
+		timer := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	} else if ctx.Err() != nil {
+		return false
+	}
+	if now := time.Now(); p.next.Before(now) {
+		p.next = now
+	}
+	p.next = p.next.Add(p.interval)
+	return true
+}
+
+// send waits for the next probe slot, then sends a probe with write. A
+// probe to an unreachable host fails on its own, so write errors are
+// dropped and the run goes on. It returns false if the context is done
+// first.
+func (p *pacer) send(ctx context.Context, write func() error) bool {
+	if !p.wait(ctx) {
+		return false
+	}
+	_ = write()
+	return true
+}
@@ -0,0 +1,30 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCheckSize(t *testing.T) {
+	tests := []struct {
+		subnet  string
+		targets []string
+		ok      bool
+	}{
+		{"192.168.1.0/24", nil, true},
+		{"172.16.0.0/16", nil, true},
+		{"172.16.0.0/15", nil, false},
+		{"10.0.0.0/8", nil, false},
+		{"10.0.0.0/8", []string{"10.1.0.0/22"}, true},
+	}
+	for _, tt := range tests {
+		_, subnet, _ := net.ParseCIDR(tt.subnet)
+		a := NewActiveDiscovery(NewDeviceRegistry(), nil, "eth0", subnet.IP, nil, subnet)
+		if err := a.SetTargets(tt.targets); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.CheckSize(); (err == nil) != tt.ok {
+			t.Errorf("%s with targets %v: error %v, want ok %v", tt.subnet, tt.targets, err, tt.ok)
+		}
+	}
+}
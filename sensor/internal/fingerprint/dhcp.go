@@ -0,0 +1,227 @@
+package fingerprint
+
+import (
+	"bufio"
+	"embed"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/asset_discovery/sensor/internal/capture"
+	"github.com/asset_discovery/sensor/internal/discovery"
+	"github.com/asset_discovery/sensor/internal/output"
+	"github.com/gopacket/gopacket/layers"
+)
+
+//go:embed data/dhcp.txt
+var dhcpData embed.FS
+
+// dhcpFingerprint is the OS a parameter request list ordering belongs to
+type dhcpFingerprint struct {
+	OS      string
+	Version string
+}
+
+// loadDHCPFingerprints reads the embedded option 55 database, keyed by
+// the comma-separated option codes
+func loadDHCPFingerprints() (map[string]dhcpFingerprint, error) {
+	file, err := dhcpData.Open("data/dhcp.txt")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	prints := make(map[string]dhcpFingerprint)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, "\t")
+		if len(parts) != 3 {
+			continue
+		}
+		fp := dhcpFingerprint{OS: parts[1]}
+		if parts[2] != "-" {
+			fp.Version = parts[2]
+		}
+		prints[parts[0]] = fp
+	}
+	return prints, scanner.Err()
+}
+
+// checkDHCP derives signals from the options of a DHCP client message.
+// It returns the client's MAC address, which relayed messages do not
+// carry as their link-layer source.
+// Option 81 alone is too weak a hint, so it only counts when option 55
+// or 60 points to the same OS.
+func (e *Engine) checkDHCP(packet *capture.PacketMeta) (string, []output.Signal) {
+	if !packet.Has(layers.LayerTypeDHCPv4) {
+		return "", nil
+	}
+	dhcp := &packet.DHCPv4
+	if dhcp.Operation != layers.DHCPOpRequest || len(dhcp.ClientHWAddr) != 6 {
+		return "", nil
+	}
+
+	var (
+		signals []output.Signal
+		fqdn    *output.Signal
+		backed  = make(map[string]bool) // OSes named by option 55 or 60
+	)
+	for _, opt := range dhcp.Options {
+		var signal *output.Signal
+		switch opt.Type {
+		case layers.DHCPOptParamsRequest:
+			signal = e.checkParamsRequest(opt.Data)
+		case layers.DHCPOptClassID:
+			signal = checkVendorClass(string(opt.Data))
+		case layers.DHCPOptClientID:
+			signal = checkClientID(opt.Data)
+		case discovery.DHCPOptClientFQDN:
+			fqdn = checkClientFQDN(opt.Data)
+		}
+		if signal != nil {
+			signals = append(signals, *signal)
+			if opt.Type == layers.DHCPOptParamsRequest || opt.Type == layers.DHCPOptClassID {
+				backed[signal.OS] = true
+			}
+		}
+	}
+	if fqdn != nil && backed[fqdn.OS] {
+		signals = append(signals, *fqdn)
+	}
+	return net.HardwareAddr(dhcp.ClientHWAddr).String(), signals
+}
+
+// checkParamsRequest looks up the option 55 ordering in the database
+func (e *Engine) checkParamsRequest(data []byte) *output.Signal {
+	codes := make([]string, len(data))
+	for i, code := range data {
+		codes[i] = strconv.Itoa(int(code))
+	}
+	key := strings.Join(codes, ",")
+
+	fp, ok := e.dhcpPrints[key]
+	if !ok {
+		return nil
+	}
+	return &output.Signal{
+		Type:    "DHCP",
+		Detail:  "option55:" + key,
+		Weight:  0.9,
+		OS:      fp.OS,
+		Version: fp.Version,
+	}
+}
+
+// checkVendorClass maps well-known option 60 vendor class identifiers
+func checkVendorClass(class string) *output.Signal {
+	signal := &output.Signal{Type: "DHCP", Detail: "option60:" + class}
+	switch {
+	case strings.HasPrefix(class, "MSFT 5.0"):
+		signal.OS, signal.Weight = "Windows", 0.85
+	case strings.HasPrefix(class, "MSFT 98"):
+		signal.OS, signal.Weight, signal.Version = "Windows", 0.85, "98/Me"
+	case strings.HasPrefix(class, "android-dhcp-"):
+		signal.OS, signal.Weight = "Android", 0.95 // Names the exact release
+		signal.Version = strings.TrimPrefix(class, "android-dhcp-")
+	case strings.HasPrefix(class, "dhcpcd"):
+		// dhcpcd-<version>:<OS>-<kernel>:<arch>:<platform>
+		parts := strings.Split(class, ":")
+		if len(parts) < 2 {
+			return nil
+		}
+		osName, _, _ := strings.Cut(parts[1], "-")
+		signal.OS, signal.Weight = osName, 0.7
+	case strings.HasPrefix(class, "udhcp"):
+		signal.OS, signal.Weight = "Linux", 0.6
+	default:
+		return nil
+	}
+	return signal
+}
+
+// checkClientID reads the option 61 client identifier type. An RFC 4361
+// identifier (IAID and DUID) is sent by systemd-networkd and
+// NetworkManager; Windows, Apple and Android use the hardware address.
+func checkClientID(data []byte) *output.Signal {
+	if len(data) < 2 || data[0] != 255 {
+		return nil
+	}
+	return &output.Signal{
+		Type:   "DHCP",
+		Detail: "option61:duid",
+		Weight: 0.4,
+		OS:     "Linux",
+	}
+}
+
+// checkClientFQDN reads option 81. Windows sends it with every request,
+// leaving the S flag clear so the client updates its own A record.
+func checkClientFQDN(data []byte) *output.Signal {
+	if len(data) < 3 || data[0]&0x01 != 0 {
+		return nil
+	}
+	return &output.Signal{
+		Type:   "DHCP",
+		Detail: "option81",
+		Weight: 0.15,
+		OS:     "Windows",
+	}
+}
+
+// IANA enterprise numbers seen in DHCPv6 identifiers
+const (
+	enterpriseMicrosoft = 311
+	enterpriseSystemd   = 43793
+)
+
+// checkDHCPv6 derives signals from a DHCPv6 client's vendor class, DUID
+// and FQDN option, returning the client's registry key
+func (e *Engine) checkDHCPv6(packet *capture.PacketMeta) (string, []output.Signal) {
+	client := discovery.ParseDHCPv6(packet)
+	if client == nil {
+		return "", nil
+	}
+	key := e.registry.DHCPv6Key(client)
+	if key == "" {
+		return "", nil
+	}
+
+	var signals []output.Signal
+	if client.VendorClass != "" {
+		// The same class strings as DHCPv4 option 60
+		if signal := checkVendorClass(client.VendorClass); signal != nil {
+			signal.Type, signal.Detail = "DHCPv6", "option16:"+client.VendorClass
+			signals = append(signals, *signal)
+		} else if client.VendorEnterprise == enterpriseMicrosoft {
+			signals = append(signals, output.Signal{
+				Type:   "DHCPv6",
+				Detail: "option16:311",
+				Weight: 0.8,
+				OS:     "Windows",
+			})
+		}
+	}
+	// systemd-networkd derives a DUID-EN under its own enterprise number
+	if client.DUIDEnterprise == enterpriseSystemd {
+		signals = append(signals, output.Signal{
+			Type:   "DHCPv6",
+			Detail: "duid:systemd",
+			Weight: 0.6,
+			OS:     "Linux",
+		})
+	}
+	// Windows sends the FQDN option with the S flag clear, as in DHCPv4
+	if client.HasFQDN && client.FQDNFlags&0x01 == 0 {
+		signals = append(signals, output.Signal{
+			Type:   "DHCPv6",
+			Detail: "option39",
+			Weight: 0.3,
+			OS:     "Windows",
+		})
+	}
+	return key, signals
+}
@@ -6,81 +6,125 @@ import (
 	"github.com/asset_discovery/sensor/internal/capture"
 	"github.com/asset_discovery/sensor/internal/discovery"
 	"github.com/asset_discovery/sensor/internal/output"
-	"github.com/gopacket/gopacket"
 	"github.com/gopacket/gopacket/layers"
 )
 
 // Engine coordinates OS fingerprinting from various signals
 type Engine struct {
-	registry *discovery.DeviceRegistry
-	signals  map[string][]output.Signal // keyed by MAC
-	mu       sync.RWMutex
+	registry   *discovery.DeviceRegistry
+	signals    map[string][]output.Signal // keyed by device registry key
+	dhcpPrints map[string]dhcpFingerprint // option 55 orderings
+	mu         sync.RWMutex
 }
 
 // NewEngine creates a new fingerprinting engine
 func NewEngine(registry *discovery.DeviceRegistry) *Engine {
+	// Without the database DHCP option 55 simply yields no signals
+	dhcpPrints, err := loadDHCPFingerprints()
+	if err != nil {
+		dhcpPrints = make(map[string]dhcpFingerprint)
+	}
+
 	return &Engine{
-		registry: registry,
-		signals:  make(map[string][]output.Signal),
+		registry:   registry,
+		signals:    make(map[string][]output.Signal),
+		dhcpPrints: dhcpPrints,
 	}
 }
 
 // ProcessPacket analyzes a packet for OS fingerprinting signals
-func (e *Engine) ProcessPacket(packet gopacket.Packet) {
-	srcMAC, _ := capture.ExtractMACs(packet)
-	if srcMAC == "" {
+func (e *Engine) ProcessPacket(packet *capture.PacketMeta) {
+	// DHCP options describe the client, which may be behind a relay
+	if mac, signals := e.checkDHCP(packet); mac != "" {
+		for _, signal := range signals {
+			e.AddSignal(mac, signal)
+		}
+	}
+	if key, signals := e.checkDHCPv6(packet); key != "" {
+		for _, signal := range signals {
+			e.AddSignal(key, signal)
+		}
+	}
+
+	key := e.registry.PacketKey(packet)
+	if key == "" {
 		return
 	}
 
 	// Check for mDNS (Apple/Linux indicator)
 	if signal := e.checkMDNS(packet); signal != nil {
-		e.addSignal(srcMAC, *signal)
+		e.AddSignal(key, *signal)
 	}
 
 	// Check for LLMNR (Windows indicator)
 	if signal := e.checkLLMNR(packet); signal != nil {
-		e.addSignal(srcMAC, *signal)
+		e.AddSignal(key, *signal)
 	}
 
 	// Check for NBNS (Windows indicator)
 	if signal := e.checkNBNS(packet); signal != nil {
-		e.addSignal(srcMAC, *signal)
+		e.AddSignal(key, *signal)
 	}
 
 	// Check TTL for hints
 	if signal := e.checkTTL(packet); signal != nil {
-		e.addSignal(srcMAC, *signal)
+		e.AddSignal(key, *signal)
 	}
 }
 
-// addSignal adds a fingerprinting signal for a device
-func (e *Engine) addSignal(mac string, signal output.Signal) {
+// AddSignal adds a fingerprinting signal for a device. Active probes
+// report their signals through it.
+func (e *Engine) AddSignal(mac string, signal output.Signal) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
 	// Avoid duplicate signals
-	for _, existing := range e.signals[mac] {
-		if existing.Type == signal.Type && existing.Detail == signal.Detail {
-			return
+	if !hasSignal(e.signals[mac], signal) {
+		e.signals[mac] = append(e.signals[mac], signal)
+	}
+}
+
+// Rekey moves the signals of a device to the key it is known by after
+// active discovery linked its IP to a MAC, so they are not lost when the
+// fingerprints are applied
+func (e *Engine) Rekey(oldKey, newKey string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	signals, ok := e.signals[oldKey]
+	if !ok || oldKey == newKey {
+		return
+	}
+	delete(e.signals, oldKey)
+	for _, signal := range signals {
+		if !hasSignal(e.signals[newKey], signal) {
+			e.signals[newKey] = append(e.signals[newKey], signal)
 		}
 	}
+}
 
-	e.signals[mac] = append(e.signals[mac], signal)
+// hasSignal reports whether signals already holds one of the same type
+// and detail
+func hasSignal(signals []output.Signal, signal output.Signal) bool {
+	for _, existing := range signals {
+		if existing.Type == signal.Type && existing.Detail == signal.Detail {
+			return true
+		}
+	}
+	return false
 }
 
 // checkMDNS detects mDNS traffic (typically Apple devices)
-func (e *Engine) checkMDNS(packet gopacket.Packet) *output.Signal {
-	_, dstPort, proto := capture.ExtractPorts(packet)
-	if proto != "UDP" || dstPort != 5353 {
+func (e *Engine) checkMDNS(packet *capture.PacketMeta) *output.Signal {
+	if packet.Protocol != "UDP" || packet.DstPort != 5353 {
 		return nil
 	}
 
-	dnsLayer := packet.Layer(layers.LayerTypeDNS)
-	if dnsLayer == nil {
+	if !packet.Has(layers.LayerTypeDNS) {
 		return nil
 	}
 
-	dns := dnsLayer.(*layers.DNS)
+	dns := &packet.DNS
 
 	// Check for Apple-specific service types
 	for _, q := range dns.Questions {
@@ -160,9 +204,8 @@ func (e *Engine) checkMDNS(packet gopacket.Packet) *output.Signal {
 }
 
 // checkLLMNR detects LLMNR traffic (Windows)
-func (e *Engine) checkLLMNR(packet gopacket.Packet) *output.Signal {
-	_, dstPort, proto := capture.ExtractPorts(packet)
-	if proto != "UDP" || dstPort != 5355 {
+func (e *Engine) checkLLMNR(packet *capture.PacketMeta) *output.Signal {
+	if packet.Protocol != "UDP" || packet.DstPort != 5355 {
 		return nil
 	}
 
@@ -176,9 +219,8 @@ func (e *Engine) checkLLMNR(packet gopacket.Packet) *output.Signal {
 }
 
 // checkNBNS detects NetBIOS Name Service traffic (Windows)
-func (e *Engine) checkNBNS(packet gopacket.Packet) *output.Signal {
-	_, dstPort, proto := capture.ExtractPorts(packet)
-	if proto != "UDP" || (dstPort != 137 && dstPort != 138) {
+func (e *Engine) checkNBNS(packet *capture.PacketMeta) *output.Signal {
+	if packet.Protocol != "UDP" || (packet.DstPort != 137 && packet.DstPort != 138) {
 		return nil
 	}
 
@@ -192,8 +234,19 @@ func (e *Engine) checkNBNS(packet gopacket.Packet) *output.Signal {
 }
 
 // checkTTL uses initial TTL values as hints
-func (e *Engine) checkTTL(packet gopacket.Packet) *output.Signal {
-	ttl := capture.GetTTL(packet)
+func (e *Engine) checkTTL(packet *capture.PacketMeta) *output.Signal {
+	return ttlSignal(packet.TTL)
+}
+
+// AddTTL adds the TTL hint of a reply to an active probe
+func (e *Engine) AddTTL(key string, ttl int) {
+	if signal := ttlSignal(ttl); signal != nil {
+		e.AddSignal(key, *signal)
+	}
+}
+
+// ttlSignal returns the OS hinted at by a received TTL, or nil
+func ttlSignal(ttl int) *output.Signal {
 	if ttl == 0 {
 		return nil
 	}
@@ -230,21 +283,20 @@ func (e *Engine) ApplyFingerprints() {
 	defer e.mu.RUnlock()
 
 	for mac, signals := range e.signals {
-		device := e.registry.Get(mac)
-		if device == nil {
-			continue
-		}
-
 		guess := e.calculateGuess(signals)
-		device.OSGuess = guess.OS
-		device.Confidence = guess.Confidence
-		device.SignalsUsed = signals
+		e.registry.Update(mac, func(device *discovery.Device) {
+			device.OSGuess = guess.OS
+			device.OSVersion = guess.Version
+			device.Confidence = guess.Confidence
+			device.SignalsUsed = signals
+		})
 	}
 }
 
 // OSGuess represents an OS determination with confidence
 type OSGuess struct {
 	OS         string
+	Version    string // Release of the strongest signal naming one, if any
 	Confidence float64
 }
 
@@ -285,8 +337,19 @@ func (e *Engine) calculateGuess(signals []output.Signal) OSGuess {
 		confidence = 0.95 // Cap at 95%
 	}
 
+	// Take the version from the strongest signal for the winner
+	var version string
+	var versionWeight float64
+	for _, sig := range signals {
+		if sig.OS == bestOS && sig.Version != "" && sig.Weight > versionWeight {
+			version = sig.Version
+			versionWeight = sig.Weight
+		}
+	}
+
 	return OSGuess{
 		OS:         bestOS,
+		Version:    version,
 		Confidence: confidence,
 	}
 }
@@ -0,0 +1,26 @@
+//go:build nopcap
+
+package iface
+
+import "net"
+
+// findDevices lists the system's interfaces when built without libpcap
+func findDevices() ([]device, error) {
+	sysIfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]device, 0, len(sysIfaces))
+	for _, i := range sysIfaces {
+		d := device{Name: i.Name}
+		addrs, _ := i.Addrs()
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				d.Addresses = append(d.Addresses, *ipNet)
+			}
+		}
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
@@ -0,0 +1,27 @@
+//go:build !nopcap
+
+package iface
+
+import (
+	"net"
+
+	"github.com/gopacket/gopacket/pcap"
+)
+
+// findDevices lists the interfaces libpcap can capture on
+func findDevices() ([]device, error) {
+	pcapDevices, err := pcap.FindAllDevs()
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]device, 0, len(pcapDevices))
+	for _, dev := range pcapDevices {
+		d := device{Name: dev.Name, Description: dev.Description}
+		for _, addr := range dev.Addresses {
+			d.Addresses = append(d.Addresses, net.IPNet{IP: addr.IP, Mask: addr.Netmask})
+		}
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
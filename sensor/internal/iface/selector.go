@@ -7,8 +7,6 @@ import (
 	"runtime"
 	"sort"
 	"strings"
-
-	"github.com/gopacket/gopacket/pcap"
 )
 
 // Selector handles network interface enumeration and selection
@@ -49,7 +47,7 @@ func NewSelector() *Selector {
 
 // ListInterfaces returns all available capture-capable interfaces
 func (s *Selector) ListInterfaces() ([]InterfaceInfo, error) {
-	devices, err := pcap.FindAllDevs()
+	devices, err := findDevices()
 	if err != nil {
 		return nil, fmt.Errorf("failed to enumerate interfaces: %w", err)
 	}
@@ -69,14 +67,20 @@ func (s *Selector) ListInterfaces() ([]InterfaceInfo, error) {
 		}
 
 		// Get IPs
+		sysIface, hasSys := sysIfaceMap[dev.Name]
 		for _, addr := range dev.Addresses {
-			if addr.IP != nil {
-				info.IPs = append(info.IPs, addr.IP.String())
+			if addr.IP == nil {
+				continue
+			}
+			info.IPs = append(info.IPs, addr.IP.String())
+			if len(addr.Mask) == 0 && hasSys {
+				addr.Mask = systemNetmask(sysIface, addr.IP)
 			}
+			info.Networks = append(info.Networks, addr)
 		}
 
 		// Check system interface for additional info
-		if sysIface, ok := sysIfaceMap[dev.Name]; ok {
+		if hasSys {
 			info.MAC = sysIface.HardwareAddr.String()
 			info.IsUp = sysIface.Flags&net.FlagUp != 0
 			info.IsLoopback = sysIface.Flags&net.FlagLoopback != 0
@@ -100,6 +104,21 @@ func (s *Selector) ListInterfaces() ([]InterfaceInfo, error) {
 	return result, nil
 }
 
+// systemNetmask looks up the netmask of an address in the system's
+// interface table, for capture libraries that report none
+func systemNetmask(sysIface net.Interface, ip net.IP) net.IPMask {
+	addrs, err := sysIface.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return ipNet.Mask
+		}
+	}
+	return nil
+}
+
 // AutoSelect returns the best interface for capture
 func (s *Selector) AutoSelect() (*InterfaceInfo, error) {
 	ifaces, err := s.ListInterfaces()
@@ -4,14 +4,22 @@ import "net"
 
 // InterfaceInfo contains information about a network interface
 type InterfaceInfo struct {
-	Name        string   // Interface name (e.g., "en0", "eth0", "Wi-Fi")
-	Description string   // Human-readable description
-	MAC         string   // Hardware MAC address
-	IPs         []string // Assigned IP addresses
-	IsUp        bool     // Whether interface is up
-	IsLoopback  bool     // Whether interface is loopback
-	IsVirtual   bool     // Whether interface appears to be virtual
-	Score       int      // Selection score (higher = better candidate)
+	Name        string      // Interface name (e.g., "en0", "eth0", "Wi-Fi")
+	Description string      // Human-readable description
+	MAC         string      // Hardware MAC address
+	IPs         []string    // Assigned IP addresses
+	Networks    []net.IPNet // Assigned addresses with their netmasks, where known
+	IsUp        bool        // Whether interface is up
+	IsLoopback  bool        // Whether interface is loopback
+	IsVirtual   bool        // Whether interface appears to be virtual
+	Score       int         // Selection score (higher = better candidate)
+}
+
+// device is a capture-capable interface as reported by the capture library
+type device struct {
+	Name        string
+	Description string
+	Addresses   []net.IPNet
 }
 
 // ScoredInterface pairs an interface with its selection score
@@ -20,6 +28,17 @@ type ScoredInterface struct {
 	Score int
 }
 
+// Netmask returns the netmask of one of the interface's addresses, or
+// nil if it is not known
+func (i *InterfaceInfo) Netmask(ip net.IP) net.IPMask {
+	for _, n := range i.Networks {
+		if n.IP.Equal(ip) && len(n.Mask) > 0 {
+			return n.Mask
+		}
+	}
+	return nil
+}
+
 // IsRFC1918 checks if an IP address is in RFC1918 private address space
 func IsRFC1918(ip net.IP) bool {
 	ip = ip.To4()
@@ -47,6 +66,13 @@ func GetLocalSubnet(ip net.IP, mask net.IPMask) *net.IPNet {
 	if ip == nil || mask == nil {
 		return nil
 	}
+	// IPv4 addresses may come with a 16-byte mask
+	if ip4 := ip.To4(); ip4 != nil && len(mask) == net.IPv6len {
+		ip, mask = ip4, mask[12:]
+	}
+	if ones, bits := mask.Size(); ones == 0 && bits == 0 {
+		return nil // Non-canonical mask
+	}
 	return &net.IPNet{
 		IP:   ip.Mask(mask),
 		Mask: mask,
@@ -5,12 +5,14 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"time"
 )
 
 // Generator creates summary JSON files
 type Generator struct {
 	outputDir string
+	retain    int // Number of summary files to keep; 0 keeps all
 }
 
 // NewGenerator creates a new summary generator
@@ -20,6 +22,12 @@ func NewGenerator(outputDir string) *Generator {
 	}
 }
 
+// SetRetain limits how many summary files are kept in the output directory.
+// Older files are removed after each new summary is written.
+func (g *Generator) SetRetain(n int) {
+	g.retain = n
+}
+
 // Generate creates and writes a summary file
 func (g *Generator) Generate(summary *Summary) (string, error) {
 	// Ensure output directory exists
@@ -43,9 +51,37 @@ func (g *Generator) Generate(summary *Summary) (string, error) {
 		return "", fmt.Errorf("failed to write summary file: %w", err)
 	}
 
+	if err := g.prune(); err != nil {
+		return filepath, fmt.Errorf("failed to remove old summaries: %w", err)
+	}
+
 	return filepath, nil
 }
 
+// prune removes the oldest summary files beyond the retention limit
+func (g *Generator) prune() error {
+	if g.retain <= 0 {
+		return nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(g.outputDir, "summary_*.json"))
+	if err != nil {
+		return err
+	}
+	if len(files) <= g.retain {
+		return nil
+	}
+
+	// Timestamped names sort chronologically
+	sort.Strings(files)
+	for _, f := range files[:len(files)-g.retain] {
+		if err := os.Remove(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // NewSummary creates a new summary with sensor info
 func NewSummary(sensorOS, hostname, ifaceName, localIP string) *Summary {
 	return &Summary{
@@ -76,6 +112,42 @@ func (s *Summary) SetCaptureInfo(startTime time.Time, duration int, packetCount
 	s.Capture.PacketCount = packetCount
 }
 
+// SetInterfaces records every interface the capture ran on
+func (s *Summary) SetInterfaces(ifaces []SegmentInfo) {
+	s.Sensor.Interfaces = ifaces
+}
+
+// SetSourceFile records the capture file a replayed summary was built from
+func (s *Summary) SetSourceFile(path string) {
+	s.Capture.SourceFile = path
+}
+
+// SetCaptureStats records capture health counters and adds a warning
+// when the drop rate exceeds warnRate (a fraction; zero disables it) or
+// an analyzer failed on some packets
+func (s *Summary) SetCaptureStats(stats CaptureStats, warnRate float64) {
+	s.Capture.Stats = &stats
+	if warnRate > 0 && stats.DropRate > warnRate {
+		s.AddWarning(fmt.Sprintf("%.2f%% of packets were dropped during capture (%d of %d); results are incomplete",
+			stats.DropRate*100, stats.Dropped+stats.IfDropped, stats.Received+stats.Dropped+stats.IfDropped))
+	}
+	for _, h := range stats.Handlers {
+		if h.Panics > 0 {
+			s.AddWarning(fmt.Sprintf("the %s analyzer failed on %d packets; its results are incomplete", h.Name, h.Panics))
+		}
+	}
+}
+
+// SetRecordings references the pcapng files holding the summarized packets
+func (s *Summary) SetRecordings(recordings []RecordingInfo) {
+	s.Capture.Recordings = recordings
+}
+
+// AddWarning records a reason the summary may be incomplete
+func (s *Summary) AddWarning(warning string) {
+	s.Capture.Warnings = append(s.Capture.Warnings, warning)
+}
+
 // SetDevices sets the devices list
 func (s *Summary) SetDevices(devices []DeviceInfo) {
 	s.Devices = devices
@@ -96,8 +168,6 @@ Interface:  %s (%s)
 Duration:   %d seconds
 Packets:    %d
 Devices:    %d discovered
-
-Top Protocols:
 `,
 		s.Sensor.Hostname,
 		s.Sensor.OS,
@@ -108,11 +178,62 @@ Top Protocols:
 		len(s.Devices),
 	)
 
+	// Add capture health
+	if st := s.Capture.Stats; st != nil {
+		result += fmt.Sprintf("Dropped:    %d kernel, %d interface (%.2f%%)\n", st.Dropped, st.IfDropped, st.DropRate*100)
+		if st.DecodeErrors > 0 {
+			result += fmt.Sprintf("Undecoded:  %d packets\n", st.DecodeErrors)
+		}
+		if st.QueueCapacity > 0 {
+			result += fmt.Sprintf("Queue:      peak %d/%d, %d stalls\n", st.QueueHighWater, st.QueueCapacity, st.QueueStalls)
+		}
+		if sm := st.Sampling; sm != nil {
+			result += fmt.Sprintf("Sampling:   1 in %d by %s, %d packets skipped (traffic counts are estimates)\n", sm.Rate, sm.Mode, sm.Skipped)
+		}
+		for _, h := range st.Handlers {
+			spent := time.Duration(h.TimeMs * float64(time.Millisecond)).Round(time.Microsecond)
+			line := fmt.Sprintf("Handler:    %s %s", h.Name, spent)
+			if h.Packets > 0 {
+				line += fmt.Sprintf(" (%.0fns/packet)", h.TimeMs*1e6/float64(h.Packets))
+			}
+			if h.Panics > 0 {
+				line += fmt.Sprintf(", %d panics", h.Panics)
+			}
+			result += line + "\n"
+		}
+	}
+
+	result += "\nTop Protocols:\n"
+
 	// Add protocol counts
 	for proto, count := range s.Traffic.ProtocolCounts {
 		result += fmt.Sprintf("  %s: %d\n", proto, count)
 	}
 
+	// Add per-interface volume when capturing on several interfaces
+	if len(s.Traffic.Interfaces) > 1 {
+		result += "\nInterfaces:\n"
+		for _, i := range s.Traffic.Interfaces {
+			subnet := ""
+			if i.Subnet != "" {
+				subnet = " (" + i.Subnet + ")"
+			}
+			result += fmt.Sprintf("  %s%s: %d packets, %d bytes\n", i.Interface, subnet, i.Packets, i.Bytes)
+		}
+	}
+
+	// Add per-VLAN volume when tagged traffic was seen
+	if len(s.Traffic.VLANs) > 0 {
+		result += "\nVLANs:\n"
+		for _, v := range s.Traffic.VLANs {
+			name := "untagged"
+			if v.VLAN != "" {
+				name = "vlan " + v.VLAN
+			}
+			result += fmt.Sprintf("  %s: %d packets, %d bytes\n", name, v.Packets, v.Bytes)
+		}
+	}
+
 	// Add top ports
 	if len(s.Traffic.TopPorts) > 0 {
 		result += "\nTop Ports:\n"
@@ -122,7 +243,11 @@ Top Protocols:
 		}
 		for i := 0; i < limit; i++ {
 			p := s.Traffic.TopPorts[i]
-			result += fmt.Sprintf("  %s/%d: %d\n", p.Protocol, p.Port, p.Count)
+			vlan := ""
+			if p.VLAN != "" {
+				vlan = " (vlan " + p.VLAN + ")"
+			}
+			result += fmt.Sprintf("  %s/%d%s: %d\n", p.Protocol, p.Port, vlan, p.Count)
 		}
 	}
 
@@ -146,12 +271,36 @@ Top Protocols:
 					ips += fmt.Sprintf(" (+%d more)", len(d.IPs)-1)
 				}
 			}
-			result += fmt.Sprintf("  %s | %s | %s | %s\n", d.MAC, ips, d.Vendor, osInfo)
+			mac := d.MAC
+			if mac == "" {
+				mac = "(no MAC)"
+			}
+			result += fmt.Sprintf("  %s | %s | %s | %s\n", mac, ips, d.Vendor, osInfo)
 		}
 		if len(s.Devices) > limit {
 			result += fmt.Sprintf("  ... and %d more devices\n", len(s.Devices)-limit)
 		}
 	}
 
+	// List recorded packet files
+	if len(s.Capture.Recordings) > 0 {
+		result += "\nRecordings:\n"
+		for _, r := range s.Capture.Recordings {
+			notes := ""
+			if r.HeadersOnly {
+				notes += ", headers only"
+			}
+			if r.Deleted {
+				notes += ", deleted for the disk budget"
+			}
+			result += fmt.Sprintf("  %s: %d packets, %d bytes%s\n", r.File, r.Packets, r.Bytes, notes)
+		}
+	}
+
+	// Flag incomplete results last so they are not missed
+	for _, w := range s.Capture.Warnings {
+		result += fmt.Sprintf("\nWARNING: %s\n", w)
+	}
+
 	return result
 }
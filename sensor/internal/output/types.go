@@ -4,48 +4,201 @@ import "time"
 
 // Summary is the main output structure written as JSON
 type Summary struct {
-	Sensor  SensorInfo    `json:"sensor"`
-	Capture CaptureInfo   `json:"capture"`
-	Devices []DeviceInfo  `json:"devices"`
-	Traffic TrafficInfo   `json:"traffic"`
+	Sensor  SensorInfo   `json:"sensor"`
+	Capture CaptureInfo  `json:"capture"`
+	Devices []DeviceInfo `json:"devices"`
+	Traffic TrafficInfo  `json:"traffic"`
 }
 
 // SensorInfo contains information about the sensor machine
 type SensorInfo struct {
-	OS        string `json:"os"`
-	Hostname  string `json:"hostname"`
+	OS         string        `json:"os"`
+	Hostname   string        `json:"hostname"`
+	Interface  string        `json:"interface"`
+	LocalIP    string        `json:"localIP"`
+	Interfaces []SegmentInfo `json:"interfaces,omitempty"` // Every interface captured on
+}
+
+// SegmentInfo identifies the interface, subnet and VLAN traffic was observed on
+type SegmentInfo struct {
 	Interface string `json:"interface"`
-	LocalIP   string `json:"localIP"`
+	Subnet    string `json:"subnet,omitempty"`
+	VLAN      string `json:"vlan,omitempty"` // 802.1Q VLAN ID, "outer.inner" for QinQ
 }
 
 // CaptureInfo contains capture session metadata
 type CaptureInfo struct {
-	StartTime   time.Time `json:"startTime"`
-	Duration    int       `json:"duration"` // seconds
-	PacketCount int64     `json:"packetCount"`
+	StartTime   time.Time       `json:"startTime"`
+	Duration    int             `json:"duration"` // seconds
+	PacketCount int64           `json:"packetCount"`
+	SourceFile  string          `json:"sourceFile,omitempty"` // Set when replaying a saved capture
+	Stats       *CaptureStats   `json:"stats,omitempty"`
+	Warnings    []string        `json:"warnings,omitempty"` // Reasons the summary may be incomplete
+	Recordings  []RecordingInfo `json:"recordings,omitempty"`
+}
+
+// RecordingInfo references a pcapng file recorded alongside the summary
+type RecordingInfo struct {
+	File        string    `json:"file"` // Name relative to the output directory
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Packets     int64     `json:"packets"`
+	Bytes       int64     `json:"bytes"`
+	HeadersOnly bool      `json:"headersOnly,omitempty"` // Payloads were truncated
+	Deleted     bool      `json:"deleted,omitempty"`     // Deleted to stay within the disk budget
+}
+
+// CaptureStats reports capture health, so a lossy capture can be told
+// apart from a quiet network
+type CaptureStats struct {
+	Received       int64            `json:"received"`
+	Dropped        int64            `json:"dropped"`   // Dropped by the kernel
+	IfDropped      int64            `json:"ifDropped"` // Dropped by the interface or driver
+	DropRate       float64          `json:"dropRate"`  // Fraction of offered packets lost
+	DecodeErrors   int64            `json:"decodeErrors"`
+	QueueHighWater int              `json:"queueHighWater,omitempty"`
+	QueueCapacity  int              `json:"queueCapacity,omitempty"`
+	QueueStalls    int64            `json:"queueStalls,omitempty"`
+	Interfaces     []InterfaceStats `json:"interfaces,omitempty"`
+	Handlers       []HandlerStats   `json:"handlers,omitempty"`
+	QuarantineFile string           `json:"quarantineFile,omitempty"` // Packets that made an analyzer fail, relative to the output directory
+	Sampling       *SamplingInfo    `json:"sampling,omitempty"`
+}
+
+// SamplingInfo describes the packet sampling applied to a capture.
+// Traffic counters are scaled up by the rate and are therefore
+// estimates; discovery packets (ARP, DHCP, mDNS, NBNS, LLMNR) are
+// always analyzed.
+type SamplingInfo struct {
+	Mode    string `json:"mode"`    // "packet" or "flow"
+	Rate    int    `json:"rate"`    // 1 in Rate packets or flows is analyzed
+	Skipped int64  `json:"skipped"` // Packets left out
+}
+
+// InterfaceStats holds capture counters for one interface
+type InterfaceStats struct {
+	Interface    string `json:"interface"`
+	Received     int64  `json:"received"`
+	Dropped      int64  `json:"dropped"`
+	IfDropped    int64  `json:"ifDropped"`
+	DecodeErrors int64  `json:"decodeErrors"`
+}
+
+// HandlerStats reports the processing time and failures of one analyzer
+type HandlerStats struct {
+	Name        string  `json:"name"`
+	Packets     int64   `json:"packets"`
+	TimeMs      float64 `json:"timeMs"` // Cumulative processing time
+	Panics      int64   `json:"panics,omitempty"`
+	Quarantined int64   `json:"quarantined,omitempty"`
 }
 
 // DeviceInfo contains information about a discovered device
 type DeviceInfo struct {
-	MAC             string   `json:"mac"`
-	IPs             []string `json:"ips"`
-	Vendor          string   `json:"vendor,omitempty"`
-	Hostname        string   `json:"hostname,omitempty"`
-	OSGuess         string   `json:"osGuess,omitempty"`
-	Confidence      float64  `json:"confidence,omitempty"`
-	SignalsUsed     []string `json:"signalsUsed,omitempty"`
-	DiscoverySource string   `json:"discoverySource"` // "passive", "active-arp", etc.
-	FirstSeen       time.Time `json:"firstSeen"`
-	LastSeen        time.Time `json:"lastSeen"`
+	MAC             string        `json:"mac"`
+	IPs             []string      `json:"ips"`
+	IPv6Addresses   []IPv6Address `json:"ipv6Addresses,omitempty"`
+	IPv6Prefixes    []string      `json:"ipv6Prefixes,omitempty"` // Prefixes advertised by an IPv6 router
+	Vendor          string        `json:"vendor,omitempty"`
+	Hostname        string        `json:"hostname,omitempty"`
+	DUID            string        `json:"duid,omitempty"`         // DHCPv6 client DUID
+	VendorClass     string        `json:"vendorClass,omitempty"`  // DHCP/DHCPv6 vendor class
+	Workgroup       string        `json:"workgroup,omitempty"`    // NetBIOS workgroup or domain
+	NetBIOSNames    []string      `json:"netbiosNames,omitempty"` // e.g. "DESKTOP-1<00>", "WORKGROUP<1E>"
+	LoggedInUser    string        `json:"loggedInUser,omitempty"` // From a NetBIOS node status response
+	Roles           []string      `json:"roles,omitempty"`        // e.g. "file-server", "domain-controller"
+	Services        []ServiceInfo `json:"services,omitempty"`     // Advertised DNS-SD services
+	UPnP            *UPnPInfo     `json:"upnp,omitempty"`
+	SNMP            *SNMPInfo     `json:"snmp,omitempty"`
+	RTTMs           float64       `json:"rttMs,omitempty"` // Ping round-trip time in milliseconds
+	TTL             int           `json:"ttl,omitempty"`   // TTL of the ping reply, as received
+	Ports           []PortInfo    `json:"ports,omitempty"` // Port probe results
+	OSGuess         string        `json:"osGuess,omitempty"`
+	OSVersion       string        `json:"osVersion,omitempty"`
+	Confidence      float64       `json:"confidence,omitempty"`
+	SignalsUsed     []string      `json:"signalsUsed,omitempty"`
+	DiscoverySource string        `json:"discoverySource"` // "passive", "active-arp", etc.
+	SeenOn          []SegmentInfo `json:"seenOn,omitempty"`
+	FirstSeen       time.Time     `json:"firstSeen"`
+	LastSeen        time.Time     `json:"lastSeen"`
+}
+
+// IPv6Address is one of a device's IPv6 addresses with how it was formed:
+// "link-local", "slaac" (EUI-64 from the MAC), "privacy" (random
+// interface ID, RFC 4941/7217), "dhcpv6" or "static" (short manually
+// assigned interface ID)
+type IPv6Address struct {
+	Address string `json:"address"`
+	Type    string `json:"type"`
+}
+
+// ServiceInfo is a DNS-SD service instance a device advertises
+type ServiceInfo struct {
+	Name string            `json:"name"`           // Instance name, e.g. "Living Room"
+	Type string            `json:"type"`           // e.g. "_googlecast._tcp"
+	Port int               `json:"port,omitempty"` // From the SRV record
+	Host string            `json:"host,omitempty"` // SRV target, e.g. "Chromecast-1a2b.local"
+	TXT  map[string]string `json:"txt,omitempty"`
+}
+
+// SNMPInfo is the SNMP system group (RFC 3418) of a device
+type SNMPInfo struct {
+	SysDescr    string `json:"sysDescr,omitempty"`
+	SysObjectID string `json:"sysObjectID,omitempty"`
+	SysName     string `json:"sysName,omitempty"`
+	SysLocation string `json:"sysLocation,omitempty"`
+	SysUpTime   int64  `json:"sysUpTime,omitempty"` // Seconds since the agent started
+	Vendor      string `json:"vendor,omitempty"`    // From the sysObjectID enterprise number
+	Version     string `json:"version"`             // "v1" or "v2c"
+}
+
+// PortInfo is the state of a probed port: "open" (SYN-ACK), "closed"
+// (RST) or "filtered" (no answer)
+type PortInfo struct {
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"` // "tcp"
+	State    string `json:"state"`
+}
+
+// UPnPInfo identifies a device from its SSDP response and UPnP device
+// description
+type UPnPInfo struct {
+	FriendlyName string `json:"friendlyName,omitempty"`
+	Manufacturer string `json:"manufacturer,omitempty"`
+	ModelName    string `json:"modelName,omitempty"`
+	ModelNumber  string `json:"modelNumber,omitempty"`
+	SerialNumber string `json:"serialNumber,omitempty"`
+	DeviceType   string `json:"deviceType,omitempty"` // e.g. "urn:schemas-upnp-org:device:MediaRenderer:1"
+	Server       string `json:"server,omitempty"`     // SSDP SERVER header
+	Location     string `json:"location,omitempty"`   // Description URL
 }
 
 // TrafficInfo contains aggregated traffic statistics
 type TrafficInfo struct {
-	ProtocolCounts map[string]int64  `json:"protocolCounts"`
-	TopPorts       []PortCount       `json:"topPorts"`
-	TopTalkers     []TalkerInfo      `json:"topTalkers"`
-	DNSDomains     []DNSDomainInfo   `json:"dnsDomains"`
-	Destinations   []DestinationInfo `json:"destinations"`
+	ProtocolCounts map[string]int64   `json:"protocolCounts"`
+	TopPorts       []PortCount        `json:"topPorts"`
+	TopTalkers     []TalkerInfo       `json:"topTalkers"`
+	DNSDomains     []DNSDomainInfo    `json:"dnsDomains"`
+	Destinations   []DestinationInfo  `json:"destinations"`
+	Interfaces     []InterfaceTraffic `json:"interfaces,omitempty"`
+	VLANs          []VLANTraffic      `json:"vlans,omitempty"` // Present when tagged traffic was seen
+}
+
+// InterfaceTraffic represents traffic volume captured on one interface
+type InterfaceTraffic struct {
+	Interface string `json:"interface"`
+	Subnet    string `json:"subnet,omitempty"`
+	Packets   int64  `json:"packets"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// VLANTraffic represents traffic volume on one VLAN. Untagged traffic
+// is listed without a VLAN.
+type VLANTraffic struct {
+	VLAN           string           `json:"vlan,omitempty"`
+	Packets        int64            `json:"packets"`
+	Bytes          int64            `json:"bytes"`
+	ProtocolCounts map[string]int64 `json:"protocolCounts"`
 }
 
 // PortCount represents a port usage count
@@ -53,6 +206,7 @@ type PortCount struct {
 	Port     int    `json:"port"`
 	Protocol string `json:"protocol"` // "TCP" or "UDP"
 	Count    int64  `json:"count"`
+	VLAN     string `json:"vlan,omitempty"`
 }
 
 // TalkerInfo represents a top talker by traffic volume
@@ -62,6 +216,9 @@ type TalkerInfo struct {
 	BytesReceived   int64  `json:"bytesReceived"`
 	PacketsSent     int64  `json:"packetsSent"`
 	PacketsReceived int64  `json:"packetsReceived"`
+	Interface       string `json:"interface,omitempty"`
+	Subnet          string `json:"subnet,omitempty"`
+	VLAN            string `json:"vlan,omitempty"`
 }
 
 // DNSDomainInfo represents a queried DNS domain
@@ -69,6 +226,7 @@ type DNSDomainInfo struct {
 	Domain      string   `json:"domain"`
 	QueryCount  int64    `json:"queryCount"`
 	QueryingIPs []string `json:"queryingIPs,omitempty"`
+	VLAN        string   `json:"vlan,omitempty"`
 }
 
 // DestinationInfo represents an external destination
@@ -76,12 +234,15 @@ type DestinationInfo struct {
 	Address         string `json:"address"` // IP or domain
 	ConnectionCount int64  `json:"connectionCount"`
 	BytesTotal      int64  `json:"bytesTotal"`
+	Interface       string `json:"interface,omitempty"`
+	VLAN            string `json:"vlan,omitempty"`
 }
 
 // Signal represents an OS fingerprinting signal
 type Signal struct {
-	Type   string  `json:"type"`   // "mDNS", "LLMNR", "NBNS", "DHCP", "TTL"
-	Detail string  `json:"detail"` // Specific observation
-	Weight float64 `json:"weight"`
-	OS     string  `json:"os"` // Implied OS
+	Type    string  `json:"type"`   // "mDNS", "LLMNR", "NBNS", "DHCP", "TTL"
+	Detail  string  `json:"detail"` // Specific observation
+	Weight  float64 `json:"weight"`
+	OS      string  `json:"os"`                // Implied OS
+	Version string  `json:"version,omitempty"` // Implied OS release, e.g. "10/11"
 }
@@ -0,0 +1,315 @@
+package record
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/asset_discovery/sensor/internal/capture"
+	"github.com/asset_discovery/sensor/internal/output"
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+)
+
+// Config controls packet recording
+type Config struct {
+	Dir         string        // Directory the pcapng files are written to
+	MaxFileSize int64         // Rotate once a file reaches this many bytes (0 = no limit)
+	MaxFileAge  time.Duration // Rotate once a file spans this much capture time (0 = no limit)
+	MaxTotal    int64         // Delete the oldest files to stay within this many bytes (0 = no limit; needs MaxFileSize)
+	HeadersOnly bool          // Truncate packets after the last protocol header
+	SnapLen     int           // Snapshot length the packets were captured with
+}
+
+// Recorder writes captured packets to a ring of pcapng files. Files are
+// rotated by size and age, and the oldest are deleted to stay within
+// the disk budget. It is safe for use from several dispatch workers.
+type Recorder struct {
+	cfg Config
+
+	mu       sync.Mutex
+	file     *os.File
+	writer   *pcapgo.NgWriter
+	size     int64          // Bytes in the current file, including buffered blocks
+	ifaces   map[string]int // pcapng interface IDs in the current file
+	segments []*segment     // Files on disk, oldest first; the last may be open
+	deleted  []*segment     // Files deleted for the budget before Cut reported them
+	seq      int
+	err      error // First write error; recording stops once set
+}
+
+// segment is one recorded file
+type segment struct {
+	path     string
+	size     int64
+	info     output.RecordingInfo
+	reported bool
+}
+
+// enhancedPacketBlockSize returns the pcapng block size for a packet
+// of n bytes written without options
+func enhancedPacketBlockSize(n int) int64 {
+	return int64(32 + (n+3)&^3)
+}
+
+// NewRecorder creates a recorder writing into cfg.Dir. Files are only
+// created once packets arrive.
+func NewRecorder(cfg Config) (*Recorder, error) {
+	if cfg.MaxFileSize < 0 || cfg.MaxTotal < 0 || cfg.MaxFileAge < 0 {
+		return nil, fmt.Errorf("recording limits must not be negative")
+	}
+	// The budget is enforced as files close, so files must be bounded
+	if cfg.MaxTotal > 0 && cfg.MaxFileSize == 0 {
+		return nil, fmt.Errorf("a recording disk budget needs a file size limit")
+	}
+	if cfg.MaxTotal > 0 && cfg.MaxFileSize > cfg.MaxTotal {
+		return nil, fmt.Errorf("recording file size (%d bytes) exceeds the disk budget (%d bytes)", cfg.MaxFileSize, cfg.MaxTotal)
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %w", err)
+	}
+
+	return &Recorder{cfg: cfg}, nil
+}
+
+// WritePacket records a packet. It has the capture.PacketHandler
+// signature so it can be added to the engine directly.
+func (r *Recorder) WritePacket(packet *capture.PacketMeta) {
+	data := packet.Data
+	if r.cfg.HeadersOnly {
+		data = data[:packet.HeaderLength()]
+	}
+	ci := gopacket.CaptureInfo{
+		Timestamp:     packet.Timestamp,
+		CaptureLength: len(data),
+		Length:        packet.Length,
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return
+	}
+	if err := r.write(packet.Interface.Name, packet.LinkType, ci, data); err != nil {
+		r.err = err
+		r.closeFile(false)
+	}
+}
+
+// write appends a packet to the current file, rotating first if needed.
+// Each capture interface is recorded with its own link type.
+func (r *Recorder) write(ifaceName string, linkType layers.LinkType, ci gopacket.CaptureInfo, data []byte) error {
+	if r.writer != nil && r.shouldRotate(ci.Timestamp) {
+		if err := r.closeFile(true); err != nil {
+			return err
+		}
+	}
+	if r.writer == nil {
+		if err := r.openFile(ifaceName, linkType, ci.Timestamp); err != nil {
+			return err
+		}
+	}
+
+	id, ok := r.ifaces[ifaceName]
+	if !ok {
+		var err error
+		if id, err = r.writer.AddInterface(r.ngInterface(ifaceName, linkType)); err != nil {
+			return fmt.Errorf("failed to add recording interface: %w", err)
+		}
+		if err := r.syncSize(); err != nil {
+			return err
+		}
+		r.ifaces[ifaceName] = id
+	}
+	ci.InterfaceIndex = id
+
+	if err := r.writer.WritePacket(ci, data); err != nil {
+		return fmt.Errorf("failed to record packet: %w", err)
+	}
+	r.size += enhancedPacketBlockSize(len(data))
+
+	current := r.segments[len(r.segments)-1]
+	current.info.Packets++
+	if current.info.Start.IsZero() || ci.Timestamp.Before(current.info.Start) {
+		current.info.Start = ci.Timestamp
+	}
+	if ci.Timestamp.After(current.info.End) {
+		current.info.End = ci.Timestamp
+	}
+	return nil
+}
+
+// shouldRotate reports whether the current file has reached a rotation limit
+func (r *Recorder) shouldRotate(ts time.Time) bool {
+	current := r.segments[len(r.segments)-1]
+	if r.cfg.MaxFileSize > 0 && r.size >= r.cfg.MaxFileSize {
+		return true
+	}
+	if r.cfg.MaxFileAge > 0 && !current.info.Start.IsZero() && ts.Sub(current.info.Start) >= r.cfg.MaxFileAge {
+		return true
+	}
+	return false
+}
+
+// openFile starts a new pcapng file whose first interface is ifaceName
+func (r *Recorder) openFile(ifaceName string, linkType layers.LinkType, ts time.Time) error {
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	// Files from an earlier run over the same capture are left alone
+	var name, path string
+	var f *os.File
+	for {
+		r.seq++
+		name = fmt.Sprintf("capture_%s_%04d.pcapng", ts.Format("20060102_150405"), r.seq)
+		path = filepath.Join(r.cfg.Dir, name)
+
+		var err error
+		if f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return fmt.Errorf("failed to create recording file: %w", err)
+		}
+	}
+	writer, err := pcapgo.NewNgWriterInterface(f, r.ngInterface(ifaceName, linkType), pcapgo.DefaultNgWriterOptions)
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("failed to write recording header: %w", err)
+	}
+
+	r.file = f
+	r.writer = writer
+	r.ifaces = map[string]int{ifaceName: 0}
+	r.segments = append(r.segments, &segment{
+		path: path,
+		info: output.RecordingInfo{
+			File:        name,
+			HeadersOnly: r.cfg.HeadersOnly,
+		},
+	})
+	return r.syncSize()
+}
+
+// syncSize flushes the header blocks, whose size the writer does not
+// report, and reads the file size back
+func (r *Recorder) syncSize() error {
+	if err := r.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write recording header: %w", err)
+	}
+	info, err := r.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat recording file: %w", err)
+	}
+	r.size = info.Size()
+	return nil
+}
+
+// ngInterface describes a capture interface in the pcapng header
+func (r *Recorder) ngInterface(name string, linkType layers.LinkType) pcapgo.NgInterface {
+	intf := pcapgo.DefaultNgInterface
+	intf.Name = name
+	intf.LinkType = linkType
+	intf.SnapLength = uint32(r.cfg.SnapLen)
+	return intf
+}
+
+// closeFile flushes and closes the current file, then enforces the disk
+// budget. With reserve set, room is also left for a full next file.
+func (r *Recorder) closeFile(reserve bool) error {
+	if r.writer == nil {
+		return nil
+	}
+
+	err := r.writer.Flush()
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	current := r.segments[len(r.segments)-1]
+	current.size = r.size
+	current.info.Bytes = r.size
+
+	r.file = nil
+	r.writer = nil
+	r.size = 0
+	r.ifaces = nil
+	if err != nil {
+		return fmt.Errorf("failed to close recording file: %w", err)
+	}
+
+	limit := r.cfg.MaxTotal
+	if reserve {
+		limit -= r.cfg.MaxFileSize
+	}
+	return r.enforceBudget(limit)
+}
+
+// enforceBudget deletes the oldest closed files until their total size
+// is within limit. Deleted files not yet reported by Cut are kept so the
+// next summary still lists them.
+func (r *Recorder) enforceBudget(limit int64) error {
+	if r.cfg.MaxTotal <= 0 {
+		return nil
+	}
+
+	var total int64
+	for _, s := range r.segments {
+		total += s.size
+	}
+	for total > limit && len(r.segments) > 0 {
+		oldest := r.segments[0]
+		if err := os.Remove(oldest.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete old recording: %w", err)
+		}
+		total -= oldest.size
+		r.segments = r.segments[1:]
+		if !oldest.reported {
+			oldest.info.Deleted = true
+			r.deleted = append(r.deleted, oldest)
+		}
+	}
+	return nil
+}
+
+// Cut closes the current file and returns the files recorded since the
+// previous call, so each summary references the packets it covers.
+// Files already deleted to stay within the disk budget are marked so.
+// Recording continues in a new file.
+func (r *Recorder) Cut() ([]output.RecordingInfo, error) {
+	return r.cut(true)
+}
+
+// Close finishes recording and returns the files not yet reported by Cut
+func (r *Recorder) Close() ([]output.RecordingInfo, error) {
+	return r.cut(false)
+}
+
+// cut closes the current file and collects the unreported files
+func (r *Recorder) cut(reserve bool) ([]output.RecordingInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.closeFile(reserve)
+	if err == nil {
+		err = r.err
+	}
+
+	var result []output.RecordingInfo
+	for _, s := range r.deleted {
+		s.reported = true
+		result = append(result, s.info)
+	}
+	r.deleted = nil
+	for _, s := range r.segments {
+		if !s.reported {
+			s.reported = true
+			result = append(result, s.info)
+		}
+	}
+	return result, err
+}
@@ -1,39 +1,92 @@
 package traffic
 
 import (
+	"net"
 	"sort"
 	"sync"
 
 	"github.com/asset_discovery/sensor/internal/capture"
 	"github.com/asset_discovery/sensor/internal/output"
-	"github.com/gopacket/gopacket"
 	"github.com/gopacket/gopacket/layers"
 )
 
+// shardCount is the number of independently locked shards. Packets are
+// assigned by symmetric flow hash, so parallel dispatch workers handling
+// different flows rarely contend for the same lock.
+const shardCount = 16
+
 // Analyzer aggregates traffic statistics
 type Analyzer struct {
-	mu sync.RWMutex
+	shards [shardCount]*shard
+
+	// Local subnet for determining "external"
+	localPrefix string
+	localNet    *net.IPNet // Overrides localPrefix when set
+}
+
+// shard holds the counters for a subset of flows
+type shard struct {
+	mu sync.Mutex
+	*counters
+}
 
+// counters holds aggregated traffic statistics
+type counters struct {
 	// Protocol counts
 	protocols map[string]int64
 
-	// Port counts (key: "protocol:port")
-	ports map[string]int64
+	// Port counts, per VLAN
+	ports map[portKey]int64
 
-	// Traffic by IP
-	talkers map[string]*talkerStats
+	// Traffic by IP, per capture interface and VLAN
+	talkers map[endpointKey]*talkerStats
 
-	// DNS domains
-	domains map[string]*domainStats
+	// DNS domains, per VLAN
+	domains map[domainKey]*domainStats
 
-	// Destinations (external IPs)
-	destinations map[string]*destStats
+	// Destinations (external IPs), per capture interface and VLAN
+	destinations map[endpointKey]*destStats
 
-	// Local subnet for determining "external"
-	localPrefix string
+	// Traffic volume by capture interface
+	interfaces map[string]*ifaceStats
+
+	// Traffic volume by VLAN ("" for untagged)
+	vlans map[string]*vlanStats
+}
+
+// endpointKey identifies an IP address on a capture interface and VLAN,
+// so the same address seen on two segments is tracked separately
+type endpointKey struct {
+	iface string
+	vlan  string
+	ip    string
+}
+
+type portKey struct {
+	protocol string
+	port     uint16
+	vlan     string
+}
+
+type domainKey struct {
+	domain string
+	vlan   string
+}
+
+type ifaceStats struct {
+	Subnet  string
+	Packets int64
+	Bytes   int64
+}
+
+type vlanStats struct {
+	Packets   int64
+	Bytes     int64
+	protocols map[string]int64
 }
 
 type talkerStats struct {
+	Subnet          string
 	BytesSent       int64
 	BytesReceived   int64
 	PacketsSent     int64
@@ -62,73 +115,112 @@ func NewAnalyzer(localIP string) *Analyzer {
 		}
 	}
 
-	return &Analyzer{
+	a := &Analyzer{localPrefix: prefix}
+	for i := range a.shards {
+		a.shards[i] = &shard{counters: newCounters()}
+	}
+	return a
+}
+
+// newCounters creates an empty set of counters
+func newCounters() *counters {
+	return &counters{
 		protocols:    make(map[string]int64),
-		ports:        make(map[string]int64),
-		talkers:      make(map[string]*talkerStats),
-		domains:      make(map[string]*domainStats),
-		destinations: make(map[string]*destStats),
-		localPrefix:  prefix,
+		ports:        make(map[portKey]int64),
+		talkers:      make(map[endpointKey]*talkerStats),
+		domains:      make(map[domainKey]*domainStats),
+		destinations: make(map[endpointKey]*destStats),
+		interfaces:   make(map[string]*ifaceStats),
+		vlans:        make(map[string]*vlanStats),
 	}
 }
 
-// ProcessPacket analyzes a single packet
-func (a *Analyzer) ProcessPacket(packet gopacket.Packet) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
+// ProcessPacket analyzes a single packet. Counters are scaled by the
+// packet's weight, so sampled captures report estimated totals.
+func (a *Analyzer) ProcessPacket(packet *capture.PacketMeta) {
+	proto := packet.Protocol
+	srcIP, dstIP := packet.SrcIP, packet.DstIP
+	weight := packet.Weight
+	packetBytes := int64(packet.Size) * weight
+	iface := packet.Interface
+	vlan := packet.VLAN
+	dstPort := packet.DstPort
+	external := dstIP != "" && !a.isLocal(dstIP)
+
+	sh := a.shards[packet.FlowHash()%shardCount]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	c := sh.counters
 
 	// Count protocol
-	proto := capture.GetProtocol(packet)
-	a.protocols[proto]++
+	c.protocols[proto] += weight
+
+	// Track per-interface volume
+	if iface.Name != "" {
+		if _, ok := c.interfaces[iface.Name]; !ok {
+			c.interfaces[iface.Name] = &ifaceStats{Subnet: iface.Subnet}
+		}
+		c.interfaces[iface.Name].Packets += weight
+		c.interfaces[iface.Name].Bytes += packetBytes
+	}
 
-	// Get IPs
-	srcIP, dstIP := capture.ExtractIPs(packet)
-	packetSize := capture.GetPacketSize(packet)
+	// Track per-VLAN volume
+	v, ok := c.vlans[vlan]
+	if !ok {
+		v = &vlanStats{protocols: make(map[string]int64)}
+		c.vlans[vlan] = v
+	}
+	v.Packets += weight
+	v.Bytes += packetBytes
+	v.protocols[proto] += weight
 
 	// Track talkers
+	subnet := packet.Subnet()
 	if srcIP != "" {
-		if _, ok := a.talkers[srcIP]; !ok {
-			a.talkers[srcIP] = &talkerStats{}
-		}
-		a.talkers[srcIP].PacketsSent++
-		a.talkers[srcIP].BytesSent += int64(packetSize)
+		talker := c.getTalker(endpointKey{iface: iface.Name, vlan: vlan, ip: srcIP}, subnet)
+		talker.PacketsSent += weight
+		talker.BytesSent += packetBytes
 	}
 	if dstIP != "" {
-		if _, ok := a.talkers[dstIP]; !ok {
-			a.talkers[dstIP] = &talkerStats{}
-		}
-		a.talkers[dstIP].PacketsReceived++
-		a.talkers[dstIP].BytesReceived += int64(packetSize)
+		talker := c.getTalker(endpointKey{iface: iface.Name, vlan: vlan, ip: dstIP}, subnet)
+		talker.PacketsReceived += weight
+		talker.BytesReceived += packetBytes
 	}
 
 	// Track ports
-	_, dstPort, protocol := capture.ExtractPorts(packet)
 	if dstPort > 0 {
-		key := protocol + ":" + itoa(int(dstPort))
-		a.ports[key]++
+		c.ports[portKey{protocol: proto, port: dstPort, vlan: vlan}] += weight
 	}
 
 	// Track external destinations
-	if dstIP != "" && !a.isLocal(dstIP) {
-		if _, ok := a.destinations[dstIP]; !ok {
-			a.destinations[dstIP] = &destStats{}
+	if external {
+		key := endpointKey{iface: iface.Name, vlan: vlan, ip: dstIP}
+		if _, ok := c.destinations[key]; !ok {
+			c.destinations[key] = &destStats{}
 		}
-		a.destinations[dstIP].ConnectionCount++
-		a.destinations[dstIP].BytesTotal += int64(packetSize)
+		c.destinations[key].ConnectionCount += weight
+		c.destinations[key].BytesTotal += packetBytes
 	}
 
 	// Parse DNS
-	a.parseDNS(packet, srcIP)
+	c.parseDNS(packet, srcIP)
+}
+
+// getTalker returns the stats for an endpoint, creating them if needed
+func (c *counters) getTalker(key endpointKey, subnet string) *talkerStats {
+	if _, ok := c.talkers[key]; !ok {
+		c.talkers[key] = &talkerStats{Subnet: subnet}
+	}
+	return c.talkers[key]
 }
 
 // parseDNS extracts DNS query information
-func (a *Analyzer) parseDNS(packet gopacket.Packet, srcIP string) {
-	dnsLayer := packet.Layer(layers.LayerTypeDNS)
-	if dnsLayer == nil {
+func (c *counters) parseDNS(packet *capture.PacketMeta, srcIP string) {
+	if !packet.Has(layers.LayerTypeDNS) {
 		return
 	}
 
-	dns := dnsLayer.(*layers.DNS)
+	dns := &packet.DNS
 
 	// Process queries
 	for _, q := range dns.Questions {
@@ -137,20 +229,31 @@ func (a *Analyzer) parseDNS(packet gopacket.Packet, srcIP string) {
 			continue
 		}
 
-		if _, ok := a.domains[domain]; !ok {
-			a.domains[domain] = &domainStats{
+		key := domainKey{domain: domain, vlan: packet.VLAN}
+		if _, ok := c.domains[key]; !ok {
+			c.domains[key] = &domainStats{
 				QueryingIPs: make(map[string]bool),
 			}
 		}
-		a.domains[domain].QueryCount++
+		c.domains[key].QueryCount += packet.Weight
 		if srcIP != "" {
-			a.domains[domain].QueryingIPs[srcIP] = true
+			c.domains[key].QueryingIPs[srcIP] = true
 		}
 	}
 }
 
+// SetLocalNet sets the local network explicitly, replacing the /16
+// guessed from the sensor's address. It must be called before capture.
+func (a *Analyzer) SetLocalNet(localNet *net.IPNet) {
+	a.localNet = localNet
+}
+
 // isLocal checks if an IP is on the local network
 func (a *Analyzer) isLocal(ip string) bool {
+	if a.localNet != nil {
+		addr := net.ParseIP(ip)
+		return addr != nil && a.localNet.Contains(addr)
+	}
 	if a.localPrefix == "" {
 		return false
 	}
@@ -163,41 +266,138 @@ func (a *Analyzer) isLocal(ip string) bool {
 
 // GetResults returns aggregated traffic statistics
 func (a *Analyzer) GetResults() output.TrafficInfo {
-	a.mu.RLock()
-	defer a.mu.RUnlock()
+	return a.collect(false)
+}
+
+// Rotate returns the statistics for the current window and starts a new one
+func (a *Analyzer) Rotate() output.TrafficInfo {
+	return a.collect(true)
+}
+
+// collect merges every shard into one set of results, optionally
+// clearing the shards. All shards are locked so the result is consistent.
+func (a *Analyzer) collect(reset bool) output.TrafficInfo {
+	for _, sh := range a.shards {
+		sh.mu.Lock()
+	}
+	defer func() {
+		for _, sh := range a.shards {
+			sh.mu.Unlock()
+		}
+	}()
+
+	merged := newCounters()
+	for _, sh := range a.shards {
+		merged.merge(sh.counters)
+		if reset {
+			sh.counters = newCounters()
+		}
+	}
+	return merged.results()
+}
 
+// merge adds another set of counters into c
+func (c *counters) merge(o *counters) {
+	for k, v := range o.protocols {
+		c.protocols[k] += v
+	}
+	for k, v := range o.ports {
+		c.ports[k] += v
+	}
+	for k, v := range o.talkers {
+		t, ok := c.talkers[k]
+		if !ok {
+			t = &talkerStats{Subnet: v.Subnet}
+			c.talkers[k] = t
+		}
+		t.BytesSent += v.BytesSent
+		t.BytesReceived += v.BytesReceived
+		t.PacketsSent += v.PacketsSent
+		t.PacketsReceived += v.PacketsReceived
+	}
+	for k, v := range o.domains {
+		d, ok := c.domains[k]
+		if !ok {
+			d = &domainStats{QueryingIPs: make(map[string]bool)}
+			c.domains[k] = d
+		}
+		d.QueryCount += v.QueryCount
+		for ip := range v.QueryingIPs {
+			d.QueryingIPs[ip] = true
+		}
+	}
+	for k, v := range o.destinations {
+		d, ok := c.destinations[k]
+		if !ok {
+			d = &destStats{}
+			c.destinations[k] = d
+		}
+		d.ConnectionCount += v.ConnectionCount
+		d.BytesTotal += v.BytesTotal
+	}
+	for k, v := range o.interfaces {
+		i, ok := c.interfaces[k]
+		if !ok {
+			i = &ifaceStats{Subnet: v.Subnet}
+			c.interfaces[k] = i
+		}
+		i.Packets += v.Packets
+		i.Bytes += v.Bytes
+	}
+	for k, v := range o.vlans {
+		s, ok := c.vlans[k]
+		if !ok {
+			s = &vlanStats{protocols: make(map[string]int64)}
+			c.vlans[k] = s
+		}
+		s.Packets += v.Packets
+		s.Bytes += v.Bytes
+		for p, n := range v.protocols {
+			s.protocols[p] += n
+		}
+	}
+}
+
+// results builds the output statistics
+func (c *counters) results() output.TrafficInfo {
 	result := output.TrafficInfo{
 		ProtocolCounts: make(map[string]int64),
 	}
 
 	// Copy protocol counts
-	for k, v := range a.protocols {
+	for k, v := range c.protocols {
 		result.ProtocolCounts[k] = v
 	}
 
 	// Get top ports
-	result.TopPorts = a.getTopPorts(20)
+	result.TopPorts = c.getTopPorts(20)
 
 	// Get top talkers
-	result.TopTalkers = a.getTopTalkers(20)
+	result.TopTalkers = c.getTopTalkers(20)
 
 	// Get DNS domains
-	result.DNSDomains = a.getDNSDomains(50)
+	result.DNSDomains = c.getDNSDomains(50)
 
 	// Get destinations
-	result.Destinations = a.getDestinations(20)
+	result.Destinations = c.getDestinations(20)
+
+	// Get per-interface volume
+	result.Interfaces = c.getInterfaces()
+
+	// Get per-VLAN volume
+	result.VLANs = c.getVLANs()
 
 	return result
 }
 
-func (a *Analyzer) getTopPorts(limit int) []output.PortCount {
+func (c *counters) getTopPorts(limit int) []output.PortCount {
 	type portEntry struct {
-		key   string
+		key   portKey
 		count int64
 	}
 
-	entries := make([]portEntry, 0, len(a.ports))
-	for k, v := range a.ports {
+	entries := make([]portEntry, 0, len(c.ports))
+	for k, v := range c.ports {
 		entries = append(entries, portEntry{k, v})
 	}
 
@@ -211,27 +411,27 @@ func (a *Analyzer) getTopPorts(limit int) []output.PortCount {
 
 	result := make([]output.PortCount, 0, len(entries))
 	for _, e := range entries {
-		proto, port := parsePortKey(e.key)
 		result = append(result, output.PortCount{
-			Port:     port,
-			Protocol: proto,
+			Port:     int(e.key.port),
+			Protocol: e.key.protocol,
 			Count:    e.count,
+			VLAN:     e.key.vlan,
 		})
 	}
 	return result
 }
 
-func (a *Analyzer) getTopTalkers(limit int) []output.TalkerInfo {
+func (c *counters) getTopTalkers(limit int) []output.TalkerInfo {
 	type talkerEntry struct {
-		ip    string
+		key   endpointKey
 		stats *talkerStats
 		total int64
 	}
 
-	entries := make([]talkerEntry, 0, len(a.talkers))
-	for ip, stats := range a.talkers {
+	entries := make([]talkerEntry, 0, len(c.talkers))
+	for key, stats := range c.talkers {
 		total := stats.BytesSent + stats.BytesReceived
-		entries = append(entries, talkerEntry{ip, stats, total})
+		entries = append(entries, talkerEntry{key, stats, total})
 	}
 
 	sort.Slice(entries, func(i, j int) bool {
@@ -245,24 +445,27 @@ func (a *Analyzer) getTopTalkers(limit int) []output.TalkerInfo {
 	result := make([]output.TalkerInfo, 0, len(entries))
 	for _, e := range entries {
 		result = append(result, output.TalkerInfo{
-			IP:              e.ip,
+			IP:              e.key.ip,
 			BytesSent:       e.stats.BytesSent,
 			BytesReceived:   e.stats.BytesReceived,
 			PacketsSent:     e.stats.PacketsSent,
 			PacketsReceived: e.stats.PacketsReceived,
+			Interface:       e.key.iface,
+			Subnet:          e.stats.Subnet,
+			VLAN:            e.key.vlan,
 		})
 	}
 	return result
 }
 
-func (a *Analyzer) getDNSDomains(limit int) []output.DNSDomainInfo {
+func (c *counters) getDNSDomains(limit int) []output.DNSDomainInfo {
 	type domainEntry struct {
-		domain string
-		stats  *domainStats
+		key   domainKey
+		stats *domainStats
 	}
 
-	entries := make([]domainEntry, 0, len(a.domains))
-	for d, s := range a.domains {
+	entries := make([]domainEntry, 0, len(c.domains))
+	for d, s := range c.domains {
 		entries = append(entries, domainEntry{d, s})
 	}
 
@@ -281,23 +484,24 @@ func (a *Analyzer) getDNSDomains(limit int) []output.DNSDomainInfo {
 			ips = append(ips, ip)
 		}
 		result = append(result, output.DNSDomainInfo{
-			Domain:      e.domain,
+			Domain:      e.key.domain,
 			QueryCount:  e.stats.QueryCount,
 			QueryingIPs: ips,
+			VLAN:        e.key.vlan,
 		})
 	}
 	return result
 }
 
-func (a *Analyzer) getDestinations(limit int) []output.DestinationInfo {
+func (c *counters) getDestinations(limit int) []output.DestinationInfo {
 	type destEntry struct {
-		address string
-		stats   *destStats
+		key   endpointKey
+		stats *destStats
 	}
 
-	entries := make([]destEntry, 0, len(a.destinations))
-	for addr, s := range a.destinations {
-		entries = append(entries, destEntry{addr, s})
+	entries := make([]destEntry, 0, len(c.destinations))
+	for key, s := range c.destinations {
+		entries = append(entries, destEntry{key, s})
 	}
 
 	sort.Slice(entries, func(i, j int) bool {
@@ -311,11 +515,64 @@ func (a *Analyzer) getDestinations(limit int) []output.DestinationInfo {
 	result := make([]output.DestinationInfo, 0, len(entries))
 	for _, e := range entries {
 		result = append(result, output.DestinationInfo{
-			Address:         e.address,
+			Address:         e.key.ip,
 			ConnectionCount: e.stats.ConnectionCount,
 			BytesTotal:      e.stats.BytesTotal,
+			Interface:       e.key.iface,
+			VLAN:            e.key.vlan,
+		})
+	}
+	return result
+}
+
+func (c *counters) getInterfaces() []output.InterfaceTraffic {
+	result := make([]output.InterfaceTraffic, 0, len(c.interfaces))
+	for name, s := range c.interfaces {
+		result = append(result, output.InterfaceTraffic{
+			Interface: name,
+			Subnet:    s.Subnet,
+			Packets:   s.Packets,
+			Bytes:     s.Bytes,
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Interface < result[j].Interface
+	})
+	return result
+}
+
+// getVLANs returns the per-VLAN breakdown, or nil when no tagged
+// traffic was seen
+func (c *counters) getVLANs() []output.VLANTraffic {
+	tagged := false
+	for vlan := range c.vlans {
+		if vlan != "" {
+			tagged = true
+			break
+		}
+	}
+	if !tagged {
+		return nil
+	}
+
+	result := make([]output.VLANTraffic, 0, len(c.vlans))
+	for vlan, s := range c.vlans {
+		counts := make(map[string]int64, len(s.protocols))
+		for k, v := range s.protocols {
+			counts[k] = v
+		}
+		result = append(result, output.VLANTraffic{
+			VLAN:           vlan,
+			Packets:        s.Packets,
+			Bytes:          s.Bytes,
+			ProtocolCounts: counts,
 		})
 	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].VLAN < result[j].VLAN
+	})
 	return result
 }
 
@@ -336,33 +593,3 @@ func splitIP(ip string) []string {
 	}
 	return result
 }
-
-func itoa(n int) string {
-	if n == 0 {
-		return "0"
-	}
-	result := ""
-	for n > 0 {
-		result = string(rune('0'+n%10)) + result
-		n /= 10
-	}
-	return result
-}
-
-func parsePortKey(key string) (string, int) {
-	proto := ""
-	port := 0
-	inPort := false
-	for _, c := range key {
-		if c == ':' {
-			inPort = true
-			continue
-		}
-		if inPort {
-			port = port*10 + int(c-'0')
-		} else {
-			proto += string(c)
-		}
-	}
-	return proto, port
-}
@@ -0,0 +1,119 @@
+package traffic
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/asset_discovery/sensor/internal/capture"
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// syntheticFlow serializes one packet of flow i: TCP to 443, NTP, or a
+// DNS query, between hosts on 10.0.0.0/16 and external servers
+func syntheticFlow(tb testing.TB, i int) []byte {
+	tb.Helper()
+
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, byte(i >> 8), byte(i)},
+		DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0xff, 0x01},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		SrcIP:    net.IP{10, 0, byte(i >> 8), byte(i)},
+		DstIP:    net.IP{93, 184, byte(i % 16), 34},
+		Protocol: layers.IPProtocolUDP,
+	}
+
+	var stack []gopacket.SerializableLayer
+	switch i % 4 {
+	case 0, 1:
+		ip.Protocol = layers.IPProtocolTCP
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(40000 + i%20000), DstPort: 443, ACK: true, Window: 65535}
+		if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+			tb.Fatal(err)
+		}
+		stack = []gopacket.SerializableLayer{tcp, gopacket.Payload(make([]byte, 512))}
+	case 2:
+		udp := &layers.UDP{SrcPort: layers.UDPPort(50000 + i%10000), DstPort: 123}
+		if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+			tb.Fatal(err)
+		}
+		stack = []gopacket.SerializableLayer{udp, gopacket.Payload(make([]byte, 48))}
+	default:
+		udp := &layers.UDP{SrcPort: layers.UDPPort(50000 + i%10000), DstPort: 53}
+		if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+			tb.Fatal(err)
+		}
+		stack = []gopacket.SerializableLayer{udp, &layers.DNS{
+			ID:      uint16(i),
+			RD:      true,
+			QDCount: 1,
+			Questions: []layers.DNSQuestion{{
+				Name:  []byte(fmt.Sprintf("host%d.example.com", i%64)),
+				Type:  layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+			}},
+		}}
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, append([]gopacket.SerializableLayer{eth, ip}, stack...)...); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// decodeFlows decodes one packet of each of n flows. The packets are
+// not released, so they stay valid for the whole benchmark.
+func decodeFlows(tb testing.TB, n int) []*capture.PacketMeta {
+	tb.Helper()
+
+	decoder := capture.NewDecoder(layers.LinkTypeEthernet)
+	packets := make([]*capture.PacketMeta, n)
+	for i := range packets {
+		packet, err := decoder.Decode(syntheticFlow(tb, i), gopacket.CaptureInfo{})
+		if err != nil {
+			tb.Fatal(err)
+		}
+		packet.Interface = capture.Interface{Name: "eth0", Subnet: "10.0.0.0/16"}
+		packets[i] = packet
+	}
+	return packets
+}
+
+// BenchmarkProcessPacket measures the analyzer's per-packet cost on one
+// goroutine and with every CPU updating the flow-sharded counters at once
+func BenchmarkProcessPacket(b *testing.B) {
+	const flows = 1024
+
+	b.Run("serial", func(b *testing.B) {
+		a := NewAnalyzer("10.0.0.1")
+		packets := decodeFlows(b, flows)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			a.ProcessPacket(packets[i%flows])
+		}
+	})
+
+	b.Run("parallel", func(b *testing.B) {
+		a := NewAnalyzer("10.0.0.1")
+		packets := decodeFlows(b, flows)
+		// Goroutines start on different flows, as workers handle disjoint ones
+		var offset atomic.Int64
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			i := int(offset.Add(flows / 8))
+			for ; pb.Next(); i++ {
+				a.ProcessPacket(packets[i%flows])
+			}
+		})
+	})
+}